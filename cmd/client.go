@@ -0,0 +1,153 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Default address of agent admin API
+const defaultRpcAddr = "http://127.0.0.1:9000"
+
+// Environment variable with admin token for control commands
+const envAdminToken = envPrefix + "ADMIN_TOKEN"
+
+var flagRpcAddr string
+var flagRpcTimeout time.Duration
+var flagToken string
+
+// Call agent admin API, encoding body and decoding response as json
+func adminRequest(method, path string, body, dst interface{}) error {
+	resp, err := adminCall(method, path, body, flagRpcTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	if dst == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(dst); err != nil {
+		return errors.Wrap(err, "error decoding response")
+	}
+
+	return nil
+}
+
+// Call agent admin API encoding body as json, the caller is
+// responsible for closing the body of a successful response
+func adminCall(
+	method, path string,
+	body interface{},
+	timeout time.Duration,
+) (*http.Response, error) {
+	var reader io.Reader
+
+	if body != nil {
+		buf := new(bytes.Buffer)
+
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			return nil, errors.Wrap(err, "error encoding request")
+		}
+
+		reader = buf
+	}
+
+	url := strings.TrimRight(flagRpcAddr, "/") + path
+
+	req, err := http.NewRequest(method, url, reader)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating request to %s", url)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	token := flagToken
+
+	if token == "" {
+		token = os.Getenv(envAdminToken)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := http.Client{Timeout: timeout}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "error calling %s", url)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		//noinspection GoUnhandledErrorResult
+		defer resp.Body.Close()
+
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+		return nil, errors.Errorf("%s returned %s: %s",
+			url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp, nil
+}
+
+// Register flags shared by all the commands talking to an agent
+func addClientFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&flagRpcAddr, "rpc-addr", defaultRpcAddr,
+		"Address of agent admin API")
+
+	cmd.Flags().DurationVar(&flagRpcTimeout, "rpc-timeout", 10*time.Second,
+		"Timeout of admin API requests")
+
+	cmd.Flags().StringVar(&flagToken, "token", "",
+		"Admin token for control commands, "+envAdminToken+" by default")
+}
+
+// Print an error and exit
+func fatal(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+
+	os.Exit(1)
+}
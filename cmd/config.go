@@ -0,0 +1,751 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+
+	"github.com/syhpoon/tattle"
+)
+
+// Prefix of environment variables overriding agent flags
+const envPrefix = "TATTLE_"
+
+// Duration which is represented in json as a string like "1m30s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+
+	if err := json.Unmarshal(data, &str); err != nil {
+		return errors.Errorf("duration must be a string like \"3s\", got %s", data)
+	}
+
+	dur, err := time.ParseDuration(str)
+
+	if err != nil {
+		return errors.Errorf("invalid duration %q", str)
+	}
+
+	*d = Duration(dur)
+
+	return nil
+}
+
+// Detector part of agent configuration
+type DetectorConfig struct {
+	PingInterval        Duration `json:"ping_interval"`
+	PingTimeout         Duration `json:"ping_timeout"`
+	IndirectPingTimeout Duration `json:"indirect_ping_timeout"`
+	IndirectPingPeers   int      `json:"indirect_ping_peers"`
+	SuspicionMult       int      `json:"suspicion_mult"`
+	RetransmitMult      int      `json:"retransmit_mult"`
+	MaxPiggybackUpdates int      `json:"max_piggyback_updates"`
+	MaxHealthScore      int      `json:"max_health_score"`
+	EventLogSize        int      `json:"event_log_size"`
+	// Membership snapshot file used to rejoin after a restart
+	SnapshotPath        string `json:"snapshot_path"`
+	UserEventSizeLimit  int    `json:"user_event_size_limit"`
+	UserEventBufferSize int    `json:"user_event_buffer_size"`
+	QuerySizeLimit      int    `json:"query_size_limit"`
+	// Maximum size of a query response payload
+	QueryResponseSizeLimit int `json:"query_response_size_limit"`
+	QueryTimeoutMult       int `json:"query_timeout_mult"`
+	// Tag naming failure domain of a member, like zone or rack
+	FailureDomainTag string `json:"failure_domain_tag"`
+	// Fraction of members suspected within partition_window
+	// signalling a partition, 0 disables partition detection
+	PartitionThreshold   float64  `json:"partition_threshold"`
+	PartitionMinSuspects int      `json:"partition_min_suspects"`
+	PartitionWindow      Duration `json:"partition_window"`
+	// Don't declare members dead while partitioned
+	PartitionFreeze  bool     `json:"partition_freeze"`
+	PartitionTimeout Duration `json:"partition_timeout"`
+	// Interval of attempts to reach failed members and seeds,
+	// 0 disables reconnecting
+	ReconnectInterval Duration `json:"reconnect_interval"`
+	ReconnectTimeout  Duration `json:"reconnect_timeout"`
+	// Dead and left members are removed after tombstone_timeout,
+	// 0 keeps them forever
+	TombstoneTimeout      Duration `json:"tombstone_timeout"`
+	DeadMemberReclaimTime Duration `json:"dead_member_reclaim_time"`
+	// Maximum number of outbound RPCs in flight
+	MaxConcurrentRpcs int `json:"max_concurrent_rpcs"`
+	// Vivaldi network coordinate settings
+	Coordinate CoordinateConfig `json:"coordinate"`
+}
+
+// Network coordinate part of agent configuration
+type CoordinateConfig struct {
+	Dimensionality       int     `json:"dimensionality"`
+	VivaldiErrorMax      float64 `json:"vivaldi_error_max"`
+	VivaldiCE            float64 `json:"vivaldi_ce"`
+	VivaldiCC            float64 `json:"vivaldi_cc"`
+	AdjustmentWindowSize int     `json:"adjustment_window_size"`
+	// Minimum height term in seconds
+	HeightMin         float64 `json:"height_min"`
+	LatencyFilterSize int     `json:"latency_filter_size"`
+	// Strength of the pull towards the origin, in seconds
+	GravityRho float64 `json:"gravity_rho"`
+}
+
+// Http transport part of agent configuration
+type HttpConfig struct {
+	Listen                 string   `json:"listen"`
+	WriteTimeout           Duration `json:"write_timeout"`
+	ReadTimeout            Duration `json:"read_timeout"`
+	RpcTimeout             Duration `json:"rpc_timeout"`
+	DetectorInjectTimeout  Duration `json:"detector_inject_timeout"`
+	DetectorProcessTimeout Duration `json:"detector_process_timeout"`
+	ShutdownTimeout        Duration `json:"shutdown_timeout"`
+	TLSCertFile            string   `json:"tls_cert_file"`
+	TLSKeyFile             string   `json:"tls_key_file"`
+	IncomingBufferSize     int      `json:"incoming_buffer_size"`
+	CompressThreshold      int      `json:"compress_threshold"`
+}
+
+// Codec part of agent configuration
+type CodecConfig struct {
+	Name           string `json:"name"`
+	MaxMessageSize int64  `json:"max_message_size"`
+	// Wrap messages into a compressing codec if positive
+	CompressThreshold int `json:"compress_threshold"`
+	// Wrap messages into a checksum envelope
+	Checksum bool `json:"checksum"`
+}
+
+// Agent configuration
+type Config struct {
+	// Node name, hostname by default
+	NodeName string `json:"node_name"`
+	// Address other members use to reach this node,
+	// http listen address by default
+	AdvertiseAddr string            `json:"advertise_addr"`
+	Tags          map[string]string `json:"tags"`
+	// Peers to join, either host:port or name@host:port
+	Seeds    []string `json:"seeds"`
+	LogLevel string   `json:"log_level"`
+	// Token protecting control endpoints of admin API,
+	// control endpoints are disabled if empty
+	AdminToken string `json:"admin_token"`
+	Transport  string `json:"transport"`
+	// Scripts invoked on membership events
+	EventHandlers []EventHandlerConfig `json:"event_handlers"`
+	// Maximum run time of an event handler script
+	EventHandlerTimeout Duration       `json:"event_handler_timeout"`
+	Codec               CodecConfig    `json:"codec"`
+	Detector            DetectorConfig `json:"detector"`
+	Http                HttpConfig     `json:"http"`
+}
+
+// Return configuration filled with library defaults
+func DefaultConfig() Config {
+	dp := tattle.DefaultDetectorParams()
+	hp := tattle.DefaulTransportHttpParams()
+
+	return Config{
+		Tags:                map[string]string{},
+		LogLevel:            "info",
+		EventHandlerTimeout: Duration(time.Minute),
+		Transport:           "http",
+		Codec: CodecConfig{
+			Name:           "json",
+			MaxMessageSize: tattle.DefaultMaxMessageSize,
+		},
+		Detector: DetectorConfig{
+			PingInterval:           Duration(dp.PingInterval),
+			PingTimeout:            Duration(dp.PingTimeout),
+			IndirectPingTimeout:    Duration(dp.IndirectPingTimeout),
+			IndirectPingPeers:      dp.IndirectPingPeers,
+			SuspicionMult:          dp.SuspicionMult,
+			RetransmitMult:         dp.RetransmitMult,
+			MaxPiggybackUpdates:    dp.MaxPiggybackUpdates,
+			MaxHealthScore:         dp.MaxHealthScore,
+			EventLogSize:           dp.EventLogSize,
+			UserEventSizeLimit:     dp.UserEventSizeLimit,
+			UserEventBufferSize:    dp.UserEventBufferSize,
+			QuerySizeLimit:         dp.QuerySizeLimit,
+			QueryResponseSizeLimit: dp.QueryResponseSizeLimit,
+			QueryTimeoutMult:       dp.QueryTimeoutMult,
+			PartitionThreshold:     dp.PartitionThreshold,
+			PartitionMinSuspects:   dp.PartitionMinSuspects,
+			PartitionWindow:        Duration(dp.PartitionWindow),
+			PartitionFreeze:        dp.PartitionFreeze,
+			PartitionTimeout:       Duration(dp.PartitionTimeout),
+			ReconnectInterval:      Duration(dp.ReconnectInterval),
+			ReconnectTimeout:       Duration(dp.ReconnectTimeout),
+			TombstoneTimeout:       Duration(dp.TombstoneTimeout),
+			DeadMemberReclaimTime:  Duration(dp.DeadMemberReclaimTime),
+			MaxConcurrentRpcs:      dp.MaxConcurrentRpcs,
+			Coordinate: CoordinateConfig{
+				Dimensionality:       dp.Coordinate.Dimensionality,
+				VivaldiErrorMax:      dp.Coordinate.VivaldiErrorMax,
+				VivaldiCE:            dp.Coordinate.VivaldiCE,
+				VivaldiCC:            dp.Coordinate.VivaldiCC,
+				AdjustmentWindowSize: dp.Coordinate.AdjustmentWindowSize,
+				HeightMin:            dp.Coordinate.HeightMin,
+				LatencyFilterSize:    dp.Coordinate.LatencyFilterSize,
+				GravityRho:           dp.Coordinate.GravityRho,
+			},
+		},
+		Http: HttpConfig{
+			Listen:                 ":9000",
+			WriteTimeout:           Duration(hp.WriteTimeout),
+			ReadTimeout:            Duration(hp.ReadTimeout),
+			RpcTimeout:             Duration(hp.RpcTimeout),
+			DetectorInjectTimeout:  Duration(hp.DetectorInjectTimeout),
+			DetectorProcessTimeout: Duration(hp.DetectorProcessTimeout),
+			ShutdownTimeout:        Duration(hp.ShutdownTimeout),
+			IncomingBufferSize:     hp.IncomingBufferSize,
+			CompressThreshold:      hp.CompressThreshold,
+		},
+	}
+}
+
+// Overlay configuration with values from a file. Format is chosen by
+// extension: .yaml/.yml, .toml, or json otherwise.
+// Fields missing in the file keep their current values.
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return errors.Wrap(err, "error opening config file")
+	}
+
+	// Other formats are converted to json, so that all of them share
+	// field names, duration parsing and unknown field checks
+	var doc map[string]interface{}
+
+	converted := true
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		_, err = toml.Decode(string(data), &doc)
+	default:
+		converted = false
+	}
+
+	if err == nil && converted {
+		// Empty or comment-only file keeps the current values
+		if doc == nil {
+			doc = map[string]interface{}{}
+		}
+
+		data, err = json.Marshal(doc)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "error parsing config file %s", path)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(c); err != nil {
+		return errors.Wrapf(err, "error parsing config file %s", path)
+	}
+
+	return nil
+}
+
+// Check configuration, reporting all the problems at once
+func (c *Config) Validate() error {
+	var problems []string
+
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, errors.Errorf(format, args...).Error())
+	}
+
+	positive := func(name string, d Duration) {
+		if d <= 0 {
+			fail("%s must be positive, got %s", name, time.Duration(d))
+		}
+	}
+
+	if _, err := tattle.ParseLogLevel(c.LogLevel); err != nil {
+		fail("log_level: %s", err)
+	}
+
+	if c.Transport != "http" {
+		fail("transport: unsupported transport %q, possible values: http",
+			c.Transport)
+	}
+
+	for i, h := range c.EventHandlers {
+		if err := h.validate(); err != nil {
+			fail("event_handlers[%d]: %s", i, err)
+		}
+	}
+
+	positive("event_handler_timeout", c.EventHandlerTimeout)
+
+	if c.Codec.Name != "json" {
+		fail("codec.name: unsupported codec %q, possible values: json",
+			c.Codec.Name)
+	}
+
+	if c.Codec.MaxMessageSize < 0 {
+		fail("codec.max_message_size must not be negative")
+	}
+
+	if len(c.Seeds) == 0 && c.Detector.SnapshotPath == "" {
+		fail("at least one seed peer is required, use --join or seeds")
+	}
+
+	for _, seed := range c.Seeds {
+		if _, err := tattle.ParseHttpPeer(seed, "http"); err != nil {
+			fail("seeds: %s", err)
+		}
+	}
+
+	if c.AdvertiseAddr != "" {
+		if _, err := tattle.ParseHttpPeer(c.AdvertiseAddr, "http"); err != nil {
+			fail("advertise_addr: %s", err)
+		}
+	}
+
+	for k := range c.Tags {
+		if k == "" {
+			fail("tags: empty tag name")
+		}
+	}
+
+	det := c.Detector
+
+	positive("detector.ping_interval", det.PingInterval)
+	positive("detector.ping_timeout", det.PingTimeout)
+	positive("detector.indirect_ping_timeout", det.IndirectPingTimeout)
+
+	if det.PingTimeout >= det.PingInterval {
+		fail("detector.ping_timeout (%s) must be less than "+
+			"detector.ping_interval (%s)",
+			time.Duration(det.PingTimeout), time.Duration(det.PingInterval))
+	}
+
+	if det.IndirectPingTimeout <= det.PingTimeout {
+		fail("detector.indirect_ping_timeout (%s) must be greater than "+
+			"detector.ping_timeout (%s) as helpers need time to ping the target",
+			time.Duration(det.IndirectPingTimeout), time.Duration(det.PingTimeout))
+	}
+
+	if det.IndirectPingPeers < 0 {
+		fail("detector.indirect_ping_peers must not be negative")
+	}
+
+	for name, val := range map[string]int{
+		"detector.suspicion_mult":                 det.SuspicionMult,
+		"detector.retransmit_mult":                det.RetransmitMult,
+		"detector.max_piggyback_updates":          det.MaxPiggybackUpdates,
+		"detector.event_log_size":                 det.EventLogSize,
+		"detector.user_event_size_limit":          det.UserEventSizeLimit,
+		"detector.user_event_buffer_size":         det.UserEventBufferSize,
+		"detector.query_size_limit":               det.QuerySizeLimit,
+		"detector.query_response_size_limit":      det.QueryResponseSizeLimit,
+		"detector.query_timeout_mult":             det.QueryTimeoutMult,
+		"detector.max_concurrent_rpcs":            det.MaxConcurrentRpcs,
+		"detector.coordinate.dimensionality":      det.Coordinate.Dimensionality,
+		"detector.coordinate.latency_filter_size": det.Coordinate.LatencyFilterSize,
+	} {
+		if val < 1 {
+			fail("%s must be at least 1, got %d", name, val)
+		}
+	}
+
+	if det.MaxHealthScore < 0 {
+		fail("detector.max_health_score must not be negative")
+	}
+
+	if det.PartitionThreshold < 0 || det.PartitionThreshold > 1 {
+		fail("detector.partition_threshold must be between 0 and 1, got %g",
+			det.PartitionThreshold)
+	}
+
+	if det.PartitionThreshold > 0 {
+		positive("detector.partition_window", det.PartitionWindow)
+	}
+
+	if det.PartitionTimeout < 0 {
+		fail("detector.partition_timeout must not be negative")
+	}
+
+	if det.ReconnectInterval < 0 {
+		fail("detector.reconnect_interval must not be negative")
+	}
+
+	if det.ReconnectInterval > 0 {
+		positive("detector.reconnect_timeout", det.ReconnectTimeout)
+	}
+
+	if det.TombstoneTimeout < 0 {
+		fail("detector.tombstone_timeout must not be negative")
+	}
+
+	if det.DeadMemberReclaimTime < 0 {
+		fail("detector.dead_member_reclaim_time must not be negative")
+	}
+
+	coord := det.Coordinate
+
+	for name, val := range map[string]float64{
+		"detector.coordinate.vivaldi_error_max": coord.VivaldiErrorMax,
+		"detector.coordinate.vivaldi_ce":        coord.VivaldiCE,
+		"detector.coordinate.vivaldi_cc":        coord.VivaldiCC,
+		"detector.coordinate.gravity_rho":       coord.GravityRho,
+	} {
+		if val <= 0 {
+			fail("%s must be positive, got %g", name, val)
+		}
+	}
+
+	for name, val := range map[string]float64{
+		"detector.coordinate.adjustment_window_size": float64(
+			coord.AdjustmentWindowSize),
+		"detector.coordinate.height_min": coord.HeightMin,
+	} {
+		if val < 0 {
+			fail("%s must not be negative, got %g", name, val)
+		}
+	}
+
+	h := c.Http
+
+	if _, _, err := net.SplitHostPort(h.Listen); err != nil {
+		fail("http.listen: %s", err)
+	}
+
+	positive("http.write_timeout", h.WriteTimeout)
+	positive("http.read_timeout", h.ReadTimeout)
+	positive("http.rpc_timeout", h.RpcTimeout)
+	positive("http.detector_inject_timeout", h.DetectorInjectTimeout)
+	positive("http.detector_process_timeout", h.DetectorProcessTimeout)
+
+	if h.ShutdownTimeout < 0 {
+		fail("http.shutdown_timeout must not be negative")
+	}
+
+	if (h.TLSCertFile == "") != (h.TLSKeyFile == "") {
+		fail("http.tls_cert_file and http.tls_key_file must be set together")
+	}
+
+	for _, file := range []string{h.TLSCertFile, h.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+
+		if _, err := os.Stat(file); err != nil {
+			fail("http: %s", err)
+		}
+	}
+
+	if h.IncomingBufferSize < 0 {
+		fail("http.incoming_buffer_size must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration:\n  %s",
+			strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// Build agent configuration from defaults, config file, environment
+// and command line flags, in order of increasing precedence.
+// Every flag can be set with TATTLE_<FLAG_NAME> environment variable.
+func loadConfig(cmd *cobra.Command) (Config, error) {
+	flags := cmd.Flags()
+
+	var err error
+
+	// Environment variables count as flags which were not set explicitly
+	flags.VisitAll(func(f *pflag.Flag) {
+		val, ok := os.LookupEnv(envName(f.Name))
+
+		if !ok || f.Changed || err != nil {
+			return
+		}
+
+		if e := flags.Set(f.Name, val); e != nil {
+			err = errors.Wrapf(e, "invalid %s", envName(f.Name))
+		}
+	})
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := DefaultConfig()
+
+	if flagConfig != "" {
+		if err := cfg.LoadFile(flagConfig); err != nil {
+			return cfg, err
+		}
+	}
+
+	flags.Visit(func(f *pflag.Flag) {
+		switch f.Name {
+		case "codec":
+			cfg.Codec.Name = flagCodec
+		case "transport":
+			cfg.Transport = flagTransport
+		case "http-listen":
+			cfg.Http.Listen = flagHttpListen
+		case "log-level":
+			cfg.LogLevel = flagLogLevel
+		case "admin-token":
+			cfg.AdminToken = flagAdminToken
+		case "node-name":
+			cfg.NodeName = flagNodeName
+		case "advertise":
+			cfg.AdvertiseAddr = flagAdvertise
+		case "join":
+			cfg.Seeds = flagJoin
+		case "tls-cert":
+			cfg.Http.TLSCertFile = flagTLSCert
+		case "tls-key":
+			cfg.Http.TLSKeyFile = flagTLSKey
+		case "event-handler":
+			cfg.EventHandlers = nil
+
+			for _, spec := range flagEventHandlers {
+				h, e := parseEventHandler(spec)
+
+				if e != nil {
+					err = errors.Wrapf(e, "invalid event handler %q", spec)
+
+					return
+				}
+
+				cfg.EventHandlers = append(cfg.EventHandlers, h)
+			}
+		case "tag":
+			for _, tag := range flagTags {
+				parts := strings.SplitN(tag, "=", 2)
+
+				if len(parts) != 2 {
+					err = errors.Errorf("invalid tag %q, expected key=value", tag)
+
+					return
+				}
+
+				if cfg.Tags == nil {
+					cfg.Tags = map[string]string{}
+				}
+
+				cfg.Tags[parts[0]] = parts[1]
+			}
+		}
+	})
+
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.NodeName == "" {
+		if cfg.NodeName, err = os.Hostname(); err != nil {
+			return cfg, errors.Wrap(err, "error getting hostname")
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Return environment variable name for a flag
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// Return protocol peers should use to reach this node
+func (c *Config) protocol() string {
+	if c.Http.TLSCertFile != "" {
+		return "https"
+	}
+
+	return "http"
+}
+
+// Return peer other members use to reach this node
+func (c *Config) localPeer() (tattle.HttpPeer, error) {
+	addr := c.AdvertiseAddr
+
+	if addr == "" {
+		addr = c.Http.Listen
+
+		host, port, err := net.SplitHostPort(addr)
+
+		if err != nil {
+			return tattle.HttpPeer{}, errors.Wrap(err, "invalid listen address")
+		}
+
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			if host, err = os.Hostname(); err != nil {
+				return tattle.HttpPeer{}, errors.Wrap(err, "error getting hostname")
+			}
+		}
+
+		addr = net.JoinHostPort(host, port)
+	}
+
+	peer, err := tattle.ParseHttpPeer(addr, c.protocol())
+
+	if err != nil {
+		return peer, err
+	}
+
+	peer.Id = c.NodeName
+
+	return peer, nil
+}
+
+// Return seed peers
+func (c *Config) seedPeers() ([]tattle.Peer, error) {
+	peers := make([]tattle.Peer, 0, len(c.Seeds))
+
+	for _, seed := range c.Seeds {
+		peer, err := tattle.ParseHttpPeer(seed, c.protocol())
+
+		if err != nil {
+			return nil, err
+		}
+
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+// Create a codec according to configuration
+func (c *Config) codec() tattle.Codec {
+	json := tattle.NewCodecJson()
+	json.MaxMessageSize = c.Codec.MaxMessageSize
+
+	var codec tattle.Codec = json
+
+	if c.Codec.CompressThreshold > 0 {
+		codec = tattle.NewCodecCompress(codec, c.Codec.CompressThreshold)
+	}
+
+	if c.Codec.Checksum {
+		checksum := tattle.NewCodecChecksum(codec)
+		checksum.MaxMessageSize = c.Codec.MaxMessageSize
+		codec = checksum
+	}
+
+	return codec
+}
+
+// Fill detector parameters from configuration
+func (c *Config) applyDetector(params *tattle.DetectorParams) {
+	tune := c.tuning()
+
+	params.Tags = c.Tags
+	params.PingInterval = tune.PingInterval
+	params.PingTimeout = tune.PingTimeout
+	params.IndirectPingTimeout = tune.IndirectPingTimeout
+	params.IndirectPingPeers = tune.IndirectPingPeers
+	params.SuspicionMult = tune.SuspicionMult
+	params.RetransmitMult = tune.RetransmitMult
+	params.MaxPiggybackUpdates = tune.MaxPiggybackUpdates
+	params.MaxHealthScore = tune.MaxHealthScore
+	params.EventLogSize = c.Detector.EventLogSize
+	params.SnapshotPath = c.Detector.SnapshotPath
+	params.UserEventSizeLimit = c.Detector.UserEventSizeLimit
+	params.UserEventBufferSize = c.Detector.UserEventBufferSize
+	params.QuerySizeLimit = c.Detector.QuerySizeLimit
+	params.QueryResponseSizeLimit = c.Detector.QueryResponseSizeLimit
+	params.QueryTimeoutMult = c.Detector.QueryTimeoutMult
+	params.FailureDomainTag = c.Detector.FailureDomainTag
+	params.PartitionThreshold = c.Detector.PartitionThreshold
+	params.PartitionMinSuspects = c.Detector.PartitionMinSuspects
+	params.PartitionWindow = time.Duration(c.Detector.PartitionWindow)
+	params.PartitionFreeze = c.Detector.PartitionFreeze
+	params.PartitionTimeout = time.Duration(c.Detector.PartitionTimeout)
+	params.ReconnectInterval = time.Duration(c.Detector.ReconnectInterval)
+	params.ReconnectTimeout = time.Duration(c.Detector.ReconnectTimeout)
+	params.TombstoneTimeout = time.Duration(c.Detector.TombstoneTimeout)
+	params.DeadMemberReclaimTime = time.Duration(c.Detector.DeadMemberReclaimTime)
+	params.MaxConcurrentRpcs = c.Detector.MaxConcurrentRpcs
+	params.Coordinate = tattle.CoordinateParams{
+		Dimensionality:       c.Detector.Coordinate.Dimensionality,
+		VivaldiErrorMax:      c.Detector.Coordinate.VivaldiErrorMax,
+		VivaldiCE:            c.Detector.Coordinate.VivaldiCE,
+		VivaldiCC:            c.Detector.Coordinate.VivaldiCC,
+		AdjustmentWindowSize: c.Detector.Coordinate.AdjustmentWindowSize,
+		HeightMin:            c.Detector.Coordinate.HeightMin,
+		LatencyFilterSize:    c.Detector.Coordinate.LatencyFilterSize,
+		GravityRho:           c.Detector.Coordinate.GravityRho,
+	}
+}
+
+// Return detector settings which can be changed at runtime
+func (c *Config) tuning() tattle.DetectorTuning {
+	det := c.Detector
+
+	return tattle.DetectorTuning{
+		PingInterval:        time.Duration(det.PingInterval),
+		PingTimeout:         time.Duration(det.PingTimeout),
+		IndirectPingTimeout: time.Duration(det.IndirectPingTimeout),
+		IndirectPingPeers:   det.IndirectPingPeers,
+		SuspicionMult:       det.SuspicionMult,
+		RetransmitMult:      det.RetransmitMult,
+		MaxPiggybackUpdates: det.MaxPiggybackUpdates,
+		MaxHealthScore:      det.MaxHealthScore,
+	}
+}
+
+// Fill http transport parameters from configuration
+func (c *Config) applyHttp(params *tattle.TransportHttpParams) {
+	h := c.Http
+
+	params.WriteTimeout = time.Duration(h.WriteTimeout)
+	params.ReadTimeout = time.Duration(h.ReadTimeout)
+	params.RpcTimeout = time.Duration(h.RpcTimeout)
+	params.DetectorInjectTimeout = time.Duration(h.DetectorInjectTimeout)
+	params.DetectorProcessTimeout = time.Duration(h.DetectorProcessTimeout)
+	params.ShutdownTimeout = time.Duration(h.ShutdownTimeout)
+	params.TLSCertFile = h.TLSCertFile
+	params.TLSKeyFile = h.TLSKeyFile
+	params.IncomingBufferSize = h.IncomingBufferSize
+	params.CompressThreshold = h.CompressThreshold
+}
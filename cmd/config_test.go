@@ -0,0 +1,285 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syhpoon/tattle"
+)
+
+// Write a file into a temporary directory and return its path
+func writeTempFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("write %s: %s", path, err)
+	}
+
+	return path
+}
+
+func TestLoadFileFormats(t *testing.T) {
+	want := DefaultConfig()
+	want.NodeName = "node-1"
+	want.Tags = map[string]string{"zone": "a"}
+	want.Detector.PingInterval = Duration(2 * time.Second)
+	want.Detector.PartitionFreeze = true
+	want.Detector.Coordinate.Dimensionality = 4
+	want.Detector.Coordinate.GravityRho = 100.5
+	want.Http.Listen = "127.0.0.1:9100"
+
+	tests := []struct {
+		file    string
+		content string
+		// File only keeps the defaults
+		empty bool
+	}{
+		{file: "config.json", content: `{
+  "node_name": "node-1",
+  "tags": {"zone": "a"},
+  "detector": {
+    "ping_interval": "2s",
+    "partition_freeze": true,
+    "coordinate": {"dimensionality": 4, "gravity_rho": 100.5}
+  },
+  "http": {"listen": "127.0.0.1:9100"}
+}`},
+		{file: "config.yaml", content: `
+node_name: node-1
+tags:
+  zone: a
+detector:
+  ping_interval: 2s
+  partition_freeze: true
+  coordinate:
+    dimensionality: 4
+    gravity_rho: 100.5
+http:
+  listen: 127.0.0.1:9100
+`},
+		{file: "config.yml", content: `{node_name: node-1, tags: {zone: a},
+detector: {ping_interval: 2s, partition_freeze: true,
+  coordinate: {dimensionality: 4, gravity_rho: 100.5}},
+http: {listen: "127.0.0.1:9100"}}`},
+		{file: "config.toml", content: `
+node_name = "node-1"
+
+[tags]
+zone = "a"
+
+[detector]
+ping_interval = "2s"
+partition_freeze = true
+
+[detector.coordinate]
+dimensionality = 4
+gravity_rho = 100.5
+
+[http]
+listen = "127.0.0.1:9100"
+`},
+		{file: "empty.yaml", content: "", empty: true},
+		{file: "comments.yaml", content: "# nothing here yet\n", empty: true},
+		{file: "empty.toml", content: "", empty: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			cfg := DefaultConfig()
+
+			if err := cfg.LoadFile(writeTempFile(t, test.file, test.content)); err != nil {
+				t.Fatalf("load: %+v", err)
+			}
+
+			expected := want
+
+			if test.empty {
+				expected = DefaultConfig()
+			}
+
+			if !reflect.DeepEqual(cfg, expected) {
+				t.Errorf("got %+v\nwant %+v", cfg, expected)
+			}
+		})
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{"unknown json field", "c.json", `{"node_nmae": "x"}`, "unknown field"},
+		{"unknown yaml field", "c.yaml", "node_nmae: x\n", "unknown field"},
+		{"unknown toml field", "c.toml", "node_nmae = \"x\"\n", "unknown field"},
+		{"bad duration", "c.yaml", "detector: {ping_interval: 2}\n",
+			"duration must be a string"},
+		{"bad yaml", "c.yaml", "node_name: [\n", "error parsing"},
+		{"bad toml", "c.toml", "node_name = \n", "error parsing"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			err := cfg.LoadFile(writeTempFile(t, test.file, test.content))
+
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want it to contain %q", err, test.wantErr)
+			}
+		})
+	}
+
+	cfg := DefaultConfig()
+
+	if err := cfg.LoadFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"ping timeout above interval", func(c *Config) {
+			c.Detector.PingTimeout = Duration(5 * time.Second)
+		}, "detector.ping_timeout"},
+		{"bad listen address", func(c *Config) {
+			c.Http.Listen = "nowhere"
+		}, "http.listen"},
+		{"negative shutdown timeout", func(c *Config) {
+			c.Http.ShutdownTimeout = Duration(-time.Second)
+		}, "http.shutdown_timeout"},
+		{"zero coordinate dimensionality", func(c *Config) {
+			c.Detector.Coordinate.Dimensionality = 0
+		}, "detector.coordinate.dimensionality"},
+		{"zero vivaldi error", func(c *Config) {
+			c.Detector.Coordinate.VivaldiErrorMax = 0
+		}, "detector.coordinate.vivaldi_error_max"},
+		{"zero vivaldi ce", func(c *Config) {
+			c.Detector.Coordinate.VivaldiCE = 0
+		}, "detector.coordinate.vivaldi_ce"},
+		{"negative vivaldi cc", func(c *Config) {
+			c.Detector.Coordinate.VivaldiCC = -0.5
+		}, "detector.coordinate.vivaldi_cc"},
+		{"negative gravity", func(c *Config) {
+			c.Detector.Coordinate.GravityRho = -1
+		}, "detector.coordinate.gravity_rho"},
+		{"zero gravity", func(c *Config) {
+			c.Detector.Coordinate.GravityRho = 0
+		}, "detector.coordinate.gravity_rho"},
+		{"unsupported transport", func(c *Config) {
+			c.Transport = "carrier-pigeon"
+		}, "transport"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.NodeName = "node"
+			cfg.Seeds = []string{"127.0.0.1:9001"}
+			test.modify(&cfg)
+
+			err := cfg.Validate()
+
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case test.wantErr != "" &&
+				(err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("error = %v, want it to mention %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyDetectorCoordinate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Detector.Coordinate.Dimensionality = 3
+	cfg.Detector.Coordinate.LatencyFilterSize = 5
+
+	params := tattle.DefaultDetectorParams()
+	cfg.applyDetector(&params)
+
+	want := tattle.DefaultCoordinateParams()
+	want.Dimensionality = 3
+	want.LatencyFilterSize = 5
+
+	if params.Coordinate != want {
+		t.Errorf("coordinate params = %+v, want %+v", params.Coordinate, want)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeTempFile(t, "config.yaml", `
+node_name: file-node
+log_level: warning
+seeds: [127.0.0.1:9001]
+http:
+  listen: 127.0.0.1:9200
+`)
+
+	t.Setenv("TATTLE_LOG_LEVEL", "debug")
+	t.Setenv("TATTLE_NODE_NAME", "env-node")
+
+	if err := RootCmd.ParseFlags([]string{
+		"--config", path, "--node-name", "flag-node"}); err != nil {
+		t.Fatalf("parse flags: %s", err)
+	}
+
+	cfg, err := loadConfig(RootCmd)
+
+	if err != nil {
+		t.Fatalf("load config: %+v", err)
+	}
+
+	tests := []struct {
+		setting   string
+		got, want string
+	}{
+		{"flag beats env and file", cfg.NodeName, "flag-node"},
+		{"env beats file", cfg.LogLevel, "debug"},
+		{"file beats default", cfg.Http.Listen, "127.0.0.1:9200"},
+		{"default", cfg.Codec.Name, "json"},
+	}
+
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.setting, test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+
+	"github.com/syhpoon/tattle"
+)
+
+var JoinCmd = &cobra.Command{
+	Use:   "join <peer>...",
+	Short: "Make a running agent join more peers",
+	Long: `Make a running agent join more peers.
+
+Peers are given as [name@][proto://]host:port. The agent exchanges full
+membership state with each of them.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var resp tattle.AdminJoinResponse
+
+		if err := adminRequest(http.MethodPost, "/v1/admin/join",
+			tattle.AdminJoinRequest{Peers: args}, &resp); err != nil {
+			fatal("error joining peers: %s", err)
+		}
+
+		fmt.Printf("Successfully joined %d of %d peers\n", resp.Joined, len(args))
+	},
+}
+
+var LeaveCmd = &cobra.Command{
+	Use:   "leave",
+	Short: "Make a running agent leave the cluster gracefully",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var local tattle.AdminMember
+
+		if err := adminRequest(
+			http.MethodPost, "/v1/admin/leave", nil, &local); err != nil {
+			fatal("error leaving the cluster: %s", err)
+		}
+
+		fmt.Printf("%s left the cluster\n", local.Id)
+	},
+}
+
+var ForceLeaveCmd = &cobra.Command{
+	Use:   "force-leave <name>",
+	Short: "Force a failed member to leave the cluster",
+	Long: `Force a failed member to leave the cluster.
+
+The member is not probed anymore and its departure is spread to the other
+members. Only dead members can be forced to leave.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := adminRequest(http.MethodPost, "/v1/admin/force-leave",
+			tattle.AdminForceLeaveRequest{Id: args[0]}, nil); err != nil {
+			fatal("error forcing %s to leave: %s", args[0], err)
+		}
+
+		fmt.Printf("%s was forced to leave\n", args[0])
+	},
+}
+
+var ReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Make a running agent reload its configuration",
+	Long: `Make a running agent reload its configuration, same as sending SIGHUP.
+
+Changes of log level, tags, event handlers, probe tuning and TLS
+certificate are applied at runtime, other changes require a restart.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := adminRequest(
+			http.MethodPost, "/v1/admin/reload", nil, nil); err != nil {
+			fatal("error reloading configuration: %s", err)
+		}
+
+		fmt.Println("Configuration reloaded")
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{
+		JoinCmd, LeaveCmd, ForceLeaveCmd, ReloadCmd} {
+
+		addClientFlags(cmd)
+
+		RootCmd.AddCommand(cmd)
+	}
+}
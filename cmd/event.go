@@ -0,0 +1,84 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/syhpoon/tattle"
+)
+
+var flagEventCoalesce bool
+
+var EventCmd = &cobra.Command{
+	Use:   "event <name> [payload]",
+	Short: "Fire a user event through a running agent",
+	Long: `Fire a user event through a running agent.
+
+The event is disseminated to every member of the cluster and passed to
+their "user" event handlers. Payload "-" is read from stdin.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ureq := tattle.AdminUserEventRequest{
+			Name:     args[0],
+			Coalesce: flagEventCoalesce,
+		}
+
+		if len(args) > 1 {
+			ureq.Payload = args[1]
+		}
+
+		if ureq.Payload == "-" {
+			payload, err := ioutil.ReadAll(os.Stdin)
+
+			if err != nil {
+				fatal("error reading payload: %s", err)
+			}
+
+			ureq.Payload = string(payload)
+		}
+
+		if err := adminRequest(
+			http.MethodPost, "/v1/admin/event", ureq, nil); err != nil {
+			fatal("error firing event: %s", err)
+		}
+
+		fmt.Printf("Event %s fired\n", ureq.Name)
+	},
+}
+
+func init() {
+	addClientFlags(EventCmd)
+
+	EventCmd.Flags().BoolVar(&flagEventCoalesce, "coalesce", true,
+		"Only deliver the latest of pending events with the same name")
+
+	RootCmd.AddCommand(EventCmd)
+}
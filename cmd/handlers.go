@@ -0,0 +1,485 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/syhpoon/tattle"
+)
+
+// Event type matching all user events, "user:<name>" matches
+// user events with the given name
+const userEventType = "user"
+
+// Event type matching all queries, "query:<name>" matches queries
+// with the given name. Output of the first matching handler
+// is sent back as the query response.
+const queryEventType = "query"
+
+// Event handler script configuration
+type EventHandlerConfig struct {
+	// Event types handled by the script, all events except
+	// queries if empty
+	Events []string `json:"events"`
+	// Only handle events about members whose tags match the
+	// regexps, members missing a tag never match and an empty
+	// regexp only requires the tag to be present.
+	// User events are not filtered by tags.
+	Tags map[string]string `json:"tags"`
+	// Command run by /bin/sh
+	Command string `json:"command"`
+}
+
+// Parse event handler specified as [event[,event...]=]command
+func parseEventHandler(spec string) (EventHandlerConfig, error) {
+	h := EventHandlerConfig{Command: spec}
+
+	if idx := strings.Index(spec, "="); idx > 0 &&
+		!strings.ContainsAny(spec[:idx], " \t/") {
+
+		h.Events = strings.Split(spec[:idx], ",")
+		h.Command = spec[idx+1:]
+	}
+
+	return h, h.validate()
+}
+
+// Check handler configuration
+func (h EventHandlerConfig) validate() error {
+	if strings.TrimSpace(h.Command) == "" {
+		return errors.New("empty command")
+	}
+
+	for _, name := range h.Events {
+		if name == userEventType || strings.HasPrefix(name, userEventType+":") ||
+			name == queryEventType || strings.HasPrefix(name, queryEventType+":") {
+			continue
+		}
+
+		var typ tattle.MemberEventType
+
+		if err := typ.UnmarshalText([]byte(name)); err != nil {
+			return errors.Errorf("unknown event type %q", name)
+		}
+	}
+
+	for key, expr := range h.Tags {
+		if _, err := compileAnchored(expr); err != nil {
+			return errors.Errorf("invalid filter for tag %s: %s", key, err)
+		}
+	}
+
+	return nil
+}
+
+// Compiled event handler
+type eventHandler struct {
+	config EventHandlerConfig
+	// Handle every event
+	all    bool
+	events map[tattle.MemberEventType]bool
+	// Handle every user event
+	allUser bool
+	user    map[string]bool
+	// Handle every query
+	allQuery bool
+	query    map[string]bool
+	tags     map[string]*regexp.Regexp
+}
+
+func newEventHandler(config EventHandlerConfig) (*eventHandler, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	h := &eventHandler{
+		config: config,
+		all:    len(config.Events) == 0,
+		events: map[tattle.MemberEventType]bool{},
+		user:   map[string]bool{},
+		query:  map[string]bool{},
+		tags:   map[string]*regexp.Regexp{},
+	}
+
+	for _, name := range config.Events {
+		if name == userEventType {
+			h.allUser = true
+
+			continue
+		}
+
+		if strings.HasPrefix(name, userEventType+":") {
+			h.user[strings.TrimPrefix(name, userEventType+":")] = true
+
+			continue
+		}
+
+		if name == queryEventType {
+			h.allQuery = true
+
+			continue
+		}
+
+		if strings.HasPrefix(name, queryEventType+":") {
+			h.query[strings.TrimPrefix(name, queryEventType+":")] = true
+
+			continue
+		}
+
+		var typ tattle.MemberEventType
+
+		_ = typ.UnmarshalText([]byte(name))
+
+		h.events[typ] = true
+	}
+
+	for key, expr := range config.Tags {
+		// Nil for an empty expression, which only requires the tag
+		h.tags[key], _ = compileAnchored(expr)
+	}
+
+	return h, nil
+}
+
+// Check if the handler is interested in the membership event
+func (h *eventHandler) match(ev tattle.MemberEvent) bool {
+	if !h.all && !h.events[ev.Type] {
+		return false
+	}
+
+	for key, re := range h.tags {
+		val, ok := ev.Member.Tags[key]
+
+		if !ok || (re != nil && !re.MatchString(val)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Check if the handler is interested in the user event
+func (h *eventHandler) matchUser(ev tattle.UserEvent) bool {
+	return h.all || h.allUser || h.user[ev.Name]
+}
+
+// Check if the handler answers the query
+func (h *eventHandler) matchQuery(q tattle.Query) bool {
+	return h.allQuery || h.query[q.Name]
+}
+
+// Runs handler scripts for membership and user events one by one,
+// so that scripts observe events in order
+type eventDispatcher struct {
+	logger     tattle.Logger
+	userEvents chan tattle.UserEvent
+
+	mu       sync.Mutex
+	detector *tattle.Detector
+	handlers []*eventHandler
+	timeout  time.Duration
+}
+
+func newEventDispatcher(logger tattle.Logger) *eventDispatcher {
+	return &eventDispatcher{
+		logger:     logger,
+		userEvents: make(chan tattle.UserEvent, 64),
+	}
+}
+
+// Replace the handlers and their run time limit
+func (e *eventDispatcher) configure(
+	configs []EventHandlerConfig, timeout time.Duration) error {
+
+	handlers := make([]*eventHandler, 0, len(configs))
+
+	for i, config := range configs {
+		h, err := newEventHandler(config)
+
+		if err != nil {
+			return errors.Wrapf(err, "invalid event handler #%d", i+1)
+		}
+
+		handlers = append(handlers, h)
+	}
+
+	e.mu.Lock()
+	e.handlers = handlers
+	e.timeout = timeout
+	e.mu.Unlock()
+
+	return nil
+}
+
+// Queue a user event for handlers, meant to be used as
+// detector user event handler
+func (e *eventDispatcher) userEvent(ev tattle.UserEvent) {
+	select {
+	case e.userEvents <- ev:
+	default:
+		e.logger.Warning("event handlers are too slow, skipping %s user event",
+			ev.Name)
+	}
+}
+
+// Answer a query with the output of the first matching handler,
+// meant to be used as detector query handler
+func (e *eventDispatcher) query(q tattle.Query) ([]byte, error) {
+	e.mu.Lock()
+	detector := e.detector
+	handlers := e.handlers
+	timeout := e.timeout
+	e.mu.Unlock()
+
+	// Not running yet
+	if detector == nil {
+		return nil, nil
+	}
+
+	var handler *eventHandler
+
+	for _, h := range handlers {
+		if h.matchQuery(q) {
+			handler = h
+
+			break
+		}
+	}
+
+	if handler == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), q.Deadline)
+	defer cancel()
+
+	ctx, cancel = context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stderr := new(bytes.Buffer)
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", handler.config.Command)
+	cmd.Env = append(os.Environ(), queryEnv(detector.LocalMember(), q)...)
+	cmd.Stdin = bytes.NewReader(q.Payload)
+	cmd.Stderr = stderr
+
+	logger := e.logger.With("command", handler.config.Command)
+
+	start := time.Now()
+	out, err := cmd.Output()
+
+	logger = logger.With("duration", time.Since(start))
+
+	if stderr.Len() > 0 {
+		logger.Debug("query handler output: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "query handler failed")
+	}
+
+	if out == nil {
+		out = []byte{}
+	}
+
+	return out, nil
+}
+
+// Dispatch events of the detector until context is done
+func (e *eventDispatcher) run(ctx context.Context, detector *tattle.Detector) {
+	events := detector.Subscribe(ctx, 0)
+
+	e.mu.Lock()
+	e.detector = detector
+	e.mu.Unlock()
+
+	for {
+		var env []string
+		var stdin string
+		var matched []*eventHandler
+
+		e.mu.Lock()
+		handlers := e.handlers
+		timeout := e.timeout
+		e.mu.Unlock()
+
+		self := detector.LocalMember()
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			for _, h := range handlers {
+				if h.match(ev) {
+					matched = append(matched, h)
+				}
+			}
+
+			env = eventEnv(self, ev)
+			stdin = memberLine(ev.Member)
+
+		case ev := <-e.userEvents:
+			for _, h := range handlers {
+				if h.matchUser(ev) {
+					matched = append(matched, h)
+				}
+			}
+
+			env = userEventEnv(self, ev)
+			stdin = string(ev.Payload)
+		}
+
+		for _, h := range matched {
+			e.invoke(ctx, h, env, strings.NewReader(stdin), timeout)
+		}
+	}
+}
+
+// Run a handler script passing event details via environment and stdin
+func (e *eventDispatcher) invoke(
+	ctx context.Context,
+	h *eventHandler,
+	env []string,
+	stdin io.Reader,
+	timeout time.Duration,
+) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.config.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = stdin
+
+	logger := e.logger.With("command", h.config.Command)
+
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+
+	logger = logger.With("duration", time.Since(start))
+
+	if len(out) > 0 {
+		logger.Debug("event handler output: %s", bytes.TrimSpace(out))
+	}
+
+	if err != nil {
+		logger.With(tattle.LogFieldError, err).Warning("event handler failed")
+	}
+}
+
+// Return environment variables describing the local node
+func selfEnv(self tattle.Member) []string {
+	env := []string{
+		envPrefix + "SELF_NAME=" + self.Peer.PeerId(),
+		envPrefix + "SELF_ADDRESS=" + fmt.Sprint(self.Peer),
+	}
+
+	for key, val := range self.Tags {
+		env = append(env, envPrefix+"TAG_"+envKey(key)+"="+val)
+	}
+
+	return env
+}
+
+// Return environment variables describing the membership event
+func eventEnv(self tattle.Member, ev tattle.MemberEvent) []string {
+	env := append(selfEnv(self),
+		envPrefix+"EVENT="+ev.Type.String(),
+		fmt.Sprintf("%sEVENT_INDEX=%d", envPrefix, ev.Index),
+		envPrefix+"MEMBER_NAME="+ev.Member.Peer.PeerId(),
+		envPrefix+"MEMBER_ADDRESS="+fmt.Sprint(ev.Member.Peer),
+		envPrefix+"MEMBER_STATE="+ev.Member.State.String(),
+		fmt.Sprintf("%sMEMBER_INCARNATION=%d",
+			envPrefix, ev.Member.Incarnation))
+
+	for key, val := range ev.Member.Tags {
+		env = append(env, envPrefix+"MEMBER_TAG_"+envKey(key)+"="+val)
+	}
+
+	return env
+}
+
+// Return environment variables describing the user event
+func userEventEnv(self tattle.Member, ev tattle.UserEvent) []string {
+	return append(selfEnv(self),
+		envPrefix+"EVENT="+userEventType,
+		envPrefix+"USER_EVENT="+ev.Name,
+		fmt.Sprintf("%sUSER_LTIME=%d", envPrefix, ev.LTime))
+}
+
+// Return environment variables describing the query
+func queryEnv(self tattle.Member, q tattle.Query) []string {
+	return append(selfEnv(self),
+		envPrefix+"EVENT="+queryEventType,
+		envPrefix+"QUERY_NAME="+q.Name,
+		fmt.Sprintf("%sQUERY_ID=%d", envPrefix, q.Id),
+		envPrefix+"QUERY_FROM="+q.From.PeerId())
+}
+
+// Return a member as a tab separated line:
+// name, address, state, incarnation, comma separated tags
+func memberLine(m tattle.Member) string {
+	tags := make([]string, 0, len(m.Tags))
+
+	for key, val := range m.Tags {
+		tags = append(tags, key+"="+val)
+	}
+
+	sort.Strings(tags)
+
+	return fmt.Sprintf("%s\t%s\t%s\t%d\t%s\n", m.Peer.PeerId(), m.Peer,
+		m.State, m.Incarnation, strings.Join(tags, ","))
+}
+
+// Turn an arbitrary string into an environment variable name part
+func envKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
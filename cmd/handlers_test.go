@@ -0,0 +1,349 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syhpoon/tattle"
+)
+
+// Create a detector which is never started, stopped when the test ends
+func newTestDetector(t *testing.T, tags map[string]string) *tattle.Detector {
+	t.Helper()
+
+	params := tattle.DefaultDetectorParams()
+	params.Transport = tattle.NewTransportHttp(tattle.DefaulTransportHttpParams())
+	params.LocalPeer = tattle.HttpPeer{Id: "local", Host: "local.test", Port: 9000}
+	params.Peers = []tattle.Peer{
+		tattle.HttpPeer{Id: "seed", Host: "seed.test", Port: 9000},
+	}
+	params.Tags = tags
+	params.Logger = tattle.NewLoggerPrintf(ioutil.Discard, 0)
+
+	d, err := tattle.NewDetector(params)
+
+	if err != nil {
+		t.Fatalf("new detector: %+v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = d.Stop(context.Background())
+	})
+
+	return d
+}
+
+func TestParseEventHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    EventHandlerConfig
+		wantErr string
+	}{
+		{
+			name: "all events",
+			spec: "/bin/true",
+			want: EventHandlerConfig{Command: "/bin/true"},
+		},
+		{
+			name: "event list",
+			spec: "member-join,user:deploy=reload.sh",
+			want: EventHandlerConfig{
+				Events:  []string{"member-join", "user:deploy"},
+				Command: "reload.sh",
+			},
+		},
+		{
+			name: "equals sign in arguments",
+			spec: "handler.sh --mode=reload",
+			want: EventHandlerConfig{Command: "handler.sh --mode=reload"},
+		},
+		{
+			name: "equals sign in path",
+			spec: "/opt/a=b/handler",
+			want: EventHandlerConfig{Command: "/opt/a=b/handler"},
+		},
+		{name: "unknown event", spec: "member-exploded=x", wantErr: "unknown event type"},
+		{name: "empty command", spec: "member-join= ", wantErr: "empty command"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := parseEventHandler(test.spec)
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("err = %v, want %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(h, test.want) {
+				t.Errorf("parsed %+v, want %+v", h, test.want)
+			}
+		})
+	}
+}
+
+func TestEventHandlerMatch(t *testing.T) {
+	member := tattle.Member{Tags: map[string]string{"role": "web"}}
+
+	tests := []struct {
+		name   string
+		config EventHandlerConfig
+		event  tattle.MemberEventType
+		user   string
+		query  string
+		want   [3]bool
+	}{
+		{
+			name:   "all events",
+			config: EventHandlerConfig{},
+			event:  tattle.MemberEventJoin,
+			user:   "deploy",
+			query:  "uptime",
+			want:   [3]bool{true, true, false},
+		},
+		{
+			name:   "event type",
+			config: EventHandlerConfig{Events: []string{"member-failed"}},
+			event:  tattle.MemberEventJoin,
+			user:   "deploy",
+			want:   [3]bool{false, false, false},
+		},
+		{
+			name:   "user event name",
+			config: EventHandlerConfig{Events: []string{"user:deploy"}},
+			event:  tattle.MemberEventJoin,
+			user:   "deploy",
+			query:  "deploy",
+			want:   [3]bool{false, true, false},
+		},
+		{
+			name:   "all queries",
+			config: EventHandlerConfig{Events: []string{"query"}},
+			event:  tattle.MemberEventJoin,
+			user:   "deploy",
+			query:  "uptime",
+			want:   [3]bool{false, false, true},
+		},
+		{
+			name: "matching tags",
+			config: EventHandlerConfig{
+				Events: []string{"member-join", "query:uptime"},
+				Tags:   map[string]string{"role": "web|db"},
+			},
+			event: tattle.MemberEventJoin,
+			query: "uptime",
+			want:  [3]bool{true, false, true},
+		},
+		{
+			name: "other tags",
+			config: EventHandlerConfig{
+				Tags: map[string]string{"role": "db"},
+			},
+			event: tattle.MemberEventJoin,
+			user:  "deploy",
+			want:  [3]bool{false, true, false},
+		},
+		{
+			name: "empty expression requires tag",
+			config: EventHandlerConfig{
+				Tags: map[string]string{"role": ""},
+			},
+			event: tattle.MemberEventJoin,
+			want:  [3]bool{true, false, false},
+		},
+		{
+			name: "empty expression missing tag",
+			config: EventHandlerConfig{
+				Tags: map[string]string{"zone": ""},
+			},
+			event: tattle.MemberEventJoin,
+			want:  [3]bool{false, false, false},
+		},
+		{
+			name: "missing tag",
+			config: EventHandlerConfig{
+				Tags: map[string]string{"zone": "a?"},
+			},
+			event: tattle.MemberEventJoin,
+			want:  [3]bool{false, false, false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.config.Command == "" {
+				test.config.Command = "true"
+			}
+
+			h, err := newEventHandler(test.config)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := [3]bool{
+				h.match(tattle.MemberEvent{Type: test.event, Member: member}),
+				test.user != "" && h.matchUser(tattle.UserEvent{Name: test.user}),
+				test.query != "" && h.matchQuery(tattle.Query{Name: test.query}),
+			}
+
+			if got != test.want {
+				t.Errorf("member, user, query match = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventDispatcherInvoke(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+
+	e := newEventDispatcher(tattle.NewLoggerPrintf(ioutil.Discard, 0))
+
+	h, err := newEventHandler(EventHandlerConfig{
+		Command: `echo "$TATTLE_EVENT $TATTLE_MEMBER_NAME $TATTLE_MEMBER_TAG_ROLE" > ` +
+			out + `; cat >> ` + out,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	self := tattle.Member{Peer: tattle.HttpPeer{Id: "local"}}
+
+	ev := tattle.MemberEvent{
+		Index: 1,
+		Type:  tattle.MemberEventJoin,
+		Member: tattle.Member{
+			Peer:        tattle.HttpPeer{Id: "a", Host: "a.test", Port: 9000, Protocol: "http"},
+			State:       tattle.MemberStateAlive,
+			Incarnation: 2,
+			Tags:        map[string]string{"role": "web", "zone": "z1"},
+		},
+	}
+
+	e.invoke(context.Background(), h, eventEnv(self, ev),
+		strings.NewReader(memberLine(ev.Member)), time.Second)
+
+	data, err := ioutil.ReadFile(out)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "member-join a web\na\thttp://a.test:9000\talive\t2\trole=web,zone=z1\n"
+
+	if string(data) != want {
+		t.Errorf("handler got %q, want %q", data, want)
+	}
+}
+
+func TestEventDispatcherQuery(t *testing.T) {
+	e := newEventDispatcher(tattle.NewLoggerPrintf(ioutil.Discard, 0))
+
+	err := e.configure([]EventHandlerConfig{
+		{Events: []string{"member-join"}, Command: "echo member"},
+		{Events: []string{"query:echo"}, Command: `printf "$TATTLE_QUERY_NAME:"; cat`},
+		{Events: []string{"query:fail"}, Command: "exit 3"},
+		{Events: []string{"query"}, Command: "printf any"},
+	}, time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := tattle.Query{
+		Name:     "echo",
+		From:     tattle.HttpPeer{Id: "origin"},
+		Payload:  []byte("ping"),
+		Deadline: time.Now().Add(time.Second),
+	}
+
+	// Detector is not running yet
+	if resp, err := e.query(q); resp != nil || err != nil {
+		t.Fatalf("query before run = %q, %v", resp, err)
+	}
+
+	e.detector = newTestDetector(t, nil)
+
+	tests := []struct {
+		name     string
+		want     string
+		wantFail bool
+	}{
+		{"echo", "echo:ping", false},
+		{"fail", "", true},
+		{"other", "any", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q.Name = test.name
+
+			resp, err := e.query(q)
+
+			if (err != nil) != test.wantFail {
+				t.Fatalf("err = %v, want failure %v", err, test.wantFail)
+			}
+
+			if string(resp) != test.want {
+				t.Errorf("response = %q, want %q", resp, test.want)
+			}
+		})
+	}
+}
+
+func TestEnvKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"role", "ROLE"},
+		{"Zone9", "ZONE9"},
+		{"failure-domain.rack", "FAILURE_DOMAIN_RACK"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			if got := envKey(test.key); got != test.want {
+				t.Errorf("envKey = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
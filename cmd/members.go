@@ -0,0 +1,211 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/syhpoon/tattle"
+)
+
+var flagMembersState string
+var flagMembersName string
+var flagMembersTags []string
+var flagMembersFormat string
+
+var MembersCmd = &cobra.Command{
+	Use:   "members",
+	Short: "List members known to a running agent",
+	Run: func(cmd *cobra.Command, args []string) {
+		filter, err := newMemberFilter(
+			flagMembersState, flagMembersName, flagMembersTags)
+
+		if err != nil {
+			fatal("%s", err)
+		}
+
+		var members []tattle.AdminMember
+
+		if err := adminRequest(
+			http.MethodGet, "/v1/admin/members", nil, &members); err != nil {
+			fatal("error listing members: %s", err)
+		}
+
+		var filtered []tattle.AdminMember
+
+		for _, m := range members {
+			if filter.match(m) {
+				filtered = append(filtered, m)
+			}
+		}
+
+		switch flagMembersFormat {
+		case "json":
+			if filtered == nil {
+				filtered = []tattle.AdminMember{}
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if err := enc.Encode(filtered); err != nil {
+				fatal("error encoding members: %s", err)
+			}
+		case "table":
+			printMembers(filtered)
+		default:
+			fatal("invalid format: %s", flagMembersFormat)
+		}
+	},
+}
+
+// Member filter built from command line flags
+type memberFilter struct {
+	state *regexp.Regexp
+	name  *regexp.Regexp
+	tags  map[string]*regexp.Regexp
+}
+
+func newMemberFilter(state, name string, tags []string) (*memberFilter, error) {
+	f := &memberFilter{
+		tags: map[string]*regexp.Regexp{},
+	}
+
+	var err error
+
+	if f.state, err = compileAnchored(state); err != nil {
+		return nil, errors.Errorf("invalid state filter: %s", err)
+	}
+
+	if f.name, err = compileAnchored(name); err != nil {
+		return nil, errors.Errorf("invalid name filter: %s", err)
+	}
+
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid tag filter, expected key=regexp: %s", tag)
+		}
+
+		if f.tags[parts[0]], err = compileAnchored(parts[1]); err != nil {
+			return nil, errors.Errorf("invalid tag filter %s: %s", tag, err)
+		}
+	}
+
+	return f, nil
+}
+
+// Compile a regexp matching the whole string, nil for an empty expression
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func (f *memberFilter) match(m tattle.AdminMember) bool {
+	if f.state != nil && !f.state.MatchString(m.State.String()) {
+		return false
+	}
+
+	if f.name != nil && !f.name.MatchString(m.Id) {
+		return false
+	}
+
+	// Empty tag expression only requires the tag to be present
+	for key, re := range f.tags {
+		val, ok := m.Tags[key]
+
+		if !ok || (re != nil && !re.MatchString(val)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func printMembers(members []tattle.AdminMember) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "NAME\tADDRESS\tSTATE\tINCARNATION\tTAGS\tRTT")
+
+	for _, m := range members {
+		rtt := "-"
+
+		if m.Rtt > 0 {
+			rtt = m.Rtt.Round(time.Microsecond).String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+			m.Id, m.Address, m.State, m.Incarnation, formatTags(m.Tags), rtt)
+	}
+
+	_ = w.Flush()
+}
+
+// Format tags as sorted comma-separated key=value pairs
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func init() {
+	addClientFlags(MembersCmd)
+
+	MembersCmd.Flags().StringVar(&flagMembersState, "state", "",
+		"Only show members whose state matches the regexp")
+
+	MembersCmd.Flags().StringVar(&flagMembersName, "name", "",
+		"Only show members whose name matches the regexp")
+
+	MembersCmd.Flags().StringArrayVar(&flagMembersTags, "tag", nil,
+		"Only show members with a tag matching key=regexp, can be repeated. "+
+			"Empty regexp only requires the tag to be present")
+
+	MembersCmd.Flags().StringVar(&flagMembersFormat, "format", "table",
+		"Output format. Possible values: table, json")
+
+	RootCmd.AddCommand(MembersCmd)
+}
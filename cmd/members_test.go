@@ -0,0 +1,186 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syhpoon/tattle"
+)
+
+func TestMemberFilter(t *testing.T) {
+	member := tattle.AdminMember{
+		Id:    "web-1",
+		State: tattle.MemberStateSuspect,
+		Tags:  map[string]string{"zone": "us-east-1a", "role": "web"},
+	}
+
+	tests := []struct {
+		name  string
+		state string
+		id    string
+		tags  []string
+		want  bool
+	}{
+		{"no filters", "", "", nil, true},
+		{"state", "suspect", "", nil, true},
+		{"state alternatives", "alive|suspect", "", nil, true},
+		{"other state", "alive", "", nil, false},
+		{"state is anchored", "sus", "", nil, false},
+		{"name", "", "web-.*", nil, true},
+		{"name is anchored", "", "web", nil, false},
+		{"tag", "", "", []string{"zone=us-east-.*"}, true},
+		{"all tags must match", "", "", []string{"zone=us-.*", "role=db"}, false},
+		{"missing tag", "", "", []string{"rack=.*"}, false},
+		{"tag presence", "", "", []string{"role="}, true},
+		{"missing tag presence", "", "", []string{"rack="}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := newMemberFilter(test.state, test.id, test.tags)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := f.match(member); got != test.want {
+				t.Errorf("match = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemberFilterErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   string
+		id      string
+		tags    []string
+		wantErr string
+	}{
+		{"state", "(", "", nil, "invalid state filter"},
+		{"name", "", "[", nil, "invalid name filter"},
+		{"tag without value", "", "", []string{"zone"}, "expected key=regexp"},
+		{"tag", "", "", []string{"zone=("}, "invalid tag filter"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newMemberFilter(test.state, test.id, test.tags)
+
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("err = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFormatTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		{"none", nil, ""},
+		{"single", map[string]string{"a": "1"}, "a=1"},
+		{"sorted", map[string]string{"b": "2", "a": "1"}, "a=1,b=2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatTags(test.tags); got != test.want {
+				t.Errorf("formatTags = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAdminRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Authorization") != "Bearer secret" {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+
+				return
+			}
+
+			_, _ = w.Write([]byte(`[{"id": "a", "state": "alive"}]`))
+		}))
+
+	defer srv.Close()
+
+	defer func(addr, token string, timeout time.Duration) {
+		flagRpcAddr, flagToken, flagRpcTimeout = addr, token, timeout
+	}(flagRpcAddr, flagToken, flagRpcTimeout)
+
+	flagRpcAddr = srv.URL + "/"
+	flagRpcTimeout = time.Second
+
+	tests := []struct {
+		name    string
+		token   string
+		env     string
+		wantErr string
+	}{
+		{"flag token", "secret", "", ""},
+		{"env token", "", "secret", ""},
+		{"flag wins", "secret", "guess", ""},
+		{"wrong token", "guess", "", "401 Unauthorized: invalid token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flagToken = test.token
+			t.Setenv(envAdminToken, test.env)
+
+			var members []tattle.AdminMember
+
+			err := adminRequest(http.MethodGet, "/v1/admin/members", nil, &members)
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("err = %v, want %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(members) != 1 || members[0].Id != "a" ||
+				members[0].State != tattle.MemberStateAlive {
+
+				t.Errorf("members = %+v", members)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/syhpoon/tattle"
+)
+
+var flagQueryNodes []string
+var flagQueryTags []string
+var flagQueryAck bool
+var flagQueryTimeout time.Duration
+var flagQueryFormat string
+
+var QueryCmd = &cobra.Command{
+	Use:   "query <name> [payload]",
+	Short: "Send a query through a running agent and collect responses",
+	Long: `Send a query through a running agent and collect responses.
+
+The query is disseminated to every member of the cluster, members
+matching --node and --tag filters answer it with the output of their
+"query" event handlers. Payload "-" is read from stdin.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		qreq := tattle.AdminQueryRequest{
+			Name:        args[0],
+			FilterNodes: flagQueryNodes,
+			FilterTags:  map[string]string{},
+			RequestAck:  flagQueryAck,
+		}
+
+		if len(args) > 1 {
+			qreq.Payload = args[1]
+		}
+
+		if qreq.Payload == "-" {
+			payload, err := ioutil.ReadAll(os.Stdin)
+
+			if err != nil {
+				fatal("error reading payload: %s", err)
+			}
+
+			qreq.Payload = string(payload)
+		}
+
+		for _, tag := range flagQueryTags {
+			parts := strings.SplitN(tag, "=", 2)
+
+			if len(parts) != 2 {
+				fatal("invalid tag filter, expected key=regexp: %s", tag)
+			}
+
+			if _, err := compileAnchored(parts[1]); err != nil {
+				fatal("invalid tag filter %s: %s", tag, err)
+			}
+
+			qreq.FilterTags[parts[0]] = parts[1]
+		}
+
+		if flagQueryTimeout > 0 {
+			qreq.Timeout = flagQueryTimeout.String()
+		}
+
+		if flagQueryFormat != "text" && flagQueryFormat != "json" {
+			fatal("invalid format: %s", flagQueryFormat)
+		}
+
+		// Responses are streamed until the query deadline,
+		// which is decided by the agent if not given
+		timeout := time.Duration(0)
+
+		if flagQueryTimeout > 0 {
+			timeout = flagQueryTimeout + flagRpcTimeout
+		}
+
+		resp, err := adminCall(
+			http.MethodPost, "/v1/admin/query", qreq, timeout)
+
+		if err != nil {
+			fatal("error sending query: %s", err)
+		}
+
+		//noinspection GoUnhandledErrorResult
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, 1<<20)
+
+		for scanner.Scan() {
+			var msg tattle.AdminQueryMessage
+
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				fatal("error decoding response: %s", err)
+			}
+
+			if flagQueryFormat == "json" {
+				fmt.Println(scanner.Text())
+
+				continue
+			}
+
+			switch msg.Type {
+			case tattle.AdminQueryAck:
+				fmt.Printf("Ack from %s\n", msg.From)
+			case tattle.AdminQueryResponse:
+				fmt.Printf("Response from %s: %s\n",
+					msg.From, strings.TrimSpace(msg.Payload))
+			case tattle.AdminQueryDone:
+				fmt.Printf("Total acks: %d\nTotal responses: %d\n",
+					msg.Acks, msg.Responses)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			fatal("error reading responses: %s", err)
+		}
+	},
+}
+
+func init() {
+	addClientFlags(QueryCmd)
+
+	QueryCmd.Flags().StringArrayVar(&flagQueryNodes, "node", nil,
+		"Only ask the node with the name, can be repeated")
+
+	QueryCmd.Flags().StringArrayVar(&flagQueryTags, "tag", nil,
+		"Only ask nodes with a tag matching key=regexp, can be repeated. "+
+			"Empty regexp only requires the tag to be present")
+
+	QueryCmd.Flags().BoolVar(&flagQueryAck, "ack", false,
+		"Ask nodes to acknowledge the query upon receipt")
+
+	QueryCmd.Flags().DurationVar(&flagQueryTimeout, "timeout", 0,
+		"Time to wait for responses, agent decides on cluster size if 0")
+
+	QueryCmd.Flags().StringVar(&flagQueryFormat, "format", "text",
+		"Output format. Possible values: text, json")
+
+	RootCmd.AddCommand(QueryCmd)
+}
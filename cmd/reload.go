@@ -0,0 +1,179 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/syhpoon/tattle"
+)
+
+// Applies configuration changes to a running agent.
+// Log level, tags, event handlers, probe tuning and TLS certificate
+// are changed in place, other changes are rejected as they need a restart.
+// Seeds are only used at startup and their changes are ignored.
+type reloader struct {
+	cmd        *cobra.Command
+	logLevel   *tattle.LogLevelVar
+	detector   *tattle.Detector
+	transport  *tattle.TransportHttp
+	dispatcher *eventDispatcher
+	logger     tattle.Logger
+
+	mu  sync.Mutex
+	cfg Config
+}
+
+// Load configuration again and apply it
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := loadConfig(r.cmd)
+
+	if err != nil {
+		return errors.Wrap(err, "error loading configuration")
+	}
+
+	if changed := restartRequired(r.cfg, cfg); len(changed) > 0 {
+		return errors.Errorf("changes of %s require a restart",
+			strings.Join(changed, ", "))
+	}
+
+	if r.transport != nil && cfg.Http.TLSCertFile != "" {
+		if err := r.transport.ReloadCertificate(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.dispatcher.configure(cfg.EventHandlers,
+		time.Duration(cfg.EventHandlerTimeout)); err != nil {
+		return err
+	}
+
+	if err := r.detector.SetTuning(cfg.tuning()); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(r.cfg.Tags, cfg.Tags) {
+		if err := r.detector.SetTags(cfg.Tags); err != nil {
+			return err
+		}
+	}
+
+	level, _ := tattle.ParseLogLevel(cfg.LogLevel)
+	r.logLevel.Set(level)
+
+	r.cfg = cfg
+
+	r.logger.Info("configuration reloaded")
+
+	return nil
+}
+
+// Return names of changed settings which can't be applied at runtime
+func restartRequired(old, cfg Config) []string {
+	settings := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"node_name", old.NodeName, cfg.NodeName},
+		{"advertise_addr", old.AdvertiseAddr, cfg.AdvertiseAddr},
+		{"admin_token", old.AdminToken, cfg.AdminToken},
+		{"transport", old.Transport, cfg.Transport},
+		{"codec", old.Codec, cfg.Codec},
+		{"detector.event_log_size",
+			old.Detector.EventLogSize, cfg.Detector.EventLogSize},
+		{"detector.snapshot_path",
+			old.Detector.SnapshotPath, cfg.Detector.SnapshotPath},
+		{"detector.user_event_size_limit",
+			old.Detector.UserEventSizeLimit, cfg.Detector.UserEventSizeLimit},
+		{"detector.user_event_buffer_size",
+			old.Detector.UserEventBufferSize, cfg.Detector.UserEventBufferSize},
+		{"detector.query_size_limit",
+			old.Detector.QuerySizeLimit, cfg.Detector.QuerySizeLimit},
+		{"detector.query_response_size_limit",
+			old.Detector.QueryResponseSizeLimit,
+			cfg.Detector.QueryResponseSizeLimit},
+		{"detector.query_timeout_mult",
+			old.Detector.QueryTimeoutMult, cfg.Detector.QueryTimeoutMult},
+		{"detector.failure_domain_tag",
+			old.Detector.FailureDomainTag, cfg.Detector.FailureDomainTag},
+		{"detector.partition_threshold",
+			old.Detector.PartitionThreshold, cfg.Detector.PartitionThreshold},
+		{"detector.partition_min_suspects",
+			old.Detector.PartitionMinSuspects, cfg.Detector.PartitionMinSuspects},
+		{"detector.partition_window",
+			old.Detector.PartitionWindow, cfg.Detector.PartitionWindow},
+		{"detector.partition_freeze",
+			old.Detector.PartitionFreeze, cfg.Detector.PartitionFreeze},
+		{"detector.partition_timeout",
+			old.Detector.PartitionTimeout, cfg.Detector.PartitionTimeout},
+		{"detector.reconnect_interval",
+			old.Detector.ReconnectInterval, cfg.Detector.ReconnectInterval},
+		{"detector.reconnect_timeout",
+			old.Detector.ReconnectTimeout, cfg.Detector.ReconnectTimeout},
+		{"detector.tombstone_timeout",
+			old.Detector.TombstoneTimeout, cfg.Detector.TombstoneTimeout},
+		{"detector.dead_member_reclaim_time",
+			old.Detector.DeadMemberReclaimTime, cfg.Detector.DeadMemberReclaimTime},
+		{"detector.max_concurrent_rpcs",
+			old.Detector.MaxConcurrentRpcs, cfg.Detector.MaxConcurrentRpcs},
+		{"detector.coordinate",
+			old.Detector.Coordinate, cfg.Detector.Coordinate},
+		{"http.listen", old.Http.Listen, cfg.Http.Listen},
+		{"http.write_timeout", old.Http.WriteTimeout, cfg.Http.WriteTimeout},
+		{"http.read_timeout", old.Http.ReadTimeout, cfg.Http.ReadTimeout},
+		{"http.rpc_timeout", old.Http.RpcTimeout, cfg.Http.RpcTimeout},
+		{"http.detector_inject_timeout",
+			old.Http.DetectorInjectTimeout, cfg.Http.DetectorInjectTimeout},
+		{"http.detector_process_timeout",
+			old.Http.DetectorProcessTimeout, cfg.Http.DetectorProcessTimeout},
+		{"http.shutdown_timeout",
+			old.Http.ShutdownTimeout, cfg.Http.ShutdownTimeout},
+		{"http.tls_cert_file", old.Http.TLSCertFile, cfg.Http.TLSCertFile},
+		{"http.tls_key_file", old.Http.TLSKeyFile, cfg.Http.TLSKeyFile},
+		{"http.incoming_buffer_size",
+			old.Http.IncomingBufferSize, cfg.Http.IncomingBufferSize},
+		{"http.compress_threshold",
+			old.Http.CompressThreshold, cfg.Http.CompressThreshold},
+	}
+
+	var changed []string
+
+	for _, s := range settings {
+		if !reflect.DeepEqual(s.old, s.new) {
+			changed = append(changed, s.name)
+		}
+	}
+
+	return changed
+}
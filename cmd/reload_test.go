@@ -0,0 +1,177 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/syhpoon/tattle"
+)
+
+func TestRestartRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   []string
+	}{
+		{"nothing", func(cfg *Config) {}, nil},
+		{"runtime settings", func(cfg *Config) {
+			cfg.LogLevel = "debug"
+			cfg.Tags = map[string]string{"zone": "b"}
+			cfg.Seeds = []string{"seed:9000"}
+			cfg.Detector.PingInterval = Duration(time.Minute)
+			cfg.EventHandlers = []EventHandlerConfig{{Command: "true"}}
+		}, nil},
+		{"node name", func(cfg *Config) {
+			cfg.NodeName = "other"
+		}, []string{"node_name"}},
+		{"nested settings", func(cfg *Config) {
+			cfg.Codec.Checksum = true
+			cfg.Detector.Coordinate.Dimensionality++
+			cfg.Http.Listen = ":9999"
+		}, []string{"codec", "detector.coordinate", "http.listen"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			old := DefaultConfig()
+			cfg := DefaultConfig()
+			test.change(&cfg)
+
+			if got := restartRequired(old, cfg); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("restartRequired = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReloaderReload(t *testing.T) {
+	defer func(path string) { flagConfig = path }(flagConfig)
+
+	const initial = `{"node_name": "local", "seeds": ["seed.test:9000"],
+		"tags": {"zone": "a"}}`
+
+	tests := []struct {
+		name      string
+		content   string
+		wantErr   string
+		wantTags  map[string]string
+		wantLevel tattle.LogLevel
+		wantPing  time.Duration
+	}{
+		{
+			name: "runtime settings",
+			content: `{"node_name": "local", "seeds": ["seed.test:9000"],
+				"tags": {"zone": "b"}, "log_level": "debug",
+				"detector": {"ping_interval": "3s"}}`,
+			wantTags:  map[string]string{"zone": "b"},
+			wantLevel: tattle.LogLevelDebug,
+			wantPing:  3 * time.Second,
+		},
+		{
+			name:    "restart required",
+			content: `{"node_name": "other", "seeds": ["seed.test:9000"]}`,
+			wantErr: "changes of node_name require a restart",
+		},
+		{
+			name: "invalid event handler",
+			content: `{"node_name": "local", "seeds": ["seed.test:9000"],
+				"event_handlers": [{"events": ["member-exploded"], "command": "true"}]}`,
+			wantErr: `event_handlers[0]: unknown event type "member-exploded"`,
+		},
+		{
+			name:    "invalid file",
+			content: `{"node_name": `,
+			wantErr: "error loading configuration",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flagConfig = writeTempFile(t, "config.json", initial)
+
+			cfg, err := loadConfig(&cobra.Command{})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			detector := newTestDetector(t, cfg.Tags)
+			logger := tattle.NewLoggerPrintf(ioutil.Discard, tattle.LogLevelInfo)
+			logger.LevelVar = tattle.NewLogLevelVar(tattle.LogLevelInfo)
+			dispatcher := newEventDispatcher(logger)
+
+			r := &reloader{
+				cmd:        &cobra.Command{},
+				logLevel:   logger.LevelVar,
+				detector:   detector,
+				dispatcher: dispatcher,
+				logger:     logger,
+				cfg:        cfg,
+			}
+
+			if err := ioutil.WriteFile(flagConfig, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			err = r.reload()
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want %q", err, test.wantErr)
+				}
+
+				// Nothing is applied
+				if !reflect.DeepEqual(r.cfg, cfg) {
+					t.Errorf("configuration changed to %+v", r.cfg)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("reload: %+v", err)
+			}
+
+			if tags := detector.LocalMember().Tags; !reflect.DeepEqual(tags, test.wantTags) {
+				t.Errorf("tags = %v, want %v", tags, test.wantTags)
+			}
+
+			if level := logger.LevelVar.Level(); level != test.wantLevel {
+				t.Errorf("log level = %v, want %v", level, test.wantLevel)
+			}
+
+			if ping := detector.Tuning().PingInterval; ping != test.wantPing {
+				t.Errorf("ping interval = %s, want %s", ping, test.wantPing)
+			}
+		})
+	}
+}
@@ -30,47 +30,96 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/syhpoon/tattle"
+	"github.com/syhpoon/tattle/metrics/prometheus"
 )
 
+var flagConfig string
 var flagCodec string
 var flagTransport string
 var flagHttpListen string
+var flagLogLevel string
+var flagNodeName string
+var flagAdvertise string
+var flagJoin []string
+var flagTags []string
+var flagTLSCert string
+var flagTLSKey string
+var flagAdminToken string
+var flagEventHandlers []string
 
 var RootCmd = &cobra.Command{
 	Use:   "tattle",
 	Short: "tattle command",
+	Long: `Run tattle agent.
+
+Settings are taken from command line flags, TATTLE_* environment
+variables (e.g. TATTLE_HTTP_LISTEN for --http-listen), config file
+and defaults, in that order of precedence.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx, cancel := context.WithCancel(context.Background())
 		logger := &tattle.LoggerPrintf{}
 
-		params := tattle.DefaultDetectorParams()
-		params.Ctx = ctx
-		params.Logger = logger
+		cfg, err := loadConfig(cmd)
 
-		var codec tattle.Codec
+		if err != nil {
+			logger.Error("%s", err)
 
-		// Prepare codec
-		switch flagCodec {
-		case "json":
-			codec = tattle.NewCodecJson()
-		default:
-			logger.Error("Invalid codec: %s", flagCodec)
+			os.Exit(1)
+		}
+
+		level, _ := tattle.ParseLogLevel(cfg.LogLevel)
+		logger.LevelVar = tattle.NewLogLevelVar(level)
+
+		metrics, err := prometheus.New(prometheus.DefaultParams())
+
+		if err != nil {
+			logger.Error("error creating metrics: %+v", err)
+
+			os.Exit(1)
+		}
+
+		localPeer, err := cfg.localPeer()
+
+		if err != nil {
+			logger.Error("%s", err)
 
 			os.Exit(1)
 		}
 
+		seeds, err := cfg.seedPeers()
+
+		if err != nil {
+			logger.Error("%s", err)
+
+			os.Exit(1)
+		}
+
+		params := tattle.DefaultDetectorParams()
+		cfg.applyDetector(&params)
+		params.Ctx = ctx
+		params.Logger = logger
+		params.Metrics = metrics
+		params.LocalPeer = localPeer
+		params.Peers = seeds
+
+		codec := cfg.codec()
+
+		var httpTransport *tattle.TransportHttp
+
 		// Prepare transport
-		switch flagTransport {
+		switch cfg.Transport {
 		case "http":
 			httpParams := tattle.DefaulTransportHttpParams()
+			cfg.applyHttp(&httpParams)
 
-			listener, err := net.Listen("tcp", flagHttpListen)
+			listener, err := net.Listen("tcp", cfg.Http.Listen)
 
 			if err != nil {
 				logger.Error("unable to start TCP listener: %s", err)
@@ -81,19 +130,28 @@ var RootCmd = &cobra.Command{
 			httpParams.Ctx = ctx
 			httpParams.Codec = codec
 			httpParams.Logger = logger
+			httpParams.Metrics = metrics
 			httpParams.Listener = listener
 
-			params.Transport = tattle.NewTransportHttp(httpParams)
+			httpTransport = tattle.NewTransportHttp(httpParams)
+			params.Transport = httpTransport
 		default:
-			logger.Error("invalid transport: %s", flagTransport)
+			logger.Error("invalid transport: %s", cfg.Transport)
 
 			os.Exit(1)
 		}
 
-		wg := &sync.WaitGroup{}
-		wg.Add(1)
+		dispatcher := newEventDispatcher(logger)
+
+		if err := dispatcher.configure(cfg.EventHandlers,
+			time.Duration(cfg.EventHandlerTimeout)); err != nil {
+			logger.Error("%s", err)
+
+			os.Exit(1)
+		}
 
-		params.WaitGroup = wg
+		params.UserEventHandler = dispatcher.userEvent
+		params.QueryHandler = dispatcher.query
 
 		detector, err := tattle.NewDetector(params)
 
@@ -103,44 +161,90 @@ var RootCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		go func() {
-			if err := detector.Run(); err != nil {
-				logger.Error("error running detector: %+v", err)
+		reloader := &reloader{
+			cmd:        cmd,
+			logLevel:   logger.LevelVar,
+			detector:   detector,
+			transport:  httpTransport,
+			dispatcher: dispatcher,
+			logger:     logger,
+			cfg:        cfg,
+		}
 
-				cancel()
+		// Mount admin API onto the transport
+		if httpTransport != nil {
+			adminParams := tattle.DefaultAdminHttpParams()
+			adminParams.Detector = detector
+			adminParams.Codec = codec
+			adminParams.Logger = logger
+			adminParams.Token = cfg.AdminToken
+			adminParams.MetricsHandler = prometheus.Handler(nil)
+			adminParams.Reload = reloader.reload
+			adminParams.ParsePeer = func(addr string) (tattle.Peer, error) {
+				return tattle.ParseHttpPeer(addr, cfg.protocol())
 			}
-		}()
 
-		wait(ctx, cancel, wg)
+			admin := tattle.NewAdminHttp(adminParams)
+			admin.Register(httpTransport.Router())
+
+			// Event streams would hold the transport shutdown otherwise
+			httpTransport.OnShutdown(admin.Close)
+		}
+
+		go dispatcher.run(ctx, detector)
+
+		if err := detector.Start(ctx); err != nil {
+			logger.Error("error starting detector: %+v", err)
+
+			os.Exit(1)
+		}
+
+		wait(detector.Done(), func() {
+			if err := reloader.reload(); err != nil {
+				logger.Error("%s", err)
+			}
+		})
+
+		// Transport drains requests in progress within its shutdown timeout
+		if err := detector.Stop(context.Background()); err != nil {
+			logger.Error("error stopping detector: %+v", err)
+		}
+
+		cancel()
 	},
 }
 
-func wait(ctx context.Context, cancel func(), wg *sync.WaitGroup) {
+// Wait for a termination signal or the detector to stop,
+// calling reload upon SIGHUP
+func wait(done <-chan struct{}, reload func()) {
 	c := make(chan os.Signal, 1)
 
 	signal.Notify(c,
 		os.Interrupt,
 		syscall.SIGTERM,
 		syscall.SIGABRT,
-		syscall.SIGPIPE,
 		syscall.SIGBUS,
-		syscall.SIGUSR1,
-		syscall.SIGUSR2,
-		syscall.SIGQUIT)
-
-	select {
-	case sig := <-c:
-		switch sig {
-		case os.Interrupt, syscall.SIGTERM, syscall.SIGABRT,
-			syscall.SIGPIPE, syscall.SIGBUS, syscall.SIGUSR1, syscall.SIGUSR2,
-			syscall.SIGQUIT:
-			cancel()
-		}
+		syscall.SIGQUIT,
+		syscall.SIGHUP)
 
-	case <-ctx.Done():
-	}
+	defer signal.Stop(c)
+
+loop:
+	for {
+		select {
+		case sig := <-c:
+			if sig == syscall.SIGHUP {
+				reload()
+
+				continue
+			}
+
+			break loop
 
-	wg.Wait()
+		case <-done:
+			break loop
+		}
+	}
 }
 
 func Execute() {
@@ -151,12 +255,53 @@ func Execute() {
 }
 
 func init() {
+	RootCmd.Flags().StringVar(&flagConfig, "config", "",
+		"Path to config file, yaml, toml or json depending on extension")
+
 	RootCmd.Flags().StringVarP(&flagCodec,
 		"codec", "c", "json", "Codec to use. Possible values: json")
 
 	RootCmd.Flags().StringVarP(&flagTransport,
 		"transport", "t", "http", "Transport to use. Possible values: http")
 
-	RootCmd.Flags().StringVar(&flagTransport,
+	RootCmd.Flags().StringVar(&flagHttpListen,
 		"http-listen", ":9000", "Listen address for http transport")
+
+	RootCmd.Flags().StringVar(&flagLogLevel, "log-level", "info",
+		"Log level. Possible values: debug, info, warning, error, critical")
+
+	RootCmd.Flags().StringVar(&flagNodeName, "node-name", "",
+		"Unique node name, hostname by default")
+
+	RootCmd.Flags().StringVar(&flagAdvertise, "advertise", "",
+		"Address other members use to reach this node, host:port")
+
+	RootCmd.Flags().StringSliceVar(&flagJoin, "join", nil,
+		"Seed peer to join, [name@][proto://]host:port. Can be repeated")
+
+	// --seed is accepted as an alias for --join
+	RootCmd.Flags().SetNormalizeFunc(
+		func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+			if name == "seed" {
+				name = "join"
+			}
+
+			return pflag.NormalizedName(name)
+		})
+
+	RootCmd.Flags().StringSliceVar(&flagTags, "tag", nil,
+		"Node tag, key=value. Can be repeated")
+
+	RootCmd.Flags().StringVar(&flagTLSCert, "tls-cert", "",
+		"TLS certificate file for http transport")
+
+	RootCmd.Flags().StringVar(&flagTLSKey, "tls-key", "",
+		"TLS key file for http transport")
+
+	RootCmd.Flags().StringArrayVar(&flagEventHandlers, "event-handler", nil,
+		"Script to run on membership events, [event[,event...]=]command. "+
+			"Can be repeated")
+
+	RootCmd.Flags().StringVar(&flagAdminToken, "admin-token", "",
+		"Token protecting control endpoints of admin API")
 }
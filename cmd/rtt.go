@@ -0,0 +1,103 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/syhpoon/tattle"
+)
+
+var RttCmd = &cobra.Command{
+	Use:   "rtt <node> [node]",
+	Short: "Estimate round-trip time between two nodes",
+	Long: `Estimate round-trip time between two nodes.
+
+The estimate is computed from network coordinates known to a running
+agent, without sending any probes. If only one node is given, the
+round-trip time to the agent itself is estimated.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var local tattle.AdminLocal
+		var members []tattle.AdminMember
+
+		if err := adminRequest(
+			http.MethodGet, "/v1/admin/local", nil, &local); err != nil {
+			fatal("error getting local node: %s", err)
+		}
+
+		if err := adminRequest(
+			http.MethodGet, "/v1/admin/members", nil, &members); err != nil {
+			fatal("error listing members: %s", err)
+		}
+
+		coords := map[string]*tattle.Coordinate{
+			local.Id: local.Coordinate,
+		}
+
+		for _, m := range members {
+			coords[m.Id] = m.Coordinate
+		}
+
+		nodes := append(args, local.Id)[:2]
+
+		for _, node := range nodes {
+			coord, ok := coords[node]
+
+			switch {
+			case !ok:
+				fatal("unknown node: %s", node)
+			case coord == nil:
+				fatal("coordinate of %s is not known yet", node)
+			}
+		}
+
+		a, b := coords[nodes[0]], coords[nodes[1]]
+
+		if !a.IsCompatibleWith(*b) {
+			fatal("coordinates of %s and %s are incompatible",
+				nodes[0], nodes[1])
+		}
+
+		rtt := time.Duration(0)
+
+		if nodes[0] != nodes[1] {
+			rtt = a.DistanceTo(*b)
+		}
+
+		fmt.Printf("Estimated %s <-> %s rtt: %s (err: %.2f, %.2f)\n",
+			nodes[0], nodes[1], rtt.Round(time.Microsecond), a.Error, b.Error)
+	},
+}
+
+func init() {
+	addClientFlags(RttCmd)
+
+	RootCmd.AddCommand(RttCmd)
+}
@@ -0,0 +1,728 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Parameters for AdminHttp instance
+type AdminHttpParams struct {
+	Detector *Detector
+	// Serves /metrics endpoint, the endpoint is disabled if nil
+	MetricsHandler http.Handler
+	// Codec used to encode streamed membership events
+	Codec Codec
+	// Interval between keep-alive comments in event streams
+	KeepAliveInterval time.Duration
+	// Bearer token required by control endpoints,
+	// control endpoints are disabled if empty
+	Token string
+	// Parses peer addresses passed to join endpoint
+	ParsePeer func(addr string) (Peer, error)
+	// Reloads configuration, reload endpoint is disabled if nil
+	Reload func() error
+	Logger Logger
+}
+
+// Join request as accepted by admin API
+type AdminJoinRequest struct {
+	Peers []string `json:"peers"`
+}
+
+// Join result as returned by admin API
+type AdminJoinResponse struct {
+	Joined int `json:"joined"`
+}
+
+// User event as accepted by admin API
+type AdminUserEventRequest struct {
+	Name     string `json:"name"`
+	Payload  string `json:"payload"`
+	Coalesce bool   `json:"coalesce"`
+}
+
+// Query as accepted by admin API
+type AdminQueryRequest struct {
+	Name        string            `json:"name"`
+	Payload     string            `json:"payload"`
+	FilterNodes []string          `json:"filter_nodes"`
+	FilterTags  map[string]string `json:"filter_tags"`
+	RequestAck  bool              `json:"request_ack"`
+	// Duration like "5s", default timeout is used if empty
+	Timeout string `json:"timeout"`
+}
+
+// Types of messages streamed in response to a query
+const (
+	AdminQueryAck      = "ack"
+	AdminQueryResponse = "response"
+	AdminQueryDone     = "done"
+)
+
+// Single line of a query response stream returned by admin API
+type AdminQueryMessage struct {
+	Type    string `json:"type"`
+	From    string `json:"from,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	// Totals sent in the final done message
+	Acks      int `json:"acks,omitempty"`
+	Responses int `json:"responses,omitempty"`
+}
+
+// Force leave request as accepted by admin API
+type AdminForceLeaveRequest struct {
+	Id string `json:"id"`
+}
+
+// Member as returned by admin API
+type AdminMember struct {
+	Id          string            `json:"id"`
+	Address     string            `json:"address"`
+	State       MemberState       `json:"state"`
+	Incarnation uint64            `json:"incarnation"`
+	Tags        map[string]string `json:"tags"`
+	LastSeen    time.Time         `json:"last_seen"`
+	StateChange time.Time         `json:"state_change"`
+	Rtt         time.Duration     `json:"rtt"`
+	Coordinate  *Coordinate       `json:"coordinate,omitempty"`
+}
+
+// Local node info as returned by admin API
+type AdminLocal struct {
+	AdminMember
+	HealthScore    int                 `json:"health_score"`
+	MaxHealthScore int                 `json:"max_health_score"`
+	MemberCounts   map[MemberState]int `json:"member_counts"`
+	Partitioned    bool                `json:"partitioned"`
+	Readiness      Readiness           `json:"readiness"`
+}
+
+// Readiness as returned by admin API
+type AdminHealth struct {
+	Readiness Readiness `json:"readiness"`
+}
+
+// Pending broadcast as returned by admin API
+type AdminBroadcast struct {
+	PeerId      string `json:"peer_id"`
+	UpdateType  string `json:"update_type"`
+	Incarnation uint64 `json:"incarnation"`
+	Transmits   int    `json:"transmits"`
+}
+
+// AdminHttp serves HTTP endpoints for inspecting detector state
+// and token protected endpoints for controlling it.
+// It can either be mounted on the transport router or served separately.
+type AdminHttp struct {
+	AdminHttpParams
+
+	// Closed to end streaming responses
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// Create default parameters for admin API
+func DefaultAdminHttpParams() AdminHttpParams {
+	return AdminHttpParams{
+		Codec:             NewCodecJson(),
+		KeepAliveInterval: 15 * time.Second,
+		ParsePeer: func(addr string) (Peer, error) {
+			return ParseHttpPeer(addr, "http")
+		},
+		Logger: &LoggerPrintf{},
+	}
+}
+
+// Create a new admin API instance
+func NewAdminHttp(params AdminHttpParams) *AdminHttp {
+	return &AdminHttp{
+		AdminHttpParams: params,
+		closing:         make(chan struct{}),
+	}
+}
+
+// End event and query streams so the server serving them can shut down
+// without waiting for clients to disconnect
+func (a *AdminHttp) Close() {
+	a.closeOnce.Do(func() {
+		close(a.closing)
+	})
+}
+
+// Register admin endpoints on the router
+func (a *AdminHttp) Register(router *mux.Router) {
+	// GET /v1/admin/members - List known members
+	router.HandleFunc("/v1/admin/members", a.membersHandler).
+		Methods(http.MethodGet)
+
+	// GET /v1/admin/local - Local node info
+	router.HandleFunc("/v1/admin/local", a.localHandler).
+		Methods(http.MethodGet)
+
+	// GET /v1/admin/health - Readiness, 503 unless joined
+	router.HandleFunc("/v1/admin/health", a.healthHandler).
+		Methods(http.MethodGet)
+
+	// GET /v1/admin/broadcasts - Broadcast queue contents
+	router.HandleFunc("/v1/admin/broadcasts", a.broadcastsHandler).
+		Methods(http.MethodGet)
+
+	// GET /v1/admin/events - Stream membership events
+	router.HandleFunc("/v1/admin/events", a.eventsHandler).
+		Methods(http.MethodGet)
+
+	// POST /v1/admin/join - Join more peers
+	router.HandleFunc("/v1/admin/join", a.authorized(a.joinHandler)).
+		Methods(http.MethodPost)
+
+	// POST /v1/admin/leave - Leave the cluster gracefully
+	router.HandleFunc("/v1/admin/leave", a.authorized(a.leaveHandler)).
+		Methods(http.MethodPost)
+
+	// POST /v1/admin/force-leave - Force a dead member to leave
+	router.HandleFunc("/v1/admin/force-leave",
+		a.authorized(a.forceLeaveHandler)).
+		Methods(http.MethodPost)
+
+	// POST /v1/admin/event - Fire a user event
+	router.HandleFunc("/v1/admin/event", a.authorized(a.userEventHandler)).
+		Methods(http.MethodPost)
+
+	// POST /v1/admin/query - Fire a query and stream responses
+	router.HandleFunc("/v1/admin/query", a.authorized(a.queryHandler)).
+		Methods(http.MethodPost)
+
+	// POST /v1/admin/reload - Reload configuration
+	router.HandleFunc("/v1/admin/reload", a.authorized(a.reloadHandler)).
+		Methods(http.MethodPost)
+
+	// GET /metrics - Metrics
+	if a.MetricsHandler != nil {
+		router.Handle("/metrics", a.MetricsHandler).Methods(http.MethodGet)
+	}
+}
+
+// Return a standalone handler serving admin endpoints
+func (a *AdminHttp) Handler() http.Handler {
+	router := mux.NewRouter()
+
+	a.Register(router)
+
+	return router
+}
+
+func (a *AdminHttp) membersHandler(w http.ResponseWriter, req *http.Request) {
+	members := a.Detector.Members()
+	resp := make([]AdminMember, 0, len(members))
+
+	for _, m := range members {
+		resp = append(resp, adminMember(m))
+	}
+
+	a.writeJson(w, resp)
+}
+
+func (a *AdminHttp) localHandler(w http.ResponseWriter, req *http.Request) {
+	resp := AdminLocal{
+		AdminMember:    adminMember(a.Detector.LocalMember()),
+		HealthScore:    a.Detector.HealthScore(),
+		MaxHealthScore: a.Detector.Tuning().MaxHealthScore,
+		MemberCounts:   a.Detector.members.counts(),
+		Partitioned:    a.Detector.Partitioned(),
+		Readiness:      a.Detector.Readiness(),
+	}
+
+	a.writeJson(w, resp)
+}
+
+func (a *AdminHttp) healthHandler(w http.ResponseWriter, req *http.Request) {
+	readiness := a.Detector.Readiness()
+
+	if readiness != ReadinessJoined {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	a.writeJson(w, AdminHealth{Readiness: readiness})
+}
+
+func (a *AdminHttp) broadcastsHandler(w http.ResponseWriter, req *http.Request) {
+	broadcasts := a.Detector.Broadcasts()
+	resp := make([]AdminBroadcast, 0, len(broadcasts))
+
+	for _, b := range broadcasts {
+		resp = append(resp, AdminBroadcast{
+			PeerId:      b.Update.Peer.PeerId(),
+			UpdateType:  b.Update.UpdateType.String(),
+			Incarnation: b.Update.SeqNum,
+			Transmits:   b.Transmits,
+		})
+	}
+
+	a.writeJson(w, resp)
+}
+
+func (a *AdminHttp) joinHandler(w http.ResponseWriter, req *http.Request) {
+	var jreq AdminJoinRequest
+
+	if !a.readJson(w, req, &jreq) {
+		return
+	}
+
+	peers := make([]Peer, 0, len(jreq.Peers))
+
+	for _, addr := range jreq.Peers {
+		peer, err := a.ParsePeer(addr)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		peers = append(peers, peer)
+	}
+
+	joined, err := a.Detector.Join(req.Context(), peers)
+
+	switch errors.Cause(err) {
+	case nil:
+		a.writeJson(w, AdminJoinResponse{Joined: joined})
+	case ErrNoPeers:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case ErrLeft:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func (a *AdminHttp) leaveHandler(w http.ResponseWriter, req *http.Request) {
+	if err := a.Detector.Leave(req.Context()); err != nil {
+		// Departure is still spread by gossip
+		a.Logger.Warning("%s", err)
+	}
+
+	a.writeJson(w, adminMember(a.Detector.LocalMember()))
+}
+
+func (a *AdminHttp) forceLeaveHandler(w http.ResponseWriter, req *http.Request) {
+	var freq AdminForceLeaveRequest
+
+	if !a.readJson(w, req, &freq) {
+		return
+	}
+
+	err := a.Detector.ForceLeave(freq.Id)
+
+	switch errors.Cause(err) {
+	case nil:
+		a.writeJson(w, struct{}{})
+	case ErrUnknownMember:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrMemberAlive:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (a *AdminHttp) userEventHandler(w http.ResponseWriter, req *http.Request) {
+	var ureq AdminUserEventRequest
+
+	if !a.readJson(w, req, &ureq) {
+		return
+	}
+
+	err := a.Detector.UserEvent(ureq.Name, []byte(ureq.Payload), ureq.Coalesce)
+
+	switch errors.Cause(err) {
+	case nil:
+		a.writeJson(w, struct{}{})
+	case ErrUserEventTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case ErrLeft:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// Fire a query streaming acks and responses as json lines
+// until the query deadline
+func (a *AdminHttp) queryHandler(w http.ResponseWriter, req *http.Request) {
+	var qreq AdminQueryRequest
+
+	if !a.readJson(w, req, &qreq) {
+		return
+	}
+
+	opts := QueryOptions{
+		FilterNodes: qreq.FilterNodes,
+		FilterTags:  qreq.FilterTags,
+		RequestAck:  qreq.RequestAck,
+	}
+
+	if qreq.Timeout != "" {
+		timeout, err := time.ParseDuration(qreq.Timeout)
+
+		if err != nil {
+			http.Error(w, "invalid timeout: "+qreq.Timeout,
+				http.StatusBadRequest)
+
+			return
+		}
+
+		opts.Timeout = timeout
+	}
+
+	resp, err := a.Detector.Query(qreq.Name, []byte(qreq.Payload), opts)
+
+	switch errors.Cause(err) {
+	case nil:
+	case ErrQueryTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+
+		return
+	case ErrLeft:
+		http.Error(w, err.Error(), http.StatusConflict)
+
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	defer resp.Close()
+
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	done := AdminQueryMessage{Type: AdminQueryDone}
+	acks, resps := resp.Acks(), resp.Responses()
+
+	for acks != nil || resps != nil {
+		var msg AdminQueryMessage
+
+		select {
+		case <-req.Context().Done():
+			return
+
+		case <-a.closing:
+			return
+
+		case from, ok := <-acks:
+			if !ok {
+				acks = nil
+
+				continue
+			}
+
+			done.Acks++
+			msg = AdminQueryMessage{Type: AdminQueryAck, From: from}
+
+		case r, ok := <-resps:
+			if !ok {
+				resps = nil
+
+				continue
+			}
+
+			done.Responses++
+			msg = AdminQueryMessage{
+				Type:    AdminQueryResponse,
+				From:    r.From,
+				Payload: string(r.Payload),
+			}
+		}
+
+		if err := enc.Encode(msg); err != nil {
+			return
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	_ = enc.Encode(done)
+}
+
+func (a *AdminHttp) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if a.Reload == nil {
+		http.Error(w, "reload is not supported", http.StatusNotImplemented)
+
+		return
+	}
+
+	if err := a.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+
+		return
+	}
+
+	a.writeJson(w, struct{}{})
+}
+
+// Wrap a control handler with bearer token authentication
+func (a *AdminHttp) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if a.Token == "" {
+			http.Error(w, "control endpoints are disabled, "+
+				"no admin token configured", http.StatusForbidden)
+
+			return
+		}
+
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+
+			return
+		}
+
+		handler(w, req)
+	}
+}
+
+// Stream membership events as server-sent events.
+// Stream starts after the event index provided either in Last-Event-ID
+// header or in index query parameter, so reconnecting clients resume
+// where they left off. If some of the requested events were already
+// evicted, a "truncated" event with the first available index is sent.
+// Payloads of binary codecs are base64-encoded.
+func (a *AdminHttp) eventsHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "streaming is not supported",
+			http.StatusInternalServerError)
+
+		return
+	}
+
+	index, err := eventIndex(req)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(a.KeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		events, truncated, notify := a.Detector.EventsSince(index)
+
+		if truncated && len(events) > 0 {
+			_, err = fmt.Fprintf(w, "event: truncated\ndata: %d\n\n",
+				events[0].Index)
+		}
+
+		for _, ev := range events {
+			if err != nil {
+				break
+			}
+
+			err = a.writeEvent(w, ev)
+			index = ev.Index
+		}
+
+		if err != nil {
+			a.Logger.Debug("event stream closed: %s", err)
+
+			return
+		}
+
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+
+		case <-a.closing:
+			return
+
+		case <-notify:
+
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+// Write a single server-sent event
+func (a *AdminHttp) writeEvent(w io.Writer, ev MemberEvent) error {
+	buf := new(bytes.Buffer)
+
+	if err := a.Codec.EncodeEvent(ev, buf); err != nil {
+		return err
+	}
+
+	// Payload is sent byte for byte: wrapping codecs checksum or compress
+	// the trailing newline too. Clients strip only the newline terminating
+	// the last data line, so a trailing newline survives as an empty one.
+	data := buf.Bytes()
+
+	if !isText(data) {
+		data = []byte(base64.StdEncoding.EncodeToString(data))
+	}
+
+	out := new(bytes.Buffer)
+
+	fmt.Fprintf(out, "id: %d\nevent: %s\n", ev.Index, ev.Type)
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		out.WriteString("data: ")
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+
+	out.WriteByte('\n')
+
+	_, err := w.Write(out.Bytes())
+
+	return err
+}
+
+// Return event index a stream should start after
+func eventIndex(req *http.Request) (uint64, error) {
+	raw := req.Header.Get("Last-Event-ID")
+
+	if raw == "" {
+		raw = req.URL.Query().Get("index")
+	}
+
+	if raw == "" {
+		return 0, nil
+	}
+
+	index, err := strconv.ParseUint(raw, 10, 64)
+
+	if err != nil {
+		return 0, errors.Errorf("invalid event index: %s", raw)
+	}
+
+	return index, nil
+}
+
+// Check if data can be sent in an event stream as is
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+
+	for _, b := range data {
+		if b < 0x20 && b != '\n' && b != '\t' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Decode json request body, responding with an error if that fails
+func (a *AdminHttp) readJson(
+	w http.ResponseWriter, req *http.Request, dst interface{}) bool {
+
+	//noinspection GoUnhandledErrorResult
+	defer req.Body.Close()
+
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).
+		Decode(dst); err != nil {
+
+		http.Error(w, "error decoding request: "+err.Error(),
+			http.StatusBadRequest)
+
+		return false
+	}
+
+	return true
+}
+
+func (a *AdminHttp) writeJson(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(obj); err != nil {
+		a.Logger.Error("error sending admin response: %s", err)
+	}
+}
+
+func adminMember(m Member) AdminMember {
+	am := AdminMember{
+		State:       m.State,
+		Incarnation: m.Incarnation,
+		Tags:        m.Tags,
+		LastSeen:    m.LastSeen,
+		StateChange: m.StateChange,
+		Rtt:         m.Rtt,
+		Coordinate:  m.Coordinate,
+	}
+
+	if am.Tags == nil {
+		am.Tags = map[string]string{}
+	}
+
+	if m.Peer != nil {
+		am.Id = m.Peer.PeerId()
+		am.Address = fmt.Sprint(m.Peer)
+	}
+
+	return am
+}
@@ -0,0 +1,248 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Create admin API of a detector using fakeTransport
+func newTestAdmin(t *testing.T, token string, peers ...Peer) (*AdminHttp, *Detector) {
+	t.Helper()
+
+	d := newTestDetector(t, testDetectorParams(newFakeTransport(nil),
+		fakePeer("local"), peers...))
+
+	params := DefaultAdminHttpParams()
+	params.Detector = d
+	params.Token = token
+	params.Logger = d.Logger
+
+	return NewAdminHttp(params), d
+}
+
+// Send a request to the admin handler and return the recorded response
+func adminRequest(
+	a *AdminHttp,
+	method, path, token, body string,
+) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestAdminControlAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		sent       string
+		wantCode   int
+	}{
+		{"no token configured", "", "secret", http.StatusForbidden},
+		{"missing token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "guess", http.StatusUnauthorized},
+		{"valid token", "secret", "secret", http.StatusOK},
+	}
+
+	endpoints := []struct {
+		path, body string
+	}{
+		{"/v1/admin/join", `{"peers": ["a.test:9000"]}`},
+		{"/v1/admin/leave", ``},
+	}
+
+	for _, test := range tests {
+		for _, ep := range endpoints {
+			t.Run(test.name+ep.path, func(t *testing.T) {
+				a, _ := newTestAdmin(t, test.configured, fakePeer("seed"))
+
+				rec := adminRequest(a, http.MethodPost, ep.path, test.sent, ep.body)
+
+				if rec.Code != test.wantCode {
+					t.Errorf("status = %d, want %d: %s",
+						rec.Code, test.wantCode, rec.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestAdminForceLeave(t *testing.T) {
+	a, d := newTestAdmin(t, "secret",
+		fakePeer("alive"), fakePeer("suspect"), fakePeer("dead"))
+
+	d.applyUpdates([]UpdateEvent{
+		{Peer: fakePeer("suspect"), UpdateType: UpdateTypePeerSuspicious, SeqNum: 1},
+		{Peer: fakePeer("dead"), UpdateType: UpdateTypePeerDead, SeqNum: 1},
+	})
+
+	tests := []struct {
+		body     string
+		wantCode int
+	}{
+		{`{"id": "unknown"}`, http.StatusNotFound},
+		{`{"id": "alive"}`, http.StatusConflict},
+		{`{"id": "suspect"}`, http.StatusConflict},
+		{`{"id": "dead"}`, http.StatusOK},
+		{`{"id": `, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		rec := adminRequest(a, http.MethodPost, "/v1/admin/force-leave",
+			"secret", test.body)
+
+		if rec.Code != test.wantCode {
+			t.Errorf("%s: status = %d, want %d", test.body, rec.Code, test.wantCode)
+		}
+	}
+}
+
+func TestAdminReadEndpoints(t *testing.T) {
+	a, d := newTestAdmin(t, "", fakePeer("seed"))
+
+	d.applyUpdates([]UpdateEvent{{
+		Peer:       fakePeer("a"),
+		UpdateType: UpdateTypePeerAlive,
+		SeqNum:     3,
+		Tags:       map[string]string{"zone": "z1"},
+	}})
+
+	tests := []struct {
+		path   string
+		code   int
+		result interface{}
+		check  func(result interface{}) bool
+	}{
+		{
+			path:   "/v1/admin/members",
+			code:   http.StatusOK,
+			result: &[]AdminMember{},
+			check: func(result interface{}) bool {
+				for _, m := range *result.(*[]AdminMember) {
+					if m.Id == "a" {
+						return m.State == MemberStateAlive &&
+							m.Incarnation == 3 && m.Tags["zone"] == "z1" &&
+							m.Address == "http://a.test:9000"
+					}
+				}
+
+				return false
+			},
+		},
+		{
+			path:   "/v1/admin/local",
+			code:   http.StatusOK,
+			result: &AdminLocal{},
+			check: func(result interface{}) bool {
+				local := result.(*AdminLocal)
+
+				return local.Id == "local" &&
+					local.MemberCounts[MemberStateAlive] == 2 &&
+					local.Readiness == ReadinessStarting
+			},
+		},
+		{
+			// Detector is not started
+			path:   "/v1/admin/health",
+			code:   http.StatusServiceUnavailable,
+			result: &AdminHealth{},
+			check: func(result interface{}) bool {
+				return result.(*AdminHealth).Readiness == ReadinessStarting
+			},
+		},
+		{
+			path:   "/v1/admin/broadcasts",
+			code:   http.StatusOK,
+			result: &[]AdminBroadcast{},
+			check: func(result interface{}) bool {
+				for _, b := range *result.(*[]AdminBroadcast) {
+					if b.PeerId == "a" {
+						return b.UpdateType == UpdateTypePeerAlive.String() &&
+							b.Incarnation == 3
+					}
+				}
+
+				return false
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			rec := adminRequest(a, http.MethodGet, test.path, "", "")
+
+			if rec.Code != test.code {
+				t.Fatalf("status = %d, want %d", rec.Code, test.code)
+			}
+
+			if err := json.Unmarshal(rec.Body.Bytes(), test.result); err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+
+			if !test.check(test.result) {
+				t.Errorf("unexpected response %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("metrics"))
+	})
+
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		wantCode int
+	}{
+		{name: "disabled", wantCode: http.StatusNotFound},
+		{name: "enabled", handler: metrics, wantCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, _ := newTestAdmin(t, "", fakePeer("seed"))
+			a.MetricsHandler = test.handler
+
+			rec := adminRequest(a, http.MethodGet, "/metrics", "", "")
+
+			if rec.Code != test.wantCode {
+				t.Errorf("code %d, want %d", rec.Code, test.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"sort"
+	"sync"
+)
+
+// Membership update waiting to be piggybacked onto outgoing messages
+type Broadcast struct {
+	Update UpdateEvent
+	// Number of times the update has already been sent
+	Transmits int
+}
+
+// Queue of updates disseminated by piggybacking them onto pings and acks.
+// Every update is retransmitted a limited number of times and
+// newer updates about a peer replace older ones.
+type broadcastQueue struct {
+	mu    sync.Mutex
+	items map[string]*Broadcast
+	seq   map[string]uint64
+	next  uint64
+}
+
+func newBroadcastQueue() *broadcastQueue {
+	return &broadcastQueue{
+		items: map[string]*Broadcast{},
+		seq:   map[string]uint64{},
+	}
+}
+
+// Queue an update, replacing any pending update about the same peer
+func (q *broadcastQueue) queue(update UpdateEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id := update.Peer.PeerId()
+
+	q.next++
+	q.items[id] = &Broadcast{Update: update}
+	q.seq[id] = q.next
+}
+
+// Return at most max updates, least transmitted and newest first,
+// along with the number of updates which were sent before.
+// Updates which were sent limit times are dropped from the queue.
+func (q *broadcastQueue) get(max, limit int) ([]UpdateEvent, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids := q.sortedIds()
+
+	if len(ids) > max {
+		ids = ids[:max]
+	}
+
+	updates := make([]UpdateEvent, 0, len(ids))
+	retransmits := 0
+
+	for _, id := range ids {
+		b := q.items[id]
+
+		if b.Transmits > 0 {
+			retransmits++
+		}
+
+		b.Transmits++
+
+		updates = append(updates, b.Update)
+
+		if b.Transmits >= limit {
+			delete(q.items, id)
+			delete(q.seq, id)
+		}
+	}
+
+	return updates, retransmits
+}
+
+// Return a copy of queue contents in transmission order
+func (q *broadcastQueue) list() []Broadcast {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids := q.sortedIds()
+	items := make([]Broadcast, 0, len(ids))
+
+	for _, id := range ids {
+		items = append(items, *q.items[id])
+	}
+
+	return items
+}
+
+// Number of pending updates
+func (q *broadcastQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+func (q *broadcastQueue) sortedIds() []string {
+	ids := make([]string, 0, len(q.items))
+
+	for id := range q.items {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		bi, bj := q.items[ids[i]], q.items[ids[j]]
+
+		if bi.Transmits != bj.Transmits {
+			return bi.Transmits < bj.Transmits
+		}
+
+		return q.seq[ids[i]] > q.seq[ids[j]]
+	})
+
+	return ids
+}
+
+// Queue of arbitrary messages piggybacked onto outgoing messages,
+// works like the membership broadcast queue with messages identified
+// by keys instead of peer ids
+type messageQueue struct {
+	mu    sync.Mutex
+	items map[string]*queuedMessage
+	next  uint64
+}
+
+type queuedMessage struct {
+	msg       interface{}
+	transmits int
+	seq       uint64
+}
+
+func newMessageQueue() *messageQueue {
+	return &messageQueue{
+		items: map[string]*queuedMessage{},
+	}
+}
+
+// Queue a message, replacing any pending message with the same key
+func (q *messageQueue) queue(key string, msg interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.next++
+	q.items[key] = &queuedMessage{msg: msg, seq: q.next}
+}
+
+// Return at most max messages, least transmitted and newest first.
+// Messages which were sent limit times are dropped from the queue.
+func (q *messageQueue) get(max, limit int) []interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	keys := make([]string, 0, len(q.items))
+
+	for key := range q.items {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		mi, mj := q.items[keys[i]], q.items[keys[j]]
+
+		if mi.transmits != mj.transmits {
+			return mi.transmits < mj.transmits
+		}
+
+		return mi.seq > mj.seq
+	})
+
+	if len(keys) > max {
+		keys = keys[:max]
+	}
+
+	msgs := make([]interface{}, 0, len(keys))
+
+	for _, key := range keys {
+		m := q.items[key]
+		m.transmits++
+
+		msgs = append(msgs, m.msg)
+
+		if m.transmits >= limit {
+			delete(q.items, key)
+		}
+	}
+
+	return msgs
+}
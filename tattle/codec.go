@@ -24,7 +24,22 @@
 
 package tattle
 
-import "io"
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Default maximum size of a decoded message
+const DefaultMaxMessageSize = 8 * 1024 * 1024
+
+var (
+	// Returned when a decoded message exceeds the maximum allowed size
+	ErrMessageTooLarge = errors.New("message too large")
+
+	// Returned when a message checksum does not match its payload
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
 
 // Codec is responsible for encoding and decoding requests and responses
 type Codec interface {
@@ -36,4 +51,65 @@ type Codec interface {
 
 	DecodeRequest(io.Reader, Request) error
 	DecodeResponse(io.Reader, *Response) error
+
+	// EncodeEvent should encode a membership event into a provided Writer
+	EncodeEvent(MemberEvent, io.Writer) error
+	DecodeEvent(io.Reader, *MemberEvent) error
+}
+
+// Reader which fails with ErrMessageTooLarge once more than
+// the allowed number of bytes has been read
+type maxSizeReader struct {
+	reader io.Reader
+	left   int64
+	err    error
+}
+
+// Limit a reader to at most max bytes, non-positive max means no limit
+func limitReader(reader io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return reader
+	}
+
+	return &maxSizeReader{reader: reader, left: max}
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	// Read one byte past the limit to tell an exact fit from an overflow
+	if int64(len(p)) > r.left+1 {
+		p = p[:r.left+1]
+	}
+
+	n, err := r.reader.Read(p)
+
+	if int64(n) <= r.left {
+		r.left -= int64(n)
+		r.err = err
+
+		return n, err
+	}
+
+	n = int(r.left)
+	r.left = 0
+	r.err = errors.WithStack(ErrMessageTooLarge)
+
+	return n, r.err
+}
+
+// Return a short metric-friendly description of a decoding error
+func decodeErrorReason(err error) string {
+	switch errors.Cause(err) {
+	case ErrMessageTooLarge:
+		return "too_large"
+	case ErrChecksumMismatch:
+		return "checksum_mismatch"
+	case ErrUnknownCompression:
+		return "unknown_compression"
+	default:
+		return "malformed"
+	}
 }
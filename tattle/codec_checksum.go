@@ -0,0 +1,158 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CodecChecksum is a Codec decorator which wraps every message
+// into an envelope protected by a CRC32 (Castagnoli) checksum.
+// Envelope layout is a 4-byte big-endian checksum followed by the payload.
+type CodecChecksum struct {
+	// Underlying codec
+	Codec Codec
+	// Maximum size of an envelope payload in bytes, zero means no limit
+	MaxMessageSize int64
+}
+
+// Create a new checksumming codec on top of the provided one
+func NewCodecChecksum(codec Codec) *CodecChecksum {
+	return &CodecChecksum{
+		Codec:          codec,
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// Encode a request
+func (c *CodecChecksum) EncodeRequest(req Request, w io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	if err := c.Codec.EncodeRequest(req, buf); err != nil {
+		return err
+	}
+
+	return c.seal(buf.Bytes(), w)
+}
+
+// Encode a response
+func (c *CodecChecksum) EncodeResponse(resp Response, w io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	if err := c.Codec.EncodeResponse(resp, buf); err != nil {
+		return err
+	}
+
+	return c.seal(buf.Bytes(), w)
+}
+
+// Decode a request
+func (c *CodecChecksum) DecodeRequest(reader io.Reader, req Request) error {
+	payload, err := c.open(reader)
+
+	if err != nil {
+		return err
+	}
+
+	return c.Codec.DecodeRequest(bytes.NewReader(payload), req)
+}
+
+// Decode a response
+func (c *CodecChecksum) DecodeResponse(reader io.Reader, resp *Response) error {
+	payload, err := c.open(reader)
+
+	if err != nil {
+		return err
+	}
+
+	return c.Codec.DecodeResponse(bytes.NewReader(payload), resp)
+}
+
+// Encode a membership event
+func (c *CodecChecksum) EncodeEvent(ev MemberEvent, w io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	if err := c.Codec.EncodeEvent(ev, buf); err != nil {
+		return err
+	}
+
+	return c.seal(buf.Bytes(), w)
+}
+
+// Decode a membership event
+func (c *CodecChecksum) DecodeEvent(reader io.Reader, ev *MemberEvent) error {
+	payload, err := c.open(reader)
+
+	if err != nil {
+		return err
+	}
+
+	return c.Codec.DecodeEvent(bytes.NewReader(payload), ev)
+}
+
+func (c *CodecChecksum) seal(payload []byte, w io.Writer) error {
+	var hdr [4]byte
+
+	binary.BigEndian.PutUint32(hdr[:], crc32.Checksum(payload, castagnoli))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err := w.Write(payload)
+
+	return errors.WithStack(err)
+}
+
+func (c *CodecChecksum) open(reader io.Reader) ([]byte, error) {
+	var hdr [4]byte
+
+	if _, err := io.ReadFull(reader, hdr[:]); err != nil {
+		return nil, errors.Wrap(err, "error reading checksum")
+	}
+
+	payload, err := ioutil.ReadAll(limitReader(reader, c.MaxMessageSize))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading payload")
+	}
+
+	expected := binary.BigEndian.Uint32(hdr[:])
+
+	if sum := crc32.Checksum(payload, castagnoli); sum != expected {
+		return nil, errors.Wrapf(ErrChecksumMismatch,
+			"expected %08x, got %08x", expected, sum)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,196 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Message body is stored as is
+	compressHeaderNone byte = 0
+	// Message body is gzip-compressed
+	compressHeaderGzip byte = 1
+)
+
+var (
+	// Returned when a message has an unknown compression header
+	ErrUnknownCompression = errors.New("unknown compression header")
+)
+
+// CodecCompress is a Codec decorator which transparently compresses
+// payloads larger than a threshold.
+// Every message is prefixed with a single header byte telling the
+// receiver whether the body that follows is compressed or not.
+type CodecCompress struct {
+	// Underlying codec
+	Codec Codec
+	// Payloads smaller than threshold are sent uncompressed
+	Threshold int
+	// Gzip compression level
+	Level int
+}
+
+// Create a new compressing codec on top of the provided one
+func NewCodecCompress(codec Codec, threshold int) *CodecCompress {
+	return &CodecCompress{
+		Codec:     codec,
+		Threshold: threshold,
+		Level:     gzip.DefaultCompression,
+	}
+}
+
+// Encode a request
+func (c *CodecCompress) EncodeRequest(req Request, w io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	if err := c.Codec.EncodeRequest(req, buf); err != nil {
+		return err
+	}
+
+	return c.compress(buf.Bytes(), w)
+}
+
+// Encode a response
+func (c *CodecCompress) EncodeResponse(resp Response, w io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	if err := c.Codec.EncodeResponse(resp, buf); err != nil {
+		return err
+	}
+
+	return c.compress(buf.Bytes(), w)
+}
+
+// Decode a request
+func (c *CodecCompress) DecodeRequest(reader io.Reader, req Request) error {
+	body, err := c.decompress(reader)
+
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer body.Close()
+
+	return c.Codec.DecodeRequest(body, req)
+}
+
+// Decode a response
+func (c *CodecCompress) DecodeResponse(reader io.Reader, resp *Response) error {
+	body, err := c.decompress(reader)
+
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer body.Close()
+
+	return c.Codec.DecodeResponse(body, resp)
+}
+
+// Encode a membership event
+func (c *CodecCompress) EncodeEvent(ev MemberEvent, w io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	if err := c.Codec.EncodeEvent(ev, buf); err != nil {
+		return err
+	}
+
+	return c.compress(buf.Bytes(), w)
+}
+
+// Decode a membership event
+func (c *CodecCompress) DecodeEvent(reader io.Reader, ev *MemberEvent) error {
+	body, err := c.decompress(reader)
+
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer body.Close()
+
+	return c.Codec.DecodeEvent(body, ev)
+}
+
+func (c *CodecCompress) compress(payload []byte, w io.Writer) error {
+	if len(payload) < c.Threshold {
+		if _, err := w.Write([]byte{compressHeaderNone}); err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err := w.Write(payload)
+
+		return errors.WithStack(err)
+	}
+
+	if _, err := w.Write([]byte{compressHeaderGzip}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	gz, err := gzip.NewWriterLevel(w, c.Level)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := gz.Write(payload); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(gz.Close())
+}
+
+func (c *CodecCompress) decompress(reader io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(reader)
+	hdr, err := br.ReadByte()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading compression header")
+	}
+
+	switch hdr {
+	case compressHeaderNone:
+		return ioutil.NopCloser(br), nil
+	case compressHeaderGzip:
+		gz, err := gzip.NewReader(br)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating gzip reader")
+		}
+
+		return gz, nil
+	default:
+		return nil, errors.Wrapf(ErrUnknownCompression, "header %d", hdr)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return a response with n updates
+func testResponse(n int) Response {
+	var resp Response
+
+	for i := 0; i < n; i++ {
+		resp.Updates = append(resp.Updates, UpdateEvent{
+			Peer:       fakePeer(fmt.Sprintf("peer-%d", i)),
+			UpdateType: UpdateTypePeerAlive,
+			SeqNum:     uint64(i),
+			Tags:       map[string]string{"zone": "us-east-1"},
+		})
+	}
+
+	return resp
+}
+
+func TestCodecCompressRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		updates   int
+		header    byte
+	}{
+		{name: "below threshold", threshold: 1 << 20, updates: 10,
+			header: compressHeaderNone},
+		{name: "above threshold", threshold: 64, updates: 10,
+			header: compressHeaderGzip},
+		{name: "empty response compressed", threshold: 0,
+			header: compressHeaderGzip},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codec := NewCodecCompress(NewCodecJson(), test.threshold)
+			resp := testResponse(test.updates)
+			buf := new(bytes.Buffer)
+
+			if err := codec.EncodeResponse(resp, buf); err != nil {
+				t.Fatalf("encode: %+v", err)
+			}
+
+			if hdr := buf.Bytes()[0]; hdr != test.header {
+				t.Errorf("header %d, want %d", hdr, test.header)
+			}
+
+			var decoded Response
+
+			if err := codec.DecodeResponse(buf, &decoded); err != nil {
+				t.Fatalf("decode: %+v", err)
+			}
+
+			if fmt.Sprint(decoded.Updates) != fmt.Sprint(resp.Updates) {
+				t.Errorf("decoded %+v, want %+v", decoded.Updates, resp.Updates)
+			}
+		})
+	}
+}
+
+func TestCodecCompressCorrupted(t *testing.T) {
+	compressed := new(bytes.Buffer)
+
+	if err := NewCodecCompress(NewCodecJson(), 0).
+		EncodeResponse(testResponse(10), compressed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		reason string
+	}{
+		{name: "empty", data: nil, reason: "malformed"},
+		{name: "unknown header", data: []byte{7, '{', '}'},
+			reason: "unknown_compression"},
+		{name: "truncated gzip", data: compressed.Bytes()[:compressed.Len()/2],
+			reason: "malformed"},
+		{name: "not gzip", data: []byte{compressHeaderGzip, '{', '}'},
+			reason: "malformed"},
+	}
+
+	codec := NewCodecCompress(NewCodecJson(), 0)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var resp Response
+
+			err := codec.DecodeResponse(bytes.NewReader(test.data), &resp)
+
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if reason := decodeErrorReason(err); reason != test.reason {
+				t.Errorf("reason %s, want %s", reason, test.reason)
+			}
+		})
+	}
+}
+
+func TestTransportHttpCompression(t *testing.T) {
+	compress := func(params *TransportHttpParams) {
+		params.CompressThreshold = 64
+	}
+
+	server, serverPeer := newTestTransport(t, compress)
+	client, _ := newTestTransport(t, compress)
+
+	startTestTransport(t, server)
+	startTestTransport(t, client)
+
+	serveTestRequests(t, server, func(inReq IncomingRequest) Response {
+		return testResponse(len(inReq.Request.(RequestDirectPing).Updates))
+	})
+
+	req := RequestDirectPing{Updates: testResponse(50).Updates}
+
+	resp, err := client.Rpc(context.Background(), serverPeer, req, time.Second)
+
+	if err != nil {
+		t.Fatalf("rpc: %+v", err)
+	}
+
+	if len(resp.Updates) != 50 {
+		t.Errorf("got %d updates, want 50", len(resp.Updates))
+	}
+
+	// Unknown encodings are rejected before decoding
+	httpReq, err := http.NewRequest(http.MethodPost,
+		serverPeer.String()+"/v1/ping/direct", strings.NewReader("{}"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpReq.Header.Set("Content-Encoding", "br")
+
+	httpResp, err := http.DefaultClient.Do(httpReq)
+
+	if err != nil {
+		t.Fatalf("post: %s", err)
+	}
+
+	_ = httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("status %d, want %d",
+			httpResp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+}
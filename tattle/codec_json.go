@@ -27,13 +27,21 @@ package tattle
 import (
 	"encoding/json"
 	"io"
+	"reflect"
+
+	"github.com/pkg/errors"
 )
 
 // Json codec
-type CodecJson struct{}
+type CodecJson struct {
+	// Maximum size of a decoded message in bytes, zero means no limit
+	MaxMessageSize int64
+}
 
 func NewCodecJson() *CodecJson {
-	return &CodecJson{}
+	return &CodecJson{
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
 }
 
 // Encode a request
@@ -56,6 +64,16 @@ func (c *CodecJson) DecodeResponse(reader io.Reader, resp *Response) error {
 	return c.dec(reader, resp)
 }
 
+// Encode a membership event
+func (c *CodecJson) EncodeEvent(ev MemberEvent, w io.Writer) error {
+	return c.enc(w, ev)
+}
+
+// Decode a membership event
+func (c *CodecJson) DecodeEvent(reader io.Reader, ev *MemberEvent) error {
+	return c.dec(reader, ev)
+}
+
 func (c *CodecJson) enc(w io.Writer, obj interface{}) error {
 	enc := json.NewEncoder(w)
 
@@ -63,7 +81,189 @@ func (c *CodecJson) enc(w io.Writer, obj interface{}) error {
 }
 
 func (c *CodecJson) dec(reader io.Reader, dst interface{}) error {
-	dec := json.NewDecoder(reader)
+	dec := json.NewDecoder(limitReader(reader, c.MaxMessageSize))
 
 	return dec.Decode(dst)
 }
+
+// Json representation of a peer stored in an interface field
+type jsonPeer struct {
+	Type string          `json:"type"`
+	Peer json.RawMessage `json:"peer"`
+}
+
+func encodePeerJson(peer Peer) (*jsonPeer, error) {
+	if peer == nil {
+		return nil, nil
+	}
+
+	name, err := peerTypeName(peer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(peer)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &jsonPeer{Type: name, Peer: raw}, nil
+}
+
+func decodePeerJson(jp *jsonPeer) (Peer, error) {
+	if jp == nil {
+		return nil, nil
+	}
+
+	ptr, err := newPeerOfType(jp.Type)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(jp.Peer, ptr); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	peer, ok := reflect.ValueOf(ptr).Elem().Interface().(Peer)
+
+	if !ok {
+		return nil, errors.Errorf("type %s is not a peer", jp.Type)
+	}
+
+	return peer, nil
+}
+
+func (e UpdateEvent) MarshalJSON() ([]byte, error) {
+	type alias UpdateEvent
+
+	peer, err := encodePeerJson(e.Peer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		alias
+		Peer *jsonPeer
+	}{alias(e), peer})
+}
+
+func (e *UpdateEvent) UnmarshalJSON(data []byte) error {
+	type alias UpdateEvent
+
+	obj := struct {
+		*alias
+		Peer *jsonPeer
+	}{alias: (*alias)(e)}
+
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return errors.WithStack(err)
+	}
+
+	peer, err := decodePeerJson(obj.Peer)
+	e.Peer = peer
+
+	return err
+}
+
+func (r RequestIndirectPing) MarshalJSON() ([]byte, error) {
+	type alias RequestIndirectPing
+
+	peer, err := encodePeerJson(r.TargetPeer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		alias
+		TargetPeer *jsonPeer
+	}{alias(r), peer})
+}
+
+func (r *RequestIndirectPing) UnmarshalJSON(data []byte) error {
+	type alias RequestIndirectPing
+
+	obj := struct {
+		*alias
+		TargetPeer *jsonPeer
+	}{alias: (*alias)(r)}
+
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return errors.WithStack(err)
+	}
+
+	peer, err := decodePeerJson(obj.TargetPeer)
+	r.TargetPeer = peer
+
+	return err
+}
+
+func (m Member) MarshalJSON() ([]byte, error) {
+	type alias Member
+
+	peer, err := encodePeerJson(m.Peer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		alias
+		Peer *jsonPeer
+	}{alias(m), peer})
+}
+
+func (m *Member) UnmarshalJSON(data []byte) error {
+	type alias Member
+
+	obj := struct {
+		*alias
+		Peer *jsonPeer
+	}{alias: (*alias)(m)}
+
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return errors.WithStack(err)
+	}
+
+	peer, err := decodePeerJson(obj.Peer)
+	m.Peer = peer
+
+	return err
+}
+
+func (q Query) MarshalJSON() ([]byte, error) {
+	type alias Query
+
+	peer, err := encodePeerJson(q.From)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		alias
+		From *jsonPeer
+	}{alias(q), peer})
+}
+
+func (q *Query) UnmarshalJSON(data []byte) error {
+	type alias Query
+
+	obj := struct {
+		*alias
+		From *jsonPeer
+	}{alias: (*alias)(q)}
+
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return errors.WithStack(err)
+	}
+
+	peer, err := decodePeerJson(obj.From)
+	q.From = peer
+
+	return err
+}
@@ -0,0 +1,348 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLimitReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		limit int64
+		err   error
+	}{
+		{name: "no limit", size: 100},
+		{name: "below limit", size: 10, limit: 100},
+		{name: "exact fit", size: 100, limit: 100},
+		{name: "one byte over", size: 101, limit: 100, err: ErrMessageTooLarge},
+		{name: "far over", size: 10000, limit: 100, err: ErrMessageTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := ioutil.ReadAll(
+				limitReader(bytes.NewReader(make([]byte, test.size)), test.limit))
+
+			if errors.Cause(err) != test.err {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+
+			if test.err == nil && len(data) != test.size {
+				t.Errorf("read %d bytes, want %d", len(data), test.size)
+			}
+
+			if test.err != nil && int64(len(data)) > test.limit {
+				t.Errorf("read %d bytes past the limit", len(data))
+			}
+		})
+	}
+}
+
+// Return json representation of a value to compare decoded messages
+func jsonString(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+// Codecs under test, each one wrapping json
+func testCodecs() map[string]Codec {
+	return map[string]Codec{
+		"json":     NewCodecJson(),
+		"checksum": NewCodecChecksum(NewCodecJson()),
+		"compress": NewCodecCompress(NewCodecJson(), 0),
+		"checksum+compress": NewCodecChecksum(
+			NewCodecCompress(NewCodecJson(), 0)),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	coord := &Coordinate{Vec: []float64{0.1, -0.2}, Error: 1.5, Height: 0.01}
+
+	requests := []struct {
+		name string
+		req  Request
+		dst  Request
+	}{
+		{
+			name: "direct ping",
+			req: RequestDirectPing{
+				Updates:    testResponse(3).Updates,
+				From:       "a",
+				Coordinate: coord,
+			},
+			dst: &RequestDirectPing{},
+		},
+		{
+			name: "indirect ping",
+			req: RequestIndirectPing{
+				Updates:    testResponse(1).Updates,
+				TargetPeer: fakePeer("target"),
+			},
+			dst: &RequestIndirectPing{},
+		},
+		{
+			name: "push pull",
+			req:  RequestPushPull{State: testResponse(5).Updates},
+			dst:  &RequestPushPull{},
+		},
+		{
+			name: "query",
+			req: RequestDirectPing{Queries: []Query{{
+				Id:         7,
+				Name:       "q",
+				From:       fakePeer("origin"),
+				Payload:    []byte("payload"),
+				FilterTags: map[string]string{"zone": "us-.*"},
+				Deadline:   time.Unix(1700000000, 0).UTC(),
+			}}},
+			dst: &RequestDirectPing{},
+		},
+	}
+
+	for codecName, codec := range testCodecs() {
+		for _, test := range requests {
+			t.Run(codecName+"/"+test.name, func(t *testing.T) {
+				buf := new(bytes.Buffer)
+
+				if err := codec.EncodeRequest(test.req, buf); err != nil {
+					t.Fatalf("encode: %+v", err)
+				}
+
+				if err := codec.DecodeRequest(buf, test.dst); err != nil {
+					t.Fatalf("decode: %+v", err)
+				}
+
+				got, want := jsonString(t, test.dst), jsonString(t, test.req)
+
+				if got != want {
+					t.Errorf("decoded %s, want %s", got, want)
+				}
+			})
+		}
+
+		t.Run(codecName+"/response", func(t *testing.T) {
+			resp := testResponse(4)
+			resp.Coordinate = coord
+			resp.Nack = true
+
+			buf := new(bytes.Buffer)
+
+			if err := codec.EncodeResponse(resp, buf); err != nil {
+				t.Fatalf("encode: %+v", err)
+			}
+
+			var decoded Response
+
+			if err := codec.DecodeResponse(buf, &decoded); err != nil {
+				t.Fatalf("decode: %+v", err)
+			}
+
+			got, want := jsonString(t, decoded), jsonString(t, resp)
+
+			if got != want {
+				t.Errorf("decoded %s, want %s", got, want)
+			}
+		})
+
+		t.Run(codecName+"/event", func(t *testing.T) {
+			ev := MemberEvent{
+				Index: 3,
+				Type:  MemberEventFailed,
+				Member: Member{
+					Peer:        fakePeer("a"),
+					State:       MemberStateDead,
+					Incarnation: 2,
+				},
+				Time: time.Unix(1700000000, 0).UTC(),
+			}
+
+			buf := new(bytes.Buffer)
+
+			if err := codec.EncodeEvent(ev, buf); err != nil {
+				t.Fatalf("encode: %+v", err)
+			}
+
+			var decoded MemberEvent
+
+			if err := codec.DecodeEvent(buf, &decoded); err != nil {
+				t.Fatalf("decode: %+v", err)
+			}
+
+			if decoded.Index != ev.Index || decoded.Type != ev.Type ||
+				decoded.Member.Peer.PeerId() != "a" ||
+				decoded.Member.State != ev.Member.State ||
+				!decoded.Time.Equal(ev.Time) {
+				t.Errorf("decoded %+v, want %+v", decoded, ev)
+			}
+		})
+	}
+}
+
+func TestCodecChecksumCorruption(t *testing.T) {
+	encoded := new(bytes.Buffer)
+
+	if err := NewCodecChecksum(NewCodecJson()).
+		EncodeResponse(testResponse(3), encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := func(i int) []byte {
+		data := append([]byte(nil), encoded.Bytes()...)
+		data[i] ^= 0xff
+
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		limit  int64
+		reason string
+	}{
+		{name: "intact", data: encoded.Bytes()},
+		{name: "checksum flipped", data: corrupt(0),
+			reason: "checksum_mismatch"},
+		{name: "payload flipped", data: corrupt(encoded.Len() / 2),
+			reason: "checksum_mismatch"},
+		{name: "truncated payload", data: encoded.Bytes()[:encoded.Len()-5],
+			reason: "checksum_mismatch"},
+		{name: "truncated header", data: encoded.Bytes()[:2],
+			reason: "malformed"},
+		{name: "too large", data: encoded.Bytes(), limit: 16,
+			reason: "too_large"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codec := NewCodecChecksum(NewCodecJson())
+
+			if test.limit > 0 {
+				codec.MaxMessageSize = test.limit
+			}
+
+			var resp Response
+
+			err := codec.DecodeResponse(bytes.NewReader(test.data), &resp)
+
+			if test.reason == "" {
+				if err != nil {
+					t.Fatalf("decode: %+v", err)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if reason := decodeErrorReason(err); reason != test.reason {
+				t.Errorf("reason %s, want %s: %v", reason, test.reason, err)
+			}
+		})
+	}
+}
+
+func TestCodecJsonMaxMessageSize(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	if err := NewCodecJson().EncodeResponse(testResponse(100), buf); err != nil {
+		t.Fatal(err)
+	}
+
+	codec := NewCodecJson()
+	codec.MaxMessageSize = int64(buf.Len() / 2)
+
+	var resp Response
+
+	if err := codec.DecodeResponse(buf, &resp); errors.Cause(err) != ErrMessageTooLarge {
+		t.Errorf("decode returned %v", err)
+	}
+}
+
+func TestTransportHttpRejectsLargeRequests(t *testing.T) {
+	codec := NewCodecJson()
+	codec.MaxMessageSize = 1024
+
+	tr, peer := newTestTransport(t, func(params *TransportHttpParams) {
+		params.Codec = codec
+	})
+
+	startTestTransport(t, tr)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "malformed", body: "{", status: http.StatusBadRequest},
+		{name: "too large", body: `{"From":"` + strings.Repeat("a", 4096) + `"}`,
+			status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			req, err := http.NewRequest(http.MethodPost,
+				peer.String()+"/v1/ping/direct", strings.NewReader(test.body))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+
+			if err != nil {
+				t.Fatalf("post: %s", err)
+			}
+
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != test.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, test.status)
+			}
+		})
+	}
+}
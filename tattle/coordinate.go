@@ -0,0 +1,437 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Coordinates closer than that are considered equal
+const coordinateZeroThreshold = 1.0e-6
+
+// RTT samples above that are considered bogus
+const coordinateMaxRtt = 10 * time.Second
+
+var (
+	ErrNoCoordinate = errors.New("coordinate is not known")
+)
+
+// Vivaldi network coordinate parameters
+type CoordinateParams struct {
+	// Number of dimensions of the euclidean part of coordinates
+	Dimensionality int
+	// Maximum and initial error of a coordinate
+	VivaldiErrorMax float64
+	// Error and coordinate adjustment gains
+	VivaldiCE float64
+	VivaldiCC float64
+	// Number of samples used to compute the adjustment term,
+	// 0 disables adjustments
+	AdjustmentWindowSize int
+	// Minimum height term in seconds
+	HeightMin float64
+	// Number of RTT samples per peer the median is taken of
+	LatencyFilterSize int
+	// Strength of the pull towards the origin, in seconds
+	GravityRho float64
+}
+
+// Return default coordinate parameters
+func DefaultCoordinateParams() CoordinateParams {
+	return CoordinateParams{
+		Dimensionality:       8,
+		VivaldiErrorMax:      1.5,
+		VivaldiCE:            0.25,
+		VivaldiCC:            0.25,
+		AdjustmentWindowSize: 20,
+		HeightMin:            10.0e-6,
+		LatencyFilterSize:    3,
+		GravityRho:           150.0,
+	}
+}
+
+// Vivaldi network coordinate of a node, distances are in seconds
+type Coordinate struct {
+	Vec        []float64 `json:"vec"`
+	Error      float64   `json:"error"`
+	Adjustment float64   `json:"adjustment"`
+	Height     float64   `json:"height"`
+}
+
+// Return a coordinate at the origin with maximum error
+func NewCoordinate(params CoordinateParams) Coordinate {
+	return Coordinate{
+		Vec:    make([]float64, params.Dimensionality),
+		Error:  params.VivaldiErrorMax,
+		Height: params.HeightMin,
+	}
+}
+
+// Return a deep copy of the coordinate
+func (c Coordinate) Clone() Coordinate {
+	c.Vec = append([]float64(nil), c.Vec...)
+
+	return c
+}
+
+// Check that the coordinate has no NaN or infinite components
+func (c Coordinate) IsValid() bool {
+	for _, v := range c.Vec {
+		if !isFinite(v) {
+			return false
+		}
+	}
+
+	return isFinite(c.Error) && isFinite(c.Adjustment) && isFinite(c.Height)
+}
+
+// Check that both coordinates have the same dimensionality
+func (c Coordinate) IsCompatibleWith(other Coordinate) bool {
+	return len(c.Vec) == len(other.Vec)
+}
+
+// Return estimated round-trip time to the other coordinate
+func (c Coordinate) DistanceTo(other Coordinate) time.Duration {
+	dist := c.rawDistanceTo(other)
+
+	if adjusted := dist + c.Adjustment + other.Adjustment; adjusted > 0 {
+		dist = adjusted
+	}
+
+	return time.Duration(dist * float64(time.Second))
+}
+
+// Distance in seconds without adjustment terms
+func (c Coordinate) rawDistanceTo(other Coordinate) float64 {
+	return magnitude(diff(c.Vec, other.Vec)) + c.Height + other.Height
+}
+
+// Move the coordinate by force seconds away from the other one,
+// or towards it if the force is negative
+func (c Coordinate) applyForce(
+	params CoordinateParams, rnd *rand.Rand, force float64, other Coordinate,
+) Coordinate {
+	ret := c.Clone()
+	unit, mag := unitVectorAt(rnd, c.Vec, other.Vec)
+
+	for i := range ret.Vec {
+		ret.Vec[i] += unit[i] * force
+	}
+
+	if mag > coordinateZeroThreshold {
+		ret.Height = (ret.Height+other.Height)*force/mag + ret.Height
+		ret.Height = math.Max(ret.Height, params.HeightMin)
+	}
+
+	return ret
+}
+
+// Maintains local coordinate from RTT samples
+type coordinateClient struct {
+	params CoordinateParams
+	rnd    *rand.Rand
+
+	mu     sync.Mutex
+	coord  Coordinate
+	origin Coordinate
+	// Ring of recent adjustment samples
+	adjustmentSamples []float64
+	adjustmentIndex   int
+	// Recent RTT samples by peer id
+	latencies map[string][]float64
+}
+
+func newCoordinateClient(params CoordinateParams) (*coordinateClient, error) {
+	// Negated comparisons reject NaN as well
+	switch {
+	case params.Dimensionality < 1:
+		return nil, errors.New("coordinate dimensionality must be at least 1")
+	case params.LatencyFilterSize < 1:
+		return nil, errors.New("latency filter size must be at least 1")
+	case params.AdjustmentWindowSize < 0:
+		return nil, errors.New("adjustment window size must not be negative")
+	case !(params.VivaldiErrorMax > 0):
+		return nil, errors.New("vivaldi error max must be positive")
+	case !(params.VivaldiCE > 0):
+		return nil, errors.New("vivaldi ce must be positive")
+	case !(params.VivaldiCC > 0):
+		return nil, errors.New("vivaldi cc must be positive")
+	case !(params.GravityRho > 0):
+		return nil, errors.New("gravity rho must be positive")
+	}
+
+	return &coordinateClient{
+		params:            params,
+		rnd:               rand.New(rand.NewSource(time.Now().UnixNano())),
+		coord:             NewCoordinate(params),
+		origin:            NewCoordinate(params),
+		adjustmentSamples: make([]float64, params.AdjustmentWindowSize),
+		latencies:         map[string][]float64{},
+	}, nil
+}
+
+// Return a copy of the local coordinate
+func (c *coordinateClient) get() Coordinate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.coord.Clone()
+}
+
+// Check that a remote coordinate can be used with the local one
+func (c *coordinateClient) acceptable(other Coordinate) bool {
+	return other.IsValid() && len(other.Vec) == c.params.Dimensionality
+}
+
+// Update the local coordinate with the RTT observed to the peer
+// at the other coordinate
+func (c *coordinateClient) update(
+	id string, other Coordinate, rtt time.Duration) error {
+
+	if !c.acceptable(other) {
+		return errors.New("invalid remote coordinate")
+	}
+
+	if rtt < 0 || rtt > coordinateMaxRtt {
+		return errors.Errorf("round trip time out of range: %s", rtt)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seconds := c.filterLatency(id, rtt.Seconds())
+
+	c.updateVivaldi(other, seconds)
+	c.updateAdjustment(other, seconds)
+	c.updateGravity()
+
+	// Start over rather than propagate garbage
+	if !c.coord.IsValid() {
+		c.coord = NewCoordinate(c.params)
+
+		return errors.New("local coordinate became invalid, reset")
+	}
+
+	return nil
+}
+
+// Forget RTT samples of the peer
+func (c *coordinateClient) forget(id string) {
+	c.mu.Lock()
+	delete(c.latencies, id)
+	c.mu.Unlock()
+}
+
+// Add the sample to the peer's window and return the median
+func (c *coordinateClient) filterLatency(id string, rtt float64) float64 {
+	samples := append(c.latencies[id], rtt)
+
+	if len(samples) > c.params.LatencyFilterSize {
+		samples = samples[1:]
+	}
+
+	c.latencies[id] = samples
+
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+
+	return sorted[len(sorted)/2]
+}
+
+func (c *coordinateClient) updateVivaldi(other Coordinate, rtt float64) {
+	rtt = math.Max(rtt, coordinateZeroThreshold)
+	dist := c.coord.DistanceTo(other).Seconds()
+	wrongness := math.Abs(dist-rtt) / rtt
+
+	totalError := math.Max(c.coord.Error+other.Error, coordinateZeroThreshold)
+	weight := c.coord.Error / totalError
+
+	c.coord.Error = c.params.VivaldiCE*weight*wrongness +
+		c.coord.Error*(1.0-c.params.VivaldiCE*weight)
+	c.coord.Error = math.Min(c.coord.Error, c.params.VivaldiErrorMax)
+
+	force := c.params.VivaldiCC * weight * (rtt - dist)
+	c.coord = c.coord.applyForce(c.params, c.rnd, force, other)
+}
+
+// Adjustment term compensates for the part of RTTs
+// euclidean space can't capture
+func (c *coordinateClient) updateAdjustment(other Coordinate, rtt float64) {
+	if c.params.AdjustmentWindowSize == 0 {
+		return
+	}
+
+	c.adjustmentSamples[c.adjustmentIndex] = rtt - c.coord.rawDistanceTo(other)
+	c.adjustmentIndex = (c.adjustmentIndex + 1) % c.params.AdjustmentWindowSize
+
+	sum := 0.0
+
+	for _, sample := range c.adjustmentSamples {
+		sum += sample
+	}
+
+	c.coord.Adjustment = sum / (2.0 * float64(c.params.AdjustmentWindowSize))
+}
+
+// Pull the coordinate towards the origin to prevent drift
+func (c *coordinateClient) updateGravity() {
+	dist := c.origin.DistanceTo(c.coord).Seconds()
+	force := -1.0 * math.Pow(dist/c.params.GravityRho, 2.0)
+
+	c.coord = c.coord.applyForce(c.params, c.rnd, force, c.origin)
+}
+
+// Return a unit vector pointing from v2 to v1 and the distance
+// between them, random direction is chosen if they coincide
+func unitVectorAt(rnd *rand.Rand, v1, v2 []float64) ([]float64, float64) {
+	ret := diff(v1, v2)
+
+	if mag := magnitude(ret); mag > coordinateZeroThreshold {
+		return scale(ret, 1.0/mag), mag
+	}
+
+	for i := range ret {
+		ret[i] = rnd.Float64() - 0.5
+	}
+
+	if mag := magnitude(ret); mag > coordinateZeroThreshold {
+		return scale(ret, 1.0/mag), 0.0
+	}
+
+	ret = make([]float64, len(ret))
+	ret[0] = 1.0
+
+	return ret, 0.0
+}
+
+func diff(v1, v2 []float64) []float64 {
+	ret := make([]float64, len(v1))
+
+	for i := range ret {
+		if i < len(v2) {
+			ret[i] = v1[i] - v2[i]
+		} else {
+			ret[i] = v1[i]
+		}
+	}
+
+	return ret
+}
+
+func scale(v []float64, factor float64) []float64 {
+	ret := make([]float64, len(v))
+
+	for i, x := range v {
+		ret[i] = x * factor
+	}
+
+	return ret
+}
+
+func magnitude(v []float64) float64 {
+	sum := 0.0
+
+	for _, x := range v {
+		sum += x * x
+	}
+
+	return math.Sqrt(sum)
+}
+
+func isFinite(f float64) bool {
+	return !math.IsInf(f, 0) && !math.IsNaN(f)
+}
+
+// Return local network coordinate
+func (d *Detector) Coordinate() Coordinate {
+	return d.coord.get()
+}
+
+// Estimate round-trip time to the member with the given id
+// from network coordinates
+func (d *Detector) EstimateRTT(id string) (time.Duration, error) {
+	if d.isLocalId(id) {
+		return 0, nil
+	}
+
+	m, ok := d.members.get(id)
+
+	if !ok {
+		return 0, errors.Wrap(ErrUnknownMember, id)
+	}
+
+	if m.Coordinate == nil {
+		return 0, errors.Wrap(ErrNoCoordinate, id)
+	}
+
+	local := d.coord.get()
+
+	if !local.IsCompatibleWith(*m.Coordinate) {
+		return 0, errors.Wrapf(ErrNoCoordinate,
+			"incompatible coordinate of %s", id)
+	}
+
+	return local.DistanceTo(*m.Coordinate), nil
+}
+
+// Remember the member's coordinate and update the local one
+// if the round-trip time to it was measured
+func (d *Detector) observeCoordinate(
+	id string, coord *Coordinate, rtt time.Duration) {
+
+	if coord == nil || d.isLocalId(id) || !d.coord.acceptable(*coord) {
+		return
+	}
+
+	c := coord.Clone()
+
+	d.members.update(func(members map[string]*Member) {
+		if m, ok := members[id]; ok {
+			m.Coordinate = &c
+		}
+	})
+
+	if rtt <= 0 {
+		return
+	}
+
+	if err := d.coord.update(id, c, rtt); err != nil {
+		d.Logger.With(LogFieldPeerId, id, LogFieldError, err).
+			Debug("coordinate update rejected")
+	}
+}
+
+// Return local coordinate to send along with a message
+func (d *Detector) localCoordinate() *Coordinate {
+	c := d.coord.get()
+
+	return &c
+}
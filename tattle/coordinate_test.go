@@ -0,0 +1,289 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Simulate a cluster where every node repeatedly measures RTT to a random
+// peer and return coordinate clients of the nodes
+func simulateCoordinates(
+	t *testing.T,
+	rtt [][]time.Duration,
+	rounds int,
+) []*coordinateClient {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(1))
+	clients := make([]*coordinateClient, len(rtt))
+
+	for i := range clients {
+		c, err := newCoordinateClient(DefaultCoordinateParams())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.rnd = rand.New(rand.NewSource(int64(i)))
+		clients[i] = c
+	}
+
+	for round := 0; round < rounds; round++ {
+		for i, c := range clients {
+			j := rnd.Intn(len(clients))
+
+			if j == i {
+				continue
+			}
+
+			if err := c.update(strconv.Itoa(j), clients[j].get(), rtt[i][j]); err != nil {
+				t.Fatalf("update: %s", err)
+			}
+		}
+	}
+
+	return clients
+}
+
+// Return RTTs between nodes placed at the given points of a plane,
+// coordinates are in milliseconds
+func planeRtt(points [][2]float64) [][]time.Duration {
+	rtt := make([][]time.Duration, len(points))
+
+	for i, p := range points {
+		rtt[i] = make([]time.Duration, len(points))
+
+		for j, q := range points {
+			dist := math.Hypot(p[0]-q[0], p[1]-q[1])
+			rtt[i][j] = time.Duration(dist * float64(time.Millisecond))
+		}
+	}
+
+	return rtt
+}
+
+func TestCoordinateConvergence(t *testing.T) {
+	var line, grid, split [][2]float64
+
+	for i := 0; i < 10; i++ {
+		line = append(line, [2]float64{float64(i) * 10, 0})
+		grid = append(grid, [2]float64{float64(i%4) * 10, float64(i/4) * 10})
+	}
+
+	for i := 0; i < 10; i++ {
+		x := float64(i%2) * 100
+		split = append(split, [2]float64{x + float64(i%3), float64(i / 2)})
+	}
+
+	tests := []struct {
+		name   string
+		points [][2]float64
+		// Maximum average relative error of RTT estimates
+		maxError float64
+	}{
+		{"line", line, 0.05},
+		{"grid", grid, 0.05},
+		{"two sites", split, 0.05},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rtt := planeRtt(test.points)
+			clients := simulateCoordinates(t, rtt, 1000)
+
+			total, pairs := 0.0, 0
+
+			for i := range clients {
+				for j := range clients {
+					if i == j || rtt[i][j] == 0 {
+						continue
+					}
+
+					est := clients[i].get().DistanceTo(clients[j].get())
+					total += math.Abs(float64(est-rtt[i][j])) / float64(rtt[i][j])
+					pairs++
+				}
+			}
+
+			if avg := total / float64(pairs); avg > test.maxError {
+				t.Errorf("average relative error %.3f, want at most %.3f",
+					avg, test.maxError)
+			}
+
+			for i, c := range clients {
+				if coord := c.get(); coord.Error >= DefaultCoordinateParams().VivaldiErrorMax {
+					t.Errorf("node %d error estimate didn't improve: %f", i, coord.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestCoordinateClientParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(p *CoordinateParams)
+		wantErr bool
+	}{
+		{"defaults", func(p *CoordinateParams) {}, false},
+		{"no dimensions", func(p *CoordinateParams) { p.Dimensionality = 0 }, true},
+		{"no latency filter", func(p *CoordinateParams) { p.LatencyFilterSize = 0 }, true},
+		{"negative window", func(p *CoordinateParams) { p.AdjustmentWindowSize = -1 }, true},
+		{"no adjustment", func(p *CoordinateParams) { p.AdjustmentWindowSize = 0 }, false},
+		{"zero error max", func(p *CoordinateParams) { p.VivaldiErrorMax = 0 }, true},
+		{"zero ce", func(p *CoordinateParams) { p.VivaldiCE = 0 }, true},
+		{"negative cc", func(p *CoordinateParams) { p.VivaldiCC = -0.25 }, true},
+		{"zero gravity", func(p *CoordinateParams) { p.GravityRho = 0 }, true},
+		{"nan gravity", func(p *CoordinateParams) { p.GravityRho = math.NaN() }, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := DefaultCoordinateParams()
+			test.change(&params)
+
+			if _, err := newCoordinateClient(params); (err != nil) != test.wantErr {
+				t.Errorf("err = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCoordinateClientUpdate(t *testing.T) {
+	params := DefaultCoordinateParams()
+	valid := NewCoordinate(params)
+
+	nan := NewCoordinate(params)
+	nan.Vec[0] = math.NaN()
+
+	tests := []struct {
+		name    string
+		other   Coordinate
+		rtt     time.Duration
+		wantErr bool
+	}{
+		{"valid", valid, 10 * time.Millisecond, false},
+		{"zero rtt", valid, 0, false},
+		{"wrong dimensionality", NewCoordinate(CoordinateParams{Dimensionality: 2}),
+			10 * time.Millisecond, true},
+		{"not finite", nan, 10 * time.Millisecond, true},
+		{"negative rtt", valid, -time.Millisecond, true},
+		{"rtt too large", valid, coordinateMaxRtt + time.Second, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := newCoordinateClient(params)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.update("peer", test.other, test.rtt)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+
+			if !c.get().IsValid() {
+				t.Errorf("local coordinate became invalid: %+v", c.get())
+			}
+		})
+	}
+}
+
+func TestFilterLatency(t *testing.T) {
+	c, err := newCoordinateClient(DefaultCoordinateParams())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Median of the last three samples
+	tests := []struct {
+		sample float64
+		want   float64
+	}{
+		{10, 10},
+		{30, 30},
+		{20, 20},
+		{1000, 30},
+		{25, 25},
+		{26, 26},
+	}
+
+	for _, test := range tests {
+		if got := c.filterLatency("peer", test.sample); got != test.want {
+			t.Errorf("after %v: median = %v, want %v", test.sample, got, test.want)
+		}
+	}
+
+	c.forget("peer")
+
+	if got := c.filterLatency("peer", 5); got != 5 {
+		t.Errorf("after forget: median = %v, want 5", got)
+	}
+}
+
+func TestEstimateRTT(t *testing.T) {
+	d := newTestDetector(t, testDetectorParams(newFakeTransport(nil),
+		fakePeer("local"), fakePeer("seed"), fakePeer("known")))
+
+	coord := NewCoordinate(d.coord.params)
+	coord.Vec[0] = 0.05
+
+	d.observeCoordinate("known", &coord, 0)
+
+	tests := []struct {
+		id        string
+		wantCause error
+	}{
+		{"local", nil},
+		{"known", nil},
+		{"seed", ErrNoCoordinate},
+		{"stranger", ErrUnknownMember},
+	}
+
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			rtt, err := d.EstimateRTT(test.id)
+
+			if errors.Cause(err) != test.wantCause {
+				t.Fatalf("err = %v, want %v", err, test.wantCause)
+			}
+
+			if test.id == "known" && rtt < 50*time.Millisecond {
+				t.Errorf("rtt = %s, want at least 50ms", rtt)
+			}
+		})
+	}
+}
@@ -26,6 +26,11 @@ package tattle
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -34,55 +39,330 @@ import (
 var (
 	// Returned when no initial peers were provided in params
 	ErrNoPeers = errors.New("no peers provided")
+	// Returned when operation requires the local node to be in the cluster
+	ErrLeft = errors.New("local node has left the cluster")
+	// Returned when referenced member is not known
+	ErrUnknownMember = errors.New("unknown member")
+	// Returned when trying to force an alive or suspect member to leave
+	ErrMemberAlive = errors.New("member is alive")
 )
 
 type Detector struct {
 	DetectorParams
+
+	members    *memberList
+	broadcasts *broadcastQueue
+	events     *eventLog
+
+	// Guards local node state below
+	mu          sync.Mutex
+	incarnation uint64
+	healthScore int
+	leaving     bool
+	tune        DetectorTuning
+
+	userClock      LamportClock
+	userEvents     *userEventBuffer
+	userBroadcasts *messageQueue
+	userDelivery   chan UserEvent
+
+	queryMu         sync.Mutex
+	queries         map[uint64]*QueryResponse
+	seenQueries     map[string]time.Time
+	queryBroadcasts *messageQueue
+
+	// Local network coordinate
+	coord *coordinateClient
+
+	partition *partitionTracker
+
+	rpcPool *rpcPool
+	// Detector goroutines, probes and other outbound work in progress
+	inflight sync.WaitGroup
+
+	// Guards lifecycle state below
+	lifeMu  sync.Mutex
+	started bool
+	stopped bool
+	// Set once the detector waits for its goroutines to exit,
+	// nothing is spawned afterwards
+	draining bool
+	// Pending timers started with afterFunc
+	timers map[*time.Timer]struct{}
+	// Cancels Ctx derived from the one in params
+	cancel context.CancelFunc
+	// Closed once all goroutines exited
+	done chan struct{}
+	// Error encountered while stopping, set before done is closed
+	stopErr error
+	// Set once any member confirmed being alive
+	joined int32
+
+	// Guards Rnd which is used from several goroutines
+	rndMu sync.Mutex
+
+	// Members of every failure domain yet to be probed in turn
+	domainMu     sync.Mutex
+	domainQueues map[string][]Peer
+
+	// Optional membership snapshot and members it remembered at startup
+	snapshot    *snapshot
+	rejoinPeers []Peer
 }
 
 // Create a new  Detector instance
 func NewDetector(params DetectorParams) (*Detector, error) {
-	if len(params.Peers) == 0 {
+	// Snapshot may know enough members to rejoin without seeds
+	if len(params.Peers) == 0 && params.SnapshotPath == "" {
 		return nil, errors.WithStack(ErrNoPeers)
 	}
 
-	return &Detector{
+	if params.MaxConcurrentRpcs < 1 {
+		return nil, errors.New("max concurrent rpcs must be at least 1")
+	}
+
+	if err := params.tuning().validate(); err != nil {
+		return nil, err
+	}
+
+	coord, err := newCoordinateClient(params.Coordinate)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid coordinate params")
+	}
+
+	d := &Detector{
 		DetectorParams: params,
-	}, nil
+		members:        newMemberList(),
+		broadcasts:     newBroadcastQueue(),
+		events:         newEventLog(params.EventLogSize),
+		tune:           params.tuning(),
+		userEvents:     newUserEventBuffer(params.UserEventBufferSize),
+		userBroadcasts: newMessageQueue(),
+		userDelivery:   make(chan UserEvent, params.UserEventBufferSize),
+
+		queries:         map[uint64]*QueryResponse{},
+		seenQueries:     map[string]time.Time{},
+		queryBroadcasts: newMessageQueue(),
+
+		coord:     coord,
+		partition: newPartitionTracker(),
+		rpcPool:   newRpcPool(params.MaxConcurrentRpcs),
+		done:      make(chan struct{}),
+		timers:    map[*time.Timer]struct{}{},
+	}
+
+	now := time.Now()
+
+	d.members.update(func(members map[string]*Member) {
+		for _, peer := range params.Peers {
+			// Seed lists are often shared by all nodes
+			if d.isLocal(peer) || (d.LocalPeer != nil &&
+				sameAddress(peer, d.LocalPeer)) {
+				continue
+			}
+
+			members[peer.PeerId()] = &Member{
+				Peer:        peer,
+				State:       MemberStateAlive,
+				StateChange: now,
+				seed:        true,
+			}
+		}
+	})
+
+	if params.SnapshotPath != "" {
+		if err := d.restoreSnapshot(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(params.Peers) == 0 && len(d.rejoinPeers) == 0 {
+		_ = d.snapshot.close()
+
+		return nil, errors.WithStack(ErrNoPeers)
+	}
+
+	d.Ctx, d.cancel = context.WithCancel(params.Ctx)
+
+	// Announce ourselves to the cluster
+	if d.LocalPeer != nil {
+		d.broadcasts.queue(d.localUpdate())
+	}
+
+	return d, nil
 }
 
-// Run main detector loop
+// Start the detector and block until it stops. Prefer Start and Stop,
+// Run is kept for callers which cancel the context of the parameters.
 func (d *Detector) Run() error {
-	if d.WaitGroup != nil {
-		defer d.WaitGroup.Done()
+	if err := d.Start(d.Ctx); err != nil {
+		return err
 	}
 
-	timer := time.NewTimer(d.PingInterval)
-	idx := 0
+	<-d.Done()
 
-	// Process incoming requests
-	go d.processIncoming()
+	if d.stopErr != nil {
+		return d.stopErr
+	}
+
+	return errors.WithStack(context.Canceled)
+}
+
+// Main detector loop
+func (d *Detector) run() {
+	timer := time.NewTimer(d.Tuning().PingInterval)
+	defer timer.Stop()
+
+	var probeList []Peer
+
+	d.updateGauges()
 
 	for {
 		select {
 		case <-d.Ctx.Done():
-			return errors.WithStack(context.Canceled)
+			// Outbound calls are canceled along with the context
+			return
 
 		case <-timer.C:
-			if idx == 0 {
-				d.shufflePeers()
+			// Node which left the cluster doesn't probe anybody
+			if d.isLeaving() {
+				probeList = nil
+			} else if len(probeList) == 0 {
+				probeList = d.probeTargets()
 			}
 
-			// Need to ping one of the peers
-			peer := d.Peers[idx]
+			// Need to ping one of the peers unless the network is
+			// so slow that previous calls are still pending
+			if len(probeList) > 0 && !d.rpcPool.available() {
+				d.Metrics.Add(MetricRpcRejected, 1, probeTypeDirect)
+
+				d.Logger.Warning("all rpc slots are busy, skipping probe")
+			} else if len(probeList) > 0 {
+				peer := probeList[0]
+				probeList = probeList[1:]
+				helpers := d.pickHelpers(peer)
 
-			go d.pingPeer(peer)
+				d.spawn(func() { d.probePeer(peer, helpers) })
+			}
+
+			d.updateGauges()
+			d.checkPartition()
+			d.reapTombstones()
 
-			idx = (idx + 1) % len(d.Peers)
+			timer.Reset(d.Tuning().PingInterval)
 		}
 	}
 }
 
+// Run f with exclusive access to the random source
+func (d *Detector) random(f func(rnd *rand.Rand)) {
+	d.rndMu.Lock()
+	defer d.rndMu.Unlock()
+
+	f(d.Rnd)
+}
+
+// Shuffle peers in place
+func (d *Detector) shufflePeers(peers []Peer) {
+	d.random(func(rnd *rand.Rand) {
+		rnd.Shuffle(len(peers), func(i, j int) {
+			peers[i], peers[j] = peers[j], peers[i]
+		})
+	})
+}
+
+// Return all the known members except the local one
+func (d *Detector) Members() []Member {
+	return d.members.list()
+}
+
+// Return the local node as a member
+func (d *Detector) LocalMember() Member {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state := MemberStateAlive
+
+	if d.leaving {
+		state = MemberStateLeft
+	}
+
+	return Member{
+		Peer:        d.LocalPeer,
+		State:       state,
+		Incarnation: d.incarnation,
+		Tags:        copyTags(d.Tags),
+		LastSeen:    time.Now(),
+		Coordinate:  d.localCoordinate(),
+	}
+}
+
+// Return local health score, zero means healthy
+func (d *Detector) HealthScore() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.healthScore
+}
+
+// Return current probe and dissemination settings
+func (d *Detector) Tuning() DetectorTuning {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.tune
+}
+
+// Change probe and dissemination settings,
+// new values take effect starting from the next probe round
+func (d *Detector) SetTuning(tune DetectorTuning) error {
+	if err := tune.validate(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.tune = tune
+
+	if d.healthScore > tune.MaxHealthScore {
+		d.healthScore = tune.MaxHealthScore
+	}
+
+	return nil
+}
+
+// Change tags of the local node and announce them to the cluster
+func (d *Detector) SetTags(tags map[string]string) error {
+	d.mu.Lock()
+
+	if d.leaving {
+		d.mu.Unlock()
+
+		return errors.WithStack(ErrLeft)
+	}
+
+	d.Tags = copyTags(tags)
+	d.incarnation++
+	incarnation := d.incarnation
+
+	d.mu.Unlock()
+
+	d.persistIncarnation(incarnation)
+
+	if d.LocalPeer != nil {
+		d.broadcasts.queue(d.localUpdate())
+	}
+
+	return nil
+}
+
+// Return updates waiting to be disseminated
+func (d *Detector) Broadcasts() []Broadcast {
+	return d.broadcasts.list()
+}
+
 func (d *Detector) processIncoming() {
 	for {
 		select {
@@ -90,45 +370,480 @@ func (d *Detector) processIncoming() {
 			return
 
 		case inReq := <-d.Transport.IncomingRequests():
-			d.Logger.Info("Incoming request: %v", inReq)
+			d.Logger.With(LogFieldRequest, fmt.Sprintf("%T", inReq.Request)).
+				Debug("incoming request")
+
+			switch req := inReq.Request.(type) {
+			case RequestDirectPing:
+				d.applyUpdates(req.Updates)
+				d.applyUserEvents(req.UserEvents)
+				d.applyQueries(req.Queries)
+				d.observeCoordinate(req.From, req.Coordinate, 0)
+
+				inReq.ResponseChan <- Response{
+					Updates:    d.piggyback(),
+					UserEvents: d.piggybackUserEvents(),
+					Queries:    d.piggybackQueries(),
+					Coordinate: d.localCoordinate(),
+				}
+
+			case RequestIndirectPing:
+				d.applyUpdates(req.Updates)
+				d.applyUserEvents(req.UserEvents)
+				d.applyQueries(req.Queries)
+
+				// Nack rather than queue behind a slow network
+				if !d.rpcPool.available() {
+					d.Metrics.Add(MetricRpcRejected, 1, probeTypeIndirect)
 
-			// TODO
+					inReq.ResponseChan <- Response{Nack: true}
+
+					continue
+				}
+
+				if !d.spawn(func() { d.pingOnBehalf(inReq, req) }) {
+					inReq.ResponseChan <- Response{Nack: true}
+				}
+
+			case RequestQueryResponse:
+				d.deliverQueryResponse(req)
+
+				inReq.ResponseChan <- Response{}
+
+			case RequestPushPull:
+				d.applyUpdates(req.State)
+
+				inReq.ResponseChan <- Response{Updates: d.localState()}
+
+			default:
+				d.Logger.Warning("unexpected request type: %T", req)
+			}
 		}
 	}
 }
 
+// Run a single probe round against the peer:
+// direct ping first, then indirect pings through helpers
+func (d *Detector) probePeer(peer Peer, helpers []Peer) {
+	ctx, span := d.Tracer.Start(d.Ctx, "tattle.probe")
+	defer span.End()
+
+	span.SetAttribute(LogFieldPeerId, peer.PeerId())
+
+	if d.pingPeer(ctx, peer) {
+		span.SetAttribute("result", "ack")
+		d.adjustHealth(-1)
+
+		return
+	}
+
+	acked, nacks := d.pingIndirect(ctx, peer, helpers)
+
+	if acked {
+		span.SetAttribute("result", "indirect_ack")
+
+		return
+	}
+
+	// Nobody answered at all, the problem may be on our side
+	if nacks == 0 {
+		d.adjustHealth(1)
+	}
+
+	span.SetAttribute("result", "suspect")
+
+	d.suspect(peer)
+}
+
 // Send a direct ping request to the peer
-func (d *Detector) pingPeer(peer Peer) {
-	// TODO: Actual updates
-	updates := []UpdateEvent{
-		{
-			Peer:       peer,
-			UpdateType: UpdateTypePeerAlive,
-			SeqNum:     1,
-		},
+func (d *Detector) pingPeer(ctx context.Context, peer Peer) bool {
+	req := RequestDirectPing{
+		Updates:    d.piggyback(),
+		UserEvents: d.piggybackUserEvents(),
+		Queries:    d.piggybackQueries(),
+		From:       d.localId(),
+		Coordinate: d.localCoordinate(),
+	}
+
+	d.Metrics.Add(MetricProbesSent, 1, probeTypeDirect)
+
+	start := time.Now()
+	resp, err := d.rpc(ctx, peer, req, d.pingTimeout())
+
+	if err != nil {
+		d.Logger.With(LogFieldPeerId, peer.PeerId(), LogFieldError, err).
+			Warning("direct ping failed")
+
+		return false
+	}
+
+	rtt := time.Since(start)
+
+	d.Metrics.Add(MetricAcksReceived, 1, probeTypeDirect)
+	d.Metrics.Observe(MetricProbeRtt, rtt.Seconds(), probeTypeDirect)
+
+	d.members.update(func(members map[string]*Member) {
+		if m, ok := members[peer.PeerId()]; ok {
+			m.LastSeen = time.Now()
+			m.Rtt = rtt
+		}
+	})
+
+	d.applyUpdates(resp.Updates)
+	d.applyUserEvents(resp.UserEvents)
+	d.applyQueries(resp.Queries)
+	d.observeCoordinate(peer.PeerId(), resp.Coordinate, rtt)
+
+	return true
+}
+
+// Ask helpers to ping the peer, succeed if any of them gets an ack.
+// Also return the number of received nacks.
+func (d *Detector) pingIndirect(
+	ctx context.Context, peer Peer, helpers []Peer) (bool, int) {
+
+	type result struct {
+		ack  bool
+		nack bool
+	}
+
+	results := make(chan result, len(helpers))
+
+	for _, helper := range helpers {
+		helper := helper
+
+		spawned := d.spawn(func() {
+			req := RequestIndirectPing{
+				Updates:    d.piggyback(),
+				UserEvents: d.piggybackUserEvents(),
+				Queries:    d.piggybackQueries(),
+				TargetPeer: peer,
+			}
+
+			d.Metrics.Add(MetricProbesSent, 1, probeTypeIndirect)
+
+			start := time.Now()
+			resp, err := d.rpc(ctx, helper, req,
+				d.Tuning().IndirectPingTimeout)
+
+			switch {
+			case err != nil:
+				d.Logger.With(LogFieldPeerId, helper.PeerId(), LogFieldError, err).
+					Warning("indirect ping request failed")
+			case resp.Nack:
+				SpanFromContext(ctx).SetAttribute("nack."+helper.PeerId(), true)
+
+				d.Logger.With(LogFieldPeerId, peer.PeerId()).
+					Debug("nack from %s", helper.PeerId())
+			default:
+				d.Metrics.Add(MetricAcksReceived, 1, probeTypeIndirect)
+				d.Metrics.Observe(MetricProbeRtt,
+					time.Since(start).Seconds(), probeTypeIndirect)
+			}
+
+			if err == nil {
+				d.applyUpdates(resp.Updates)
+				d.applyUserEvents(resp.UserEvents)
+				d.applyQueries(resp.Queries)
+			}
+
+			results <- result{
+				ack:  err == nil && !resp.Nack,
+				nack: err == nil && resp.Nack,
+			}
+		})
+
+		// Detector is stopping
+		if !spawned {
+			results <- result{}
+		}
+	}
+
+	nacks := 0
+
+	for range helpers {
+		res := <-results
+
+		if res.ack {
+			return true, nacks
+		}
+
+		if res.nack {
+			nacks++
+		}
+	}
+
+	return false, nacks
+}
+
+// Ping a target on behalf of the peer which sent an indirect ping request
+func (d *Detector) pingOnBehalf(inReq IncomingRequest, req RequestIndirectPing) {
+	ctx := inReq.Ctx
+
+	if ctx == nil {
+		ctx = d.Ctx
 	}
 
-	req := &RequestDirectPing{
-		Updates: updates,
+	if req.TargetPeer == nil {
+		inReq.ResponseChan <- Response{Nack: true}
+
+		return
 	}
 
-	resp, err := d.Transport.Rpc(peer, req, d.PingTimeout)
+	d.Metrics.Add(MetricIndirectProbes, 1)
+
+	ctx, span := d.Tracer.Start(ctx, "tattle.indirect_probe")
+	defer span.End()
+
+	span.SetAttribute(LogFieldPeerId, req.TargetPeer.PeerId())
+
+	start := time.Now()
+	resp, err := d.rpc(ctx, req.TargetPeer, RequestDirectPing{
+		Updates:    d.piggyback(),
+		UserEvents: d.piggybackUserEvents(),
+		Queries:    d.piggybackQueries(),
+		From:       d.localId(),
+		Coordinate: d.localCoordinate(),
+	}, d.pingTimeout())
 
 	if err != nil {
-		d.markDead(peer)
+		span.RecordError(err)
+	} else {
+		d.applyUpdates(resp.Updates)
+		d.applyUserEvents(resp.UserEvents)
+		d.applyQueries(resp.Queries)
+		d.observeCoordinate(req.TargetPeer.PeerId(), resp.Coordinate,
+			time.Since(start))
+	}
+
+	inReq.ResponseChan <- Response{
+		Updates:    d.piggyback(),
+		UserEvents: d.piggybackUserEvents(),
+		Queries:    d.piggybackQueries(),
+		Nack:       err != nil,
+	}
+}
+
+// Return targets of the next probe round in random order.
+// Without a failure domain tag a round probes every alive and suspected
+// member. With the tag a round probes one member of every domain,
+// members of a domain taking turns across rounds, so that every domain
+// gets the same share of probes regardless of its size.
+func (d *Detector) probeTargets() []Peer {
+	if d.FailureDomainTag == "" {
+		return d.fanoutTargets()
+	}
+
+	domains := d.groupByDomain(
+		d.members.inStates(MemberStateAlive, MemberStateSuspect), "")
+
+	d.domainMu.Lock()
+	defer d.domainMu.Unlock()
+
+	round := make(map[string][]Peer, len(domains))
+	queues := make(map[string][]Peer, len(domains))
+
+	for name, peers := range domains {
+		current := make(map[string]Peer, len(peers))
+
+		for _, peer := range peers {
+			current[peer.PeerId()] = peer
+		}
+
+		// Skip members which left the domain since the queue was filled
+		queue := d.domainQueues[name]
+
+		for len(queue) > 0 && current[queue[0].PeerId()] == nil {
+			queue = queue[1:]
+		}
+
+		if len(queue) == 0 {
+			d.shufflePeers(peers)
+			queue = peers
+		}
+
+		round[name] = []Peer{current[queue[0].PeerId()]}
+		queues[name] = queue[1:]
 	}
 
-	// TODO:
-	_ = resp
+	d.domainQueues = queues
+
+	return d.interleaveDomains(round, -1)
 }
 
-// Shuffle the peers
-func (d *Detector) shufflePeers() {
-	d.Rnd.Shuffle(len(d.Peers), func(i, j int) {
-		d.Peers[i], d.Peers[j] = d.Peers[j], d.Peers[i]
+// Return alive and suspected members in random order.
+// With a failure domain tag, consecutive members alternate
+// between domains.
+func (d *Detector) fanoutTargets() []Peer {
+	if d.FailureDomainTag == "" {
+		peers := d.members.peers(MemberStateAlive, MemberStateSuspect)
+
+		d.shufflePeers(peers)
+
+		return peers
+	}
+
+	domains := d.groupByDomain(
+		d.members.inStates(MemberStateAlive, MemberStateSuspect), "")
+
+	return d.interleaveDomains(domains, -1)
+}
+
+// Randomly choose alive peers to send indirect pings through.
+// With a failure domain tag, helpers are taken from distinct
+// domains, the ones other than the local domain first.
+func (d *Detector) pickHelpers(target Peer) []Peer {
+	max := d.Tuning().IndirectPingPeers
+	candidates := d.members.inStates(MemberStateAlive)
+
+	if d.FailureDomainTag != "" {
+		domains := d.groupByDomain(candidates, target.PeerId())
+		local := d.LocalMember().Tags[d.FailureDomainTag]
+
+		// Helpers sharing our domain tend to share our fate
+		if peers, ok := domains[local]; ok && len(domains) > 1 {
+			delete(domains, local)
+
+			helpers := d.interleaveDomains(domains, max)
+
+			if len(helpers) < max {
+				helpers = append(helpers, d.interleaveDomains(
+					map[string][]Peer{local: peers}, max-len(helpers))...)
+			}
+
+			return helpers
+		}
+
+		return d.interleaveDomains(domains, max)
+	}
+
+	var helpers []Peer
+
+	var perm []int
+
+	d.random(func(rnd *rand.Rand) {
+		perm = rnd.Perm(len(candidates))
 	})
+
+	for _, idx := range perm {
+		if len(helpers) >= max {
+			break
+		}
+
+		if candidates[idx].Peer.PeerId() != target.PeerId() {
+			helpers = append(helpers, candidates[idx].Peer)
+		}
+	}
+
+	return helpers
+}
+
+// Group peers of the members by failure domain skipping the excluded id.
+// Members without the tag form a domain of their own.
+func (d *Detector) groupByDomain(
+	members []Member, exclude string) map[string][]Peer {
+
+	domains := map[string][]Peer{}
+
+	for _, m := range members {
+		if m.Peer.PeerId() == exclude {
+			continue
+		}
+
+		domain := m.Tags[d.FailureDomainTag]
+		domains[domain] = append(domains[domain], m.Peer)
+	}
+
+	return domains
 }
 
-func (d *Detector) markDead(peer Peer) {
-	d.Logger.Info("TODO: Marking peer %v dead\n", peer)
+// Shuffle peers within domains and merge them taking one peer
+// from every domain in turn, up to max peers if it's not negative
+func (d *Detector) interleaveDomains(domains map[string][]Peer, max int) []Peer {
+	names := make([]string, 0, len(domains))
+	total := 0
+
+	for name, peers := range domains {
+		names = append(names, name)
+		total += len(peers)
+
+		d.shufflePeers(peers)
+	}
+
+	// Map iteration order is random but not uniformly so
+	sort.Strings(names)
+
+	d.random(func(rnd *rand.Rand) {
+		rnd.Shuffle(len(names), func(i, j int) {
+			names[i], names[j] = names[j], names[i]
+		})
+	})
+
+	if max < 0 || max > total {
+		max = total
+	}
+
+	result := make([]Peer, 0, max)
+
+	for i := 0; len(result) < max; i++ {
+		for _, name := range names {
+			if i < len(domains[name]) && len(result) < max {
+				result = append(result, domains[name][i])
+			}
+		}
+	}
+
+	return result
+}
+
+// Return updates to piggyback onto an outgoing message
+func (d *Detector) piggyback() []UpdateEvent {
+	updates, retransmits := d.broadcasts.get(
+		d.Tuning().MaxPiggybackUpdates, d.retransmitLimit())
+
+	d.Metrics.Add(MetricBroadcastRetransmits, float64(retransmits))
+
+	return updates
+}
+
+// Return number of times an update is retransmitted
+func (d *Detector) retransmitLimit() int {
+	n := len(d.members.peers(MemberStateAlive, MemberStateSuspect)) + 1
+
+	return d.Tuning().RetransmitMult *
+		int(math.Ceil(math.Log10(float64(n+1))))
+}
+
+// Return ping timeout scaled by local health
+func (d *Detector) pingTimeout() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.tune.PingTimeout * time.Duration(d.healthScore+1)
+}
+
+// Change local health score by delta keeping it within bounds
+func (d *Detector) adjustHealth(delta int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.healthScore += delta
+
+	if d.healthScore < 0 {
+		d.healthScore = 0
+	}
+
+	if d.healthScore > d.tune.MaxHealthScore {
+		d.healthScore = d.tune.MaxHealthScore
+	}
+}
+
+func (d *Detector) updateGauges() {
+	for state, count := range d.members.counts() {
+		d.Metrics.Set(MetricMembers, float64(count), state.String())
+	}
+
+	d.Metrics.Set(MetricBroadcastQueueDepth, float64(d.broadcasts.len()))
+	d.Metrics.Set(MetricTombstones, float64(len(
+		d.members.inStates(MemberStateDead, MemberStateLeft))))
 }
@@ -0,0 +1,291 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// Returned when starting a detector which was started before
+	ErrAlreadyStarted = errors.New("detector is already started")
+	// Returned when the detector is stopping and can't start new work
+	ErrStopping = errors.New("detector is stopping")
+)
+
+// Readiness of the local node as a cluster member
+type Readiness int
+
+const (
+	// Detector is not started or no member has confirmed it's alive yet
+	ReadinessStarting Readiness = 1
+	// At least one other member is confirmed alive
+	ReadinessJoined Readiness = 2
+	// Node joined before but lost all members, is partitioned,
+	// or its own probes are failing
+	ReadinessDegraded Readiness = 3
+	// Node has left the cluster
+	ReadinessLeaving Readiness = 4
+	// Detector is stopped or stopping
+	ReadinessStopped Readiness = 5
+)
+
+var readinessNames = map[Readiness]string{
+	ReadinessStarting: "starting",
+	ReadinessJoined:   "joined",
+	ReadinessDegraded: "degraded",
+	ReadinessLeaving:  "leaving",
+	ReadinessStopped:  "stopped",
+}
+
+func (r Readiness) String() string {
+	if name, ok := readinessNames[r]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+func (r Readiness) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Readiness) UnmarshalText(text []byte) error {
+	for readiness, name := range readinessNames {
+		if strings.EqualFold(name, string(text)) {
+			*r = readiness
+
+			return nil
+		}
+	}
+
+	return errors.Errorf("invalid readiness: %s", text)
+}
+
+// Several errors which happened while stopping
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, 0, len(e))
+
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Return nil if there are no errors, the only error if there's one
+// and the whole list otherwise
+func (e MultiError) errorOrNil() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	default:
+		return e
+	}
+}
+
+// Start the transport and the detector goroutines. Context only bounds transport startup,
+// use Stop or cancel the context of the parameters to stop.
+func (d *Detector) Start(ctx context.Context) error {
+	d.lifeMu.Lock()
+
+	if d.started {
+		d.lifeMu.Unlock()
+
+		return errors.WithStack(ErrAlreadyStarted)
+	}
+
+	d.started = true
+	d.lifeMu.Unlock()
+
+	if err := d.Transport.Start(ctx); err != nil {
+		d.cancel()
+		go d.finish()
+
+		return errors.Wrap(err, "error starting transport")
+	}
+
+	d.spawn(d.run)
+
+	// Process incoming requests
+	d.spawn(d.processIncoming)
+
+	if d.UserEventHandler != nil {
+		d.spawn(d.deliverUserEvents)
+	}
+
+	if d.snapshot != nil && len(d.rejoinPeers) > 0 {
+		d.spawn(d.rejoin)
+	}
+
+	if d.ReconnectInterval > 0 {
+		d.spawn(d.reconnect)
+	}
+
+	go d.finish()
+
+	return nil
+}
+
+// Stop the detector and its transport, waiting for all goroutines
+// to exit until context is done. Transport is shut down first so
+// requests in progress are still answered. Can be called several times
+// and before Start, in which case the detector can't be started anymore.
+func (d *Detector) Stop(ctx context.Context) error {
+	d.lifeMu.Lock()
+
+	stopped := d.stopped
+	d.stopped = true
+
+	if !d.started {
+		d.started = true
+
+		go d.finish()
+	}
+
+	d.lifeMu.Unlock()
+
+	var errs MultiError
+
+	if !stopped {
+		if err := d.Transport.Shutdown(ctx); err != nil {
+			errs = append(errs, errors.Wrap(err, "error shutting down transport"))
+		}
+	}
+
+	d.cancel()
+
+	select {
+	case <-d.done:
+		if d.stopErr != nil {
+			errs = append(errs, d.stopErr)
+		}
+	case <-ctx.Done():
+		errs = append(errs,
+			errors.Wrap(ctx.Err(), "waiting for detector to stop"))
+	}
+
+	return errs.errorOrNil()
+}
+
+// Channel closed once the detector is stopped and all its goroutines exited
+func (d *Detector) Done() <-chan struct{} {
+	return d.done
+}
+
+// Wait for detector goroutines and release the resources
+func (d *Detector) finish() {
+	<-d.Ctx.Done()
+
+	// Nothing may be spawned once waiting begins
+	d.lifeMu.Lock()
+	d.draining = true
+
+	for timer := range d.timers {
+		timer.Stop()
+	}
+
+	d.timers = nil
+	d.lifeMu.Unlock()
+
+	d.inflight.Wait()
+
+	d.lifeMu.Lock()
+	stopped := d.stopped
+	d.stopped = true
+	d.lifeMu.Unlock()
+
+	var errs MultiError
+
+	// Context of the parameters was canceled without calling Stop,
+	// transport bounds the shutdown by itself
+	if !stopped {
+		if err := d.Transport.Shutdown(context.Background()); err != nil {
+			errs = append(errs, errors.Wrap(err, "error shutting down transport"))
+		}
+	}
+
+	d.closeQueries()
+
+	if d.snapshot != nil {
+		if err := d.snapshot.close(); err != nil {
+			errs = append(errs, errors.Wrap(err, "error closing snapshot"))
+		}
+	}
+
+	d.stopErr = errs.errorOrNil()
+
+	if d.WaitGroup != nil {
+		d.WaitGroup.Done()
+	}
+
+	close(d.done)
+}
+
+// Return current readiness of the local node
+func (d *Detector) Readiness() Readiness {
+	d.lifeMu.Lock()
+	started := d.started
+	d.lifeMu.Unlock()
+
+	switch {
+	case d.Ctx.Err() != nil:
+		return ReadinessStopped
+	case d.isLeaving():
+		return ReadinessLeaving
+	case !started:
+		return ReadinessStarting
+	}
+
+	alive := 0
+
+	for _, m := range d.members.inStates(MemberStateAlive, MemberStateSuspect) {
+		if m.Confirmed() {
+			alive++
+		}
+	}
+
+	switch {
+	case alive == 0 && atomic.LoadInt32(&d.joined) == 0:
+		return ReadinessStarting
+	case alive == 0 || d.Partitioned() || d.HealthScore() > 0:
+		return ReadinessDegraded
+	default:
+		return ReadinessJoined
+	}
+}
+
+// Remember that some member confirmed being alive
+func (d *Detector) markJoined() {
+	atomic.StoreInt32(&d.joined, 1)
+}
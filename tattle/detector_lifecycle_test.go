@@ -0,0 +1,298 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestDetectorStartTwice(t *testing.T) {
+	d := newTestDetector(t, testDetectorParams(newFakeTransport(nil),
+		fakePeer("local"), fakePeer("seed")))
+
+	if r := d.Readiness(); r != ReadinessStarting {
+		t.Errorf("readiness before start is %s", r)
+	}
+
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %+v", err)
+	}
+
+	if err := d.Start(context.Background()); errors.Cause(err) != ErrAlreadyStarted {
+		t.Errorf("second start returned %v", err)
+	}
+
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %+v", err)
+	}
+
+	if r := d.Readiness(); r != ReadinessStopped {
+		t.Errorf("readiness after stop is %s", r)
+	}
+
+	if err := d.Stop(context.Background()); err != nil {
+		t.Errorf("second stop: %+v", err)
+	}
+}
+
+func TestDetectorStopWaitsForQueries(t *testing.T) {
+	tests := []struct {
+		name string
+		// Stop context timeout, zero waits until the handler returns
+		timeout time.Duration
+		failed  bool
+	}{
+		{name: "handler finishes"},
+		{name: "stop times out", timeout: 50 * time.Millisecond, failed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			started := make(chan struct{})
+			release := make(chan struct{})
+
+			var finished int32
+
+			params := testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), fakePeer("seed"))
+			params.QueryHandler = func(q Query) ([]byte, error) {
+				close(started)
+				<-release
+				atomic.StoreInt32(&finished, 1)
+
+				return nil, nil
+			}
+
+			d := newTestDetector(t, params)
+
+			if err := d.Start(context.Background()); err != nil {
+				t.Fatalf("start: %+v", err)
+			}
+
+			resp, err := d.Query("slow", nil, QueryOptions{Timeout: time.Hour})
+
+			if err != nil {
+				t.Fatalf("query: %+v", err)
+			}
+
+			<-started
+
+			ctx := context.Background()
+
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+
+			stopped := make(chan error, 1)
+
+			go func() {
+				stopped <- d.Stop(ctx)
+			}()
+
+			select {
+			case <-d.Done():
+				t.Fatal("done before the query handler returned")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			if test.failed {
+				if err := <-stopped; err == nil {
+					t.Error("stop succeeded with handler running")
+				}
+			}
+
+			close(release)
+
+			select {
+			case <-d.Done():
+			case <-time.After(time.Second):
+				t.Fatal("detector didn't stop")
+			}
+
+			if atomic.LoadInt32(&finished) == 0 {
+				t.Error("done before the query handler returned")
+			}
+
+			if !test.failed {
+				if err := <-stopped; err != nil {
+					t.Errorf("stop: %+v", err)
+				}
+			}
+
+			if !resp.Finished() {
+				t.Error("query is not closed")
+			}
+		})
+	}
+}
+
+func TestDetectorStopReleasesWaiters(t *testing.T) {
+	params := testDetectorParams(newFakeTransport(nil),
+		fakePeer("local"), fakePeer("seed"))
+	// Suspicion timers must not hold the detector either
+	params.PingInterval = time.Hour
+
+	d := newTestDetector(t, params)
+
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %+v", err)
+	}
+
+	d.applyUpdates([]UpdateEvent{
+		{Peer: fakePeer("suspect"), UpdateType: UpdateTypePeerAlive, SeqNum: 1},
+		{Peer: fakePeer("suspect"), UpdateType: UpdateTypePeerSuspicious, SeqNum: 1},
+	})
+
+	events := d.Subscribe(context.Background(), 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("stop: %+v", err)
+	}
+
+	for range events {
+	}
+
+	if d.spawn(func() {}) {
+		t.Error("spawned a goroutine after stop")
+	}
+
+	if timer := d.afterFunc(time.Millisecond, func() {}); timer.Stop() {
+		t.Error("timer started after stop")
+	}
+}
+
+func TestDetectorStopDuringProbe(t *testing.T) {
+	var d *Detector
+
+	transport := newFakeTransport(func(peer Peer, req Request) (Response, error) {
+		if _, ok := req.(RequestDirectPing); ok {
+			// Fail the direct ping once the detector is stopping,
+			// so that indirect pings are attempted while it drains
+			<-d.Ctx.Done()
+			time.Sleep(50 * time.Millisecond)
+
+			return Response{}, errors.New("unreachable")
+		}
+
+		return Response{}, nil
+	})
+
+	params := testDetectorParams(transport, fakePeer("local"),
+		fakePeer("a"), fakePeer("b"), fakePeer("c"))
+
+	d = newTestDetector(t, params)
+
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("start: %+v", err)
+	}
+
+	waitFor(t, time.Second, "a probe", func() bool {
+		return len(transport.sentTo(RequestDirectPing{})) > 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("stop: %+v", err)
+	}
+}
+
+func TestReadinessText(t *testing.T) {
+	for readiness := range readinessNames {
+		text, err := readiness.MarshalText()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded Readiness
+
+		if err := decoded.UnmarshalText(text); err != nil || decoded != readiness {
+			t.Errorf("%s decoded as %s: %v", text, decoded, err)
+		}
+	}
+
+	var r Readiness
+
+	if err := r.UnmarshalText([]byte("sleeping")); err == nil {
+		t.Error("decoded unknown readiness")
+	}
+}
+
+func TestNewDetectorValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(p *DetectorParams)
+		wantErr string
+	}{
+		{"defaults", func(p *DetectorParams) {}, ""},
+		{"no peers", func(p *DetectorParams) { p.Peers = nil }, "no peers"},
+		{"no rpc slots", func(p *DetectorParams) { p.MaxConcurrentRpcs = 0 },
+			"max concurrent rpcs"},
+		{"zero ping interval", func(p *DetectorParams) { p.PingInterval = 0 },
+			"ping interval"},
+		{"zero ping timeout", func(p *DetectorParams) { p.PingTimeout = 0 },
+			"ping timeout"},
+		{"zero suspicion multiplier", func(p *DetectorParams) { p.SuspicionMult = 0 },
+			"suspicion multiplier"},
+		{"invalid coordinate", func(p *DetectorParams) { p.Coordinate.GravityRho = 0 },
+			"gravity rho"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), fakePeer("seed"))
+			test.change(&params)
+
+			d, err := NewDetector(params)
+
+			if d != nil {
+				t.Cleanup(func() { _ = d.Stop(context.Background()) })
+			}
+
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %+v", err)
+			case test.wantErr != "" &&
+				(err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("err = %v, want it to mention %s", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,697 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Number of members notified directly when leaving the cluster
+const leaveFanout = 3
+
+// Check if the peer is the local node
+func (d *Detector) isLocal(peer Peer) bool {
+	return d.LocalPeer != nil && peer.PeerId() == d.LocalPeer.PeerId()
+}
+
+// Return id of the local node, empty if it's not known
+func (d *Detector) localId() string {
+	if d.LocalPeer == nil {
+		return ""
+	}
+
+	return d.LocalPeer.PeerId()
+}
+
+// Check if the id is the one of the local node
+func (d *Detector) isLocalId(id string) bool {
+	return d.LocalPeer != nil && id == d.LocalPeer.PeerId()
+}
+
+// Return an alive update about the local node
+func (d *Detector) localUpdate() UpdateEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.leaving {
+		return UpdateEvent{
+			Peer:       d.LocalPeer,
+			UpdateType: UpdateTypePeerLeft,
+			SeqNum:     d.incarnation,
+		}
+	}
+
+	return UpdateEvent{
+		Peer:       d.LocalPeer,
+		UpdateType: UpdateTypePeerAlive,
+		SeqNum:     d.incarnation,
+		Tags:       copyTags(d.Tags),
+	}
+}
+
+// Check if the local node has left the cluster
+func (d *Detector) isLeaving() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.leaving
+}
+
+// Return updates describing full membership state known locally
+func (d *Detector) localState() []UpdateEvent {
+	var state []UpdateEvent
+
+	if d.LocalPeer != nil {
+		state = append(state, d.localUpdate())
+	}
+
+	for _, m := range d.members.list() {
+		// Seeds are only known by address until they answer
+		if m.seed {
+			continue
+		}
+
+		update := UpdateEvent{
+			Peer:   m.Peer,
+			SeqNum: m.Incarnation,
+		}
+
+		switch m.State {
+		case MemberStateAlive:
+			update.UpdateType = UpdateTypePeerAlive
+			update.Tags = copyTags(m.Tags)
+		case MemberStateSuspect:
+			update.UpdateType = UpdateTypePeerSuspicious
+		case MemberStateDead:
+			update.UpdateType = UpdateTypePeerDead
+		case MemberStateLeft:
+			update.UpdateType = UpdateTypePeerLeft
+		}
+
+		state = append(state, update)
+	}
+
+	return state
+}
+
+// Apply updates received from other peers
+func (d *Detector) applyUpdates(updates []UpdateEvent) {
+	for _, update := range updates {
+		if update.Peer == nil {
+			continue
+		}
+
+		if d.isLocal(update.Peer) {
+			d.applyLocalUpdate(update)
+		} else {
+			d.applyUpdate(update)
+		}
+	}
+}
+
+// Refute any rumours about the local node contradicting its own view
+func (d *Detector) applyLocalUpdate(update UpdateEvent) {
+	d.mu.Lock()
+
+	// Rumours matching our own view need no refutation
+	expected := UpdateTypePeerAlive
+
+	if d.leaving {
+		expected = UpdateTypePeerLeft
+	}
+
+	if update.SeqNum < d.incarnation ||
+		(update.UpdateType == expected && update.SeqNum == d.incarnation) {
+		d.mu.Unlock()
+
+		return
+	}
+
+	d.incarnation = update.SeqNum + 1
+	incarnation := d.incarnation
+
+	d.mu.Unlock()
+
+	d.persistIncarnation(incarnation)
+
+	if update.UpdateType != UpdateTypePeerAlive && !d.isLeaving() {
+		// Being suspected is a sign of a local problem
+		d.adjustHealth(1)
+	}
+
+	d.Logger.With(LogFieldIncarnation, incarnation,
+		LogFieldState, update.UpdateType).
+		Warning("refuting update about local node")
+
+	d.broadcasts.queue(d.localUpdate())
+}
+
+// Apply an update about another peer according to incarnation rules
+func (d *Detector) applyUpdate(update UpdateEvent) {
+	id := update.Peer.PeerId()
+
+	d.members.update(func(members map[string]*Member) {
+		m, ok := members[id]
+
+		switch update.UpdateType {
+		case UpdateTypePeerAlive:
+			if !ok {
+				// Seeds configured by address only are replaced
+				// by the named member living at the same address
+				for seedId, seed := range members {
+					if seed.seed && seedId != id &&
+						sameAddress(seed.Peer, update.Peer) {
+						delete(members, seedId)
+					}
+				}
+
+				m = &Member{
+					Peer:        update.Peer,
+					Incarnation: update.SeqNum,
+					Tags:        copyTags(update.Tags),
+				}
+
+				members[id] = m
+
+				d.transition(m, MemberStateAlive, update.SeqNum)
+				d.broadcasts.queue(update)
+
+				return
+			}
+
+			// Seed members accept the first announcement of any incarnation,
+			// so do members whose name is reclaimed by a new node
+			reclaimed := d.reclaimable(m, update.Peer)
+
+			if !reclaimed && (update.SeqNum < m.Incarnation ||
+				(update.SeqNum == m.Incarnation && !m.seed)) {
+				return
+			}
+
+			// Whatever was measured belongs to the previous node
+			if reclaimed {
+				d.Logger.With(LogFieldPeerId, id).
+					Info("name of failed member reclaimed by %s", update.Peer)
+
+				m.Rtt = 0
+				m.Coordinate = nil
+			}
+
+			if m.State == MemberStateSuspect {
+				d.Metrics.Add(MetricSuspicionsRefuted, 1)
+			}
+
+			m.Peer = update.Peer
+			m.Tags = copyTags(update.Tags)
+
+			d.transition(m, MemberStateAlive, update.SeqNum)
+			m.seed = false
+			d.broadcasts.queue(update)
+
+		case UpdateTypePeerSuspicious:
+			if !ok || update.SeqNum < m.Incarnation ||
+				m.State == MemberStateDead || m.State == MemberStateLeft {
+				return
+			}
+
+			if m.State == MemberStateSuspect {
+				if update.SeqNum > m.Incarnation {
+					m.Incarnation = update.SeqNum
+					d.broadcasts.queue(update)
+				}
+
+				return
+			}
+
+			d.startSuspicion(members, m, update.SeqNum)
+
+		case UpdateTypePeerDead:
+			if !ok || update.SeqNum < m.Incarnation ||
+				m.State == MemberStateDead || m.State == MemberStateLeft {
+				return
+			}
+
+			// Deaths gossiped during a partition are only suspicions,
+			// the member is declared dead once the partition heals
+			if d.deathsFrozen() {
+				if m.State == MemberStateAlive {
+					d.startSuspicion(members, m, update.SeqNum)
+				}
+
+				return
+			}
+
+			d.declareDead(m, update.SeqNum)
+
+		case UpdateTypePeerLeft:
+			if !ok || update.SeqNum < m.Incarnation ||
+				m.State == MemberStateLeft {
+				return
+			}
+
+			d.transition(m, MemberStateLeft, update.SeqNum)
+			d.broadcasts.queue(update)
+		}
+	})
+}
+
+// Check if the tombstone of the member may be taken over by a node
+// at another address regardless of incarnation
+func (d *Detector) reclaimable(m *Member, peer Peer) bool {
+	return d.DeadMemberReclaimTime > 0 &&
+		(m.State == MemberStateDead || m.State == MemberStateLeft) &&
+		time.Since(m.StateChange) >= d.DeadMemberReclaimTime &&
+		!sameAddress(m.Peer, peer)
+}
+
+// Remove members which have been dead or left for longer
+// than TombstoneTimeout
+func (d *Detector) reapTombstones() {
+	if d.TombstoneTimeout <= 0 {
+		return
+	}
+
+	var reaped []Member
+
+	d.members.update(func(members map[string]*Member) {
+		for id, m := range members {
+			if (m.State == MemberStateDead || m.State == MemberStateLeft) &&
+				time.Since(m.StateChange) > d.TombstoneTimeout {
+				delete(members, id)
+
+				reaped = append(reaped, m.clone())
+			}
+		}
+	})
+
+	for _, m := range reaped {
+		d.Logger.With(LogFieldPeerId, m.Peer.PeerId()).
+			Debug("reaped tombstone")
+
+		d.events.append(MemberEventReap, m)
+	}
+}
+
+// Suspect a peer which failed a probe round
+func (d *Detector) suspect(peer Peer) {
+	d.members.update(func(members map[string]*Member) {
+		if m, ok := members[peer.PeerId()]; ok && m.State == MemberStateAlive {
+			d.startSuspicion(members, m, m.Incarnation)
+		}
+	})
+
+	d.checkPartition()
+}
+
+// Mark member as suspicious and schedule its death,
+// must be called with member list locked
+func (d *Detector) startSuspicion(
+	members map[string]*Member, m *Member, incarnation uint64) {
+
+	live := 1
+
+	for _, other := range members {
+		if other.State == MemberStateAlive || other.State == MemberStateSuspect {
+			live++
+		}
+	}
+
+	d.Metrics.Add(MetricSuspicionsRaised, 1)
+	d.noteSuspicion(m.Peer.PeerId())
+
+	d.transition(m, MemberStateSuspect, incarnation)
+
+	d.broadcasts.queue(UpdateEvent{
+		Peer:       m.Peer,
+		UpdateType: UpdateTypePeerSuspicious,
+		SeqNum:     incarnation,
+	})
+
+	peer := m.Peer
+
+	d.afterFunc(d.suspicionTimeout(live), func() {
+		d.suspicionExpired(peer, incarnation)
+	})
+}
+
+// Declare a member dead if it didn't refute suspicion in time
+func (d *Detector) suspicionExpired(peer Peer, incarnation uint64) {
+	if d.Ctx.Err() != nil {
+		return
+	}
+
+	// Wait until the partition heals, suspicions gossiped
+	// by others may not have been accounted for yet
+	if d.PartitionFreeze {
+		d.checkPartition()
+	}
+
+	if d.deathsFrozen() {
+		d.afterFunc(d.Tuning().PingInterval, func() {
+			d.suspicionExpired(peer, incarnation)
+		})
+
+		return
+	}
+
+	d.members.update(func(members map[string]*Member) {
+		m, ok := members[peer.PeerId()]
+
+		if ok && m.State == MemberStateSuspect &&
+			m.Incarnation == incarnation {
+			d.declareDead(m, incarnation)
+		}
+	})
+}
+
+// Mark member as dead, must be called with member list locked
+func (d *Detector) declareDead(m *Member, incarnation uint64) {
+	d.Metrics.Add(MetricDeathsDeclared, 1)
+
+	d.transition(m, MemberStateDead, incarnation)
+
+	d.broadcasts.queue(UpdateEvent{
+		Peer:       m.Peer,
+		UpdateType: UpdateTypePeerDead,
+		SeqNum:     incarnation,
+	})
+}
+
+// Change member state and record an event,
+// must be called with member list locked
+func (d *Detector) transition(m *Member, state MemberState, incarnation uint64) {
+	prev := m.State
+
+	m.Incarnation = incarnation
+
+	if state == MemberStateAlive {
+		d.markJoined()
+	}
+
+	if prev == state {
+		// Seeds become known members once they announce themselves
+		if state == MemberStateAlive && m.seed {
+			d.events.append(MemberEventJoin, m.clone())
+		} else if state == MemberStateAlive {
+			d.events.append(MemberEventUpdate, m.clone())
+		}
+
+		if state == MemberStateAlive {
+			d.recordMember(m)
+		}
+
+		return
+	}
+
+	m.State = state
+	m.StateChange = time.Now()
+
+	switch {
+	case state == MemberStateAlive && prev == MemberStateSuspect:
+		d.events.append(MemberEventAlive, m.clone())
+	case state == MemberStateAlive:
+		d.events.append(MemberEventJoin, m.clone())
+	case state == MemberStateSuspect:
+		d.events.append(MemberEventSuspect, m.clone())
+	case state == MemberStateDead:
+		d.events.append(MemberEventFailed, m.clone())
+	case state == MemberStateLeft:
+		d.events.append(MemberEventLeave, m.clone())
+	}
+
+	if state == MemberStateDead || state == MemberStateLeft {
+		d.coord.forget(m.Peer.PeerId())
+	}
+
+	d.recordMember(m)
+
+	d.Logger.With(
+		LogFieldPeerId, m.Peer.PeerId(),
+		LogFieldIncarnation, incarnation,
+		LogFieldState, state).
+		Info("member state changed")
+}
+
+// Return suspicion timeout for a cluster of n live nodes
+func (d *Detector) suspicionTimeout(n int) time.Duration {
+	scale := math.Max(1, math.Log10(float64(n)))
+
+	tune := d.Tuning()
+
+	return time.Duration(float64(tune.SuspicionMult) * scale *
+		float64(tune.PingInterval))
+}
+
+// Join the cluster through the given peers by exchanging full
+// membership state with each of them.
+// Return number of peers which were successfully contacted.
+func (d *Detector) Join(ctx context.Context, peers []Peer) (int, error) {
+	if len(peers) == 0 {
+		return 0, errors.WithStack(ErrNoPeers)
+	}
+
+	if d.isLeaving() {
+		return 0, errors.WithStack(ErrLeft)
+	}
+
+	joined := 0
+
+	var lastErr error
+
+	for _, peer := range peers {
+		if err := d.pushPull(ctx, peer); err != nil {
+			d.Logger.With(LogFieldPeerId, peer.PeerId(), LogFieldError, err).
+				Warning("error joining peer")
+
+			lastErr = err
+
+			continue
+		}
+
+		joined++
+	}
+
+	if joined == 0 {
+		return 0, errors.Wrap(lastErr, "unable to join any of the peers")
+	}
+
+	return joined, nil
+}
+
+// Periodically try to reach a random recently failed member or
+// a seed through push-pull, so that both sides of a healed partition
+// find each other again
+func (d *Detector) reconnect() {
+	ticker := time.NewTicker(d.ReconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if d.isLeaving() {
+			continue
+		}
+
+		candidates := d.reconnectCandidates()
+
+		if len(candidates) == 0 {
+			continue
+		}
+
+		var peer Peer
+
+		d.random(func(rnd *rand.Rand) {
+			peer = candidates[rnd.Intn(len(candidates))]
+		})
+
+		if err := d.pushPull(d.Ctx, peer); err != nil {
+			d.Metrics.Add(MetricReconnectAttempts, 1, "error")
+
+			d.Logger.With(LogFieldPeerId, peer.PeerId(), LogFieldError, err).
+				Debug("reconnect attempt failed")
+
+			continue
+		}
+
+		d.Metrics.Add(MetricReconnectAttempts, 1, "ok")
+
+		d.Logger.With(LogFieldPeerId, peer.PeerId()).
+			Debug("reconnected")
+	}
+}
+
+// Return dead and left members which changed state within
+// ReconnectTimeout and seeds not known as alive members
+func (d *Detector) reconnectCandidates() []Peer {
+	var candidates, alive []Peer
+
+	now := time.Now()
+
+	for _, m := range d.members.list() {
+		switch m.State {
+		case MemberStateDead, MemberStateLeft:
+			if now.Sub(m.StateChange) <= d.ReconnectTimeout {
+				candidates = append(candidates, m.Peer)
+			}
+		default:
+			alive = append(alive, m.Peer)
+		}
+	}
+
+	for _, seed := range d.Peers {
+		if !containsAddress(alive, seed) && !d.isLocal(seed) {
+			candidates = append(candidates, seed)
+		}
+	}
+
+	return candidates
+}
+
+// Leave the cluster gracefully. The local node stops probing others
+// and announces its departure: the announcement is pushed to a few random
+// members right away and keeps spreading by gossip while the node runs.
+// Leaving can't be undone, a new detector must be created to rejoin.
+func (d *Detector) Leave(ctx context.Context) error {
+	if d.LocalPeer == nil {
+		return errors.New("local peer is not set")
+	}
+
+	d.mu.Lock()
+
+	if !d.leaving {
+		d.leaving = true
+		d.incarnation++
+	}
+
+	incarnation := d.incarnation
+
+	d.mu.Unlock()
+
+	if d.snapshot != nil {
+		d.snapshot.localIncarnation(incarnation)
+		d.snapshot.leave()
+	}
+
+	d.Logger.Info("leaving the cluster")
+
+	d.broadcasts.queue(d.localUpdate())
+
+	peers := d.fanoutTargets()
+
+	if len(peers) > leaveFanout {
+		peers = peers[:leaveFanout]
+	}
+
+	errs := make(chan error, len(peers))
+	spawned := 0
+
+	for _, peer := range peers {
+		peer := peer
+
+		if !d.spawn(func() { errs <- d.pushPull(ctx, peer) }) {
+			break
+		}
+
+		spawned++
+	}
+
+	var failed MultiError
+
+	for i := 0; i < spawned; i++ {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	if spawned < len(peers) {
+		return errors.WithStack(ErrStopping)
+	}
+
+	if len(peers) > 0 && len(failed) == len(peers) {
+		return errors.Wrap(failed.errorOrNil(),
+			"unable to notify any member about leaving")
+	}
+
+	return nil
+}
+
+// Force a dead member to leave the cluster, so it's not probed anymore
+// and its name can be reused. Alive and suspect members can't be forced
+// to leave, suspect ones may still refute the suspicion.
+func (d *Detector) ForceLeave(id string) error {
+	var err error
+
+	d.members.update(func(members map[string]*Member) {
+		m, ok := members[id]
+
+		switch {
+		case !ok:
+			err = errors.Wrap(ErrUnknownMember, id)
+		case m.State == MemberStateAlive || m.State == MemberStateSuspect:
+			err = errors.Wrap(ErrMemberAlive, id)
+		case m.State == MemberStateLeft:
+		default:
+			d.transition(m, MemberStateLeft, m.Incarnation)
+
+			d.broadcasts.queue(UpdateEvent{
+				Peer:       m.Peer,
+				UpdateType: UpdateTypePeerLeft,
+				SeqNum:     m.Incarnation,
+			})
+		}
+	})
+
+	return err
+}
+
+// Exchange full membership state with the peer
+func (d *Detector) pushPull(ctx context.Context, peer Peer) error {
+	ctx, span := d.Tracer.Start(ctx, "tattle.push_pull")
+	defer span.End()
+
+	span.SetAttribute(LogFieldPeerId, peer.PeerId())
+
+	resp, err := d.rpc(ctx, peer,
+		RequestPushPull{State: d.localState()}, 0)
+
+	if err != nil {
+		span.RecordError(err)
+
+		return err
+	}
+
+	d.applyUpdates(resp.Updates)
+
+	return nil
+}
@@ -0,0 +1,667 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLeaveNotifiesFanout(t *testing.T) {
+	seeds := []Peer{fakePeer("a"), fakePeer("b"), fakePeer("c"),
+		fakePeer("d"), fakePeer("e")}
+
+	tests := []struct {
+		name    string
+		seeds   []Peer
+		failing int
+		wantErr bool
+	}{
+		{"all reachable", seeds, 0, false},
+		{"some unreachable", seeds, leaveFanout - 1, false},
+		{"all unreachable", seeds, len(seeds), true},
+		{"fewer members than fanout", seeds[:2], 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failing := map[string]bool{}
+
+			for _, p := range seeds[:test.failing] {
+				failing[p.PeerId()] = true
+			}
+
+			tr := newFakeTransport(func(peer Peer, req Request) (Response, error) {
+				if failing[peer.PeerId()] {
+					return Response{}, errors.New("unreachable")
+				}
+
+				return Response{}, nil
+			})
+
+			d := newTestDetector(t, testDetectorParams(tr, fakePeer("local"),
+				test.seeds...))
+
+			err := d.Leave(context.Background())
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			notified := tr.sentTo(RequestPushPull{})
+			want := leaveFanout
+
+			if len(test.seeds) < want {
+				want = len(test.seeds)
+			}
+
+			if len(notified) != want {
+				t.Errorf("notified %v, want %d distinct members", notified, want)
+			}
+
+			sort.Strings(notified)
+
+			for i := 1; i < len(notified); i++ {
+				if notified[i] == notified[i-1] {
+					t.Errorf("%s notified twice", notified[i])
+				}
+			}
+
+			if d.Readiness() != ReadinessLeaving {
+				t.Errorf("readiness = %s after leave", d.Readiness())
+			}
+
+			if _, err := d.Join(context.Background(), seeds); errors.Cause(err) != ErrLeft {
+				t.Errorf("join after leave: %v, want %v", err, ErrLeft)
+			}
+		})
+	}
+}
+
+func TestLeaveWhileStopping(t *testing.T) {
+	tr := newFakeTransport(nil)
+	d := newTestDetector(t, testDetectorParams(tr, fakePeer("local"),
+		fakePeer("a"), fakePeer("b")))
+
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %+v", err)
+	}
+
+	if err := d.Leave(context.Background()); errors.Cause(err) != ErrStopping {
+		t.Errorf("leave: %v, want %v", err, ErrStopping)
+	}
+
+	if notified := tr.sentTo(RequestPushPull{}); len(notified) != 0 {
+		t.Errorf("notified %v while stopping", notified)
+	}
+}
+
+func TestForceLeave(t *testing.T) {
+	tr := newFakeTransport(nil)
+	d := newTestDetector(t, testDetectorParams(tr, fakePeer("local"),
+		fakePeer("alive"), fakePeer("suspect"), fakePeer("dead")))
+
+	d.applyUpdates([]UpdateEvent{
+		{Peer: fakePeer("suspect"), UpdateType: UpdateTypePeerSuspicious, SeqNum: 1},
+		{Peer: fakePeer("dead"), UpdateType: UpdateTypePeerDead, SeqNum: 1},
+	})
+
+	tests := []struct {
+		id        string
+		wantErr   error
+		wantState MemberState
+	}{
+		{"unknown", ErrUnknownMember, 0},
+		{"alive", ErrMemberAlive, MemberStateAlive},
+		// Suspect members may still refute the suspicion
+		{"suspect", ErrMemberAlive, MemberStateSuspect},
+		{"dead", nil, MemberStateLeft},
+		// Forcing a member which left already is a no-op
+		{"dead", nil, MemberStateLeft},
+	}
+
+	for _, test := range tests {
+		err := d.ForceLeave(test.id)
+
+		if errors.Cause(err) != test.wantErr {
+			t.Errorf("force leave %s: error = %v, want %v", test.id, err, test.wantErr)
+		}
+
+		state := MemberState(0)
+
+		for _, m := range d.Members() {
+			if m.Peer.PeerId() == test.id {
+				state = m.State
+			}
+		}
+
+		if state != test.wantState {
+			t.Errorf("%s is %s, want %s", test.id, state, test.wantState)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	tests := []struct {
+		name       string
+		peers      []Peer
+		failing    map[string]bool
+		wantJoined int
+		wantErr    bool
+	}{
+		{"no peers", nil, nil, 0, true},
+		{"all reachable", []Peer{fakePeer("a"), fakePeer("b")}, nil, 2, false},
+		{"one reachable", []Peer{fakePeer("a"), fakePeer("b")},
+			map[string]bool{"a": true}, 1, false},
+		{"none reachable", []Peer{fakePeer("a")},
+			map[string]bool{"a": true}, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := newFakeTransport(func(peer Peer, req Request) (Response, error) {
+				if test.failing[peer.PeerId()] {
+					return Response{}, errors.New("unreachable")
+				}
+
+				// Remote side answers with its own state
+				return Response{Updates: []UpdateEvent{{
+					Peer:       peer,
+					UpdateType: UpdateTypePeerAlive,
+					SeqNum:     1,
+				}}}, nil
+			})
+
+			d := newTestDetector(t, testDetectorParams(tr, fakePeer("local"),
+				fakePeer("seed")))
+
+			joined, err := d.Join(context.Background(), test.peers)
+
+			if joined != test.wantJoined || (err != nil) != test.wantErr {
+				t.Fatalf("join = %d, %v; want %d, error %v",
+					joined, err, test.wantJoined, test.wantErr)
+			}
+
+			for _, p := range test.peers {
+				if test.failing[p.PeerId()] {
+					continue
+				}
+
+				found := false
+
+				for _, m := range d.Members() {
+					if m.Peer.PeerId() == p.PeerId() && m.Confirmed() {
+						found = true
+					}
+				}
+
+				if !found {
+					t.Errorf("%s is not a confirmed member after join", p.PeerId())
+				}
+			}
+		})
+	}
+}
+
+func TestApplyUpdate(t *testing.T) {
+	update := func(updateType UpdateType, seqNum uint64) UpdateEvent {
+		return UpdateEvent{
+			Peer:       fakePeer("a"),
+			UpdateType: updateType,
+			SeqNum:     seqNum,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		updates     []UpdateEvent
+		state       MemberState
+		incarnation uint64
+	}{
+		{name: "join", updates: []UpdateEvent{update(UpdateTypePeerAlive, 2)},
+			state: MemberStateAlive, incarnation: 2},
+		{name: "stale alive", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerAlive, 1)},
+			state: MemberStateAlive, incarnation: 2},
+		{name: "newer alive", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerAlive, 3)},
+			state: MemberStateAlive, incarnation: 3},
+		{name: "suspect", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerSuspicious, 2)},
+			state: MemberStateSuspect, incarnation: 2},
+		{name: "stale suspect", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerSuspicious, 1)},
+			state: MemberStateAlive, incarnation: 2},
+		{name: "suspicion refuted", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerSuspicious, 2),
+			update(UpdateTypePeerAlive, 3)},
+			state: MemberStateAlive, incarnation: 3},
+		{name: "refutation must be newer", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerSuspicious, 2),
+			update(UpdateTypePeerAlive, 2)},
+			state: MemberStateSuspect, incarnation: 2},
+		{name: "dead", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerDead, 2)},
+			state: MemberStateDead, incarnation: 2},
+		{name: "suspicion of dead ignored", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerDead, 2),
+			update(UpdateTypePeerSuspicious, 3)},
+			state: MemberStateDead, incarnation: 2},
+		{name: "rejoin after death", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerDead, 2),
+			update(UpdateTypePeerAlive, 3)},
+			state: MemberStateAlive, incarnation: 3},
+		{name: "left", updates: []UpdateEvent{
+			update(UpdateTypePeerAlive, 2), update(UpdateTypePeerLeft, 2)},
+			state: MemberStateLeft, incarnation: 2},
+		{name: "unknown suspect ignored",
+			updates: []UpdateEvent{update(UpdateTypePeerSuspicious, 2)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), fakePeer("seed"))
+			// Keep suspicions from expiring during the test
+			params.PingInterval = time.Hour
+
+			d := newTestDetector(t, params)
+
+			d.applyUpdates(test.updates)
+
+			var found *Member
+
+			for _, m := range d.Members() {
+				if m.Peer.PeerId() == "a" {
+					m := m
+					found = &m
+				}
+			}
+
+			switch {
+			case found == nil && test.state != 0:
+				t.Fatal("member is unknown")
+			case found == nil:
+				return
+			case test.state == 0:
+				t.Fatalf("member is known as %s", found.State)
+			}
+
+			if found.State != test.state ||
+				found.Incarnation != test.incarnation {
+				t.Errorf("member is %s/%d, want %s/%d", found.State,
+					found.Incarnation, test.state, test.incarnation)
+			}
+		})
+	}
+}
+
+func TestRefuteLocalRumours(t *testing.T) {
+	tests := []struct {
+		name        string
+		update      UpdateEvent
+		incarnation uint64
+		health      int
+	}{
+		{name: "own view", update: UpdateEvent{
+			UpdateType: UpdateTypePeerAlive, SeqNum: 0}},
+		{name: "suspected", update: UpdateEvent{
+			UpdateType: UpdateTypePeerSuspicious, SeqNum: 0},
+			incarnation: 1, health: 1},
+		{name: "declared dead later", update: UpdateEvent{
+			UpdateType: UpdateTypePeerDead, SeqNum: 5},
+			incarnation: 6, health: 1},
+		{name: "newer alive", update: UpdateEvent{
+			UpdateType: UpdateTypePeerAlive, SeqNum: 3},
+			incarnation: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTestDetector(t, testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), fakePeer("seed")))
+
+			update := test.update
+			update.Peer = fakePeer("local")
+
+			d.applyUpdates([]UpdateEvent{update})
+
+			if inc := d.LocalMember().Incarnation; inc != test.incarnation {
+				t.Errorf("incarnation %d, want %d", inc, test.incarnation)
+			}
+
+			if health := d.HealthScore(); health != test.health {
+				t.Errorf("health score %d, want %d", health, test.health)
+			}
+		})
+	}
+}
+
+func TestSuspicionTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		refute bool
+		state  MemberState
+	}{
+		{name: "expires", state: MemberStateDead},
+		{name: "refuted", refute: true, state: MemberStateAlive},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTestDetector(t, testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), fakePeer("seed")))
+
+			d.applyUpdates([]UpdateEvent{
+				{Peer: fakePeer("a"), UpdateType: UpdateTypePeerAlive, SeqNum: 1},
+				{Peer: fakePeer("a"), UpdateType: UpdateTypePeerSuspicious, SeqNum: 1},
+			})
+
+			if test.refute {
+				d.applyUpdates([]UpdateEvent{
+					{Peer: fakePeer("a"), UpdateType: UpdateTypePeerAlive, SeqNum: 2},
+				})
+			}
+
+			time.Sleep(3 * d.suspicionTimeout(3))
+
+			if state := memberState(d, "a"); state != test.state {
+				t.Errorf("member is %s, want %s", state, test.state)
+			}
+		})
+	}
+}
+
+// Move the member's last state change into the past
+func ageMember(d *Detector, id string, age time.Duration) {
+	d.members.update(func(members map[string]*Member) {
+		if m, ok := members[id]; ok {
+			m.StateChange = time.Now().Add(-age)
+		}
+	})
+}
+
+func TestReconnectCandidates(t *testing.T) {
+	type member struct {
+		id   string
+		typ  UpdateType
+		age  time.Duration
+		seed bool
+	}
+
+	tests := []struct {
+		name    string
+		members []member
+		want    []string
+	}{
+		{
+			name: "alive members and seed",
+			members: []member{
+				{id: "seed", typ: UpdateTypePeerAlive, seed: true},
+				{id: "a", typ: UpdateTypePeerAlive},
+			},
+		},
+		{
+			name: "recently failed and left",
+			members: []member{
+				{id: "seed", typ: UpdateTypePeerAlive, seed: true},
+				{id: "a", typ: UpdateTypePeerDead, age: time.Minute},
+				{id: "b", typ: UpdateTypePeerLeft, age: time.Minute},
+				{id: "c", typ: UpdateTypePeerSuspicious},
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "failed long ago",
+			members: []member{
+				{id: "seed", typ: UpdateTypePeerAlive, seed: true},
+				{id: "a", typ: UpdateTypePeerDead, age: 2 * time.Hour},
+			},
+		},
+		{
+			name: "failed seed",
+			members: []member{
+				{id: "seed", typ: UpdateTypePeerDead, age: 2 * time.Hour, seed: true},
+				{id: "a", typ: UpdateTypePeerAlive},
+			},
+			want: []string{"seed"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var seeds []Peer
+
+			for _, m := range test.members {
+				if m.seed {
+					seeds = append(seeds, fakePeer(m.id))
+				}
+			}
+
+			params := testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), seeds...)
+			params.ReconnectTimeout = time.Hour
+
+			d := newTestDetector(t, params)
+
+			for _, m := range test.members {
+				d.applyUpdates([]UpdateEvent{
+					{Peer: fakePeer(m.id), UpdateType: UpdateTypePeerAlive, SeqNum: 1},
+					{Peer: fakePeer(m.id), UpdateType: m.typ, SeqNum: 1},
+				})
+
+				ageMember(d, m.id, m.age)
+			}
+
+			ids := map[string]bool{}
+
+			for _, p := range d.reconnectCandidates() {
+				ids[p.PeerId()] = true
+			}
+
+			var got []string
+
+			for id := range ids {
+				got = append(got, id)
+			}
+
+			sort.Strings(got)
+
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("candidates = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{name: "reconnected"},
+		{name: "unreachable", err: errors.New("unreachable"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := newFakeTransport(func(peer Peer, req Request) (Response, error) {
+				if _, ok := req.(RequestPushPull); ok {
+					return Response{}, test.err
+				}
+
+				return Response{}, nil
+			})
+
+			metrics := newMetricsRecorder()
+
+			params := testDetectorParams(tr, fakePeer("local"), fakePeer("seed"))
+			params.ReconnectInterval = 20 * time.Millisecond
+			params.Metrics = metrics
+
+			d := newTestDetector(t, params)
+
+			d.applyUpdates([]UpdateEvent{
+				{Peer: fakePeer("a"), UpdateType: UpdateTypePeerAlive, SeqNum: 1},
+				{Peer: fakePeer("a"), UpdateType: UpdateTypePeerDead, SeqNum: 1},
+			})
+
+			if err := d.Start(context.Background()); err != nil && !test.wantErr {
+				t.Fatal(err)
+			}
+
+			result := "ok"
+
+			if test.wantErr {
+				result = "error"
+			}
+
+			waitFor(t, 5*time.Second, "reconnect attempts", func() bool {
+				return metrics.value(MetricReconnectAttempts, result) >= 2
+			})
+
+			// Only the failed member is a candidate, the seed is alive
+			for _, id := range tr.sentTo(RequestPushPull{}) {
+				if id != "a" && id != "seed" {
+					t.Errorf("pushed state to %s", id)
+				}
+			}
+		})
+	}
+}
+
+func TestReapTombstones(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		typ        UpdateType
+		age        time.Duration
+		wantReaped bool
+	}{
+		{"expired dead", time.Hour, UpdateTypePeerDead, 2 * time.Hour, true},
+		{"expired left", time.Hour, UpdateTypePeerLeft, 2 * time.Hour, true},
+		{"recent dead", time.Hour, UpdateTypePeerDead, time.Minute, false},
+		{"alive", time.Hour, UpdateTypePeerAlive, 2 * time.Hour, false},
+		{"suspect", time.Hour, UpdateTypePeerSuspicious, 2 * time.Hour, false},
+		{"disabled", 0, UpdateTypePeerDead, 2 * time.Hour, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), fakePeer("seed"))
+			params.TombstoneTimeout = test.timeout
+
+			d := newTestDetector(t, params)
+
+			d.applyUpdates([]UpdateEvent{
+				{Peer: fakePeer("a"), UpdateType: UpdateTypePeerAlive, SeqNum: 1},
+				{Peer: fakePeer("a"), UpdateType: test.typ, SeqNum: 1},
+			})
+
+			ageMember(d, "a", test.age)
+
+			d.reapTombstones()
+
+			_, known := d.members.get("a")
+
+			if known == test.wantReaped {
+				t.Errorf("member known = %v, want reaped %v", known, test.wantReaped)
+			}
+
+			events, _, _ := d.EventsSince(0)
+			reapEvent := events[len(events)-1].Type == MemberEventReap
+
+			if reapEvent != test.wantReaped {
+				t.Errorf("reap event = %v, want %v", reapEvent, test.wantReaped)
+			}
+		})
+	}
+}
+
+func TestReclaimDeadMemberName(t *testing.T) {
+	moved := HttpPeer{Id: "a", Host: "other.test", Port: 9000, Protocol: "http"}
+
+	tests := []struct {
+		name        string
+		reclaimTime time.Duration
+		typ         UpdateType
+		age         time.Duration
+		peer        HttpPeer
+		wantPeer    HttpPeer
+	}{
+		{"reclaimed", time.Minute, UpdateTypePeerDead, time.Hour, moved, moved},
+		{"left member", time.Minute, UpdateTypePeerLeft, time.Hour, moved, moved},
+		{"too early", time.Minute, UpdateTypePeerDead, time.Second, moved, fakePeer("a")},
+		{"disabled", 0, UpdateTypePeerDead, time.Hour, moved, fakePeer("a")},
+		{"not failed", time.Minute, UpdateTypePeerSuspicious, time.Hour, moved,
+			fakePeer("a")},
+		{"same address", time.Minute, UpdateTypePeerDead, time.Hour, fakePeer("a"),
+			fakePeer("a")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), fakePeer("seed"))
+			params.DeadMemberReclaimTime = test.reclaimTime
+
+			d := newTestDetector(t, params)
+
+			d.applyUpdates([]UpdateEvent{
+				{Peer: fakePeer("a"), UpdateType: UpdateTypePeerAlive, SeqNum: 5},
+				{Peer: fakePeer("a"), UpdateType: test.typ, SeqNum: 5},
+			})
+
+			ageMember(d, "a", test.age)
+
+			// New node restarts incarnations from scratch
+			d.applyUpdates([]UpdateEvent{
+				{Peer: test.peer, UpdateType: UpdateTypePeerAlive, SeqNum: 1},
+			})
+
+			m, _ := d.members.get("a")
+			reclaimed := test.wantPeer == moved
+
+			if m.Peer != Peer(test.wantPeer) {
+				t.Errorf("peer = %v, want %v", m.Peer, test.wantPeer)
+			}
+
+			if (m.State == MemberStateAlive) != reclaimed {
+				t.Errorf("state = %s, want reclaimed %v", m.State, reclaimed)
+			}
+
+			if reclaimed && m.Incarnation != 1 {
+				t.Errorf("incarnation = %d, want 1", m.Incarnation)
+			}
+		})
+	}
+}
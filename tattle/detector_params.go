@@ -29,30 +29,185 @@ import (
 	"math/rand"
 	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// Detector parameters. Probe and dissemination settings are only
+// initial values, use Detector.SetTuning to change them at runtime.
 type DetectorParams struct {
-	Transport         Transport
-	Peers             []Peer
-	PingInterval      time.Duration
-	PingTimeout       time.Duration
-	IndirectPingPeers int
-	Rnd               *rand.Rand
-	Logger            Logger
-	WaitGroup         *sync.WaitGroup
-	Ctx               context.Context
+	Transport Transport
+	// Initial peers to probe
+	Peers []Peer
+	// Peer other members use to reach this node
+	LocalPeer Peer
+	// Tags of this node disseminated to other members
+	Tags         map[string]string
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	// Timeout of a ping-req sent to an indirect ping helper,
+	// should include helper's own PingTimeout
+	IndirectPingTimeout time.Duration
+	IndirectPingPeers   int
+	// Suspicion timeout is SuspicionMult * log10(N) * PingInterval
+	SuspicionMult int
+	// Updates are piggybacked RetransmitMult * log10(N+1) times
+	RetransmitMult int
+	// Maximum number of updates piggybacked onto a single message
+	MaxPiggybackUpdates int
+	// Upper bound of local health score, ping timeouts are scaled
+	// by (score + 1)
+	MaxHealthScore int
+	// Number of most recent membership events kept for subscribers
+	EventLogSize int
+	// Path of membership snapshot file used to rejoin known members
+	// after a restart, snapshots are disabled if empty
+	SnapshotPath string
+	// Maximum total size of user event name and payload
+	UserEventSizeLimit int
+	// Number of Lamport ticks user events are remembered for
+	// deduplication, older events are ignored
+	UserEventBufferSize int
+	// Called for every user event delivered to the local node,
+	// including the ones it fired itself. Calls are made one by one
+	// in order of arrival.
+	UserEventHandler func(UserEvent)
+	// Maximum total size of query name and payload
+	QuerySizeLimit int
+	// Maximum size of a query response payload
+	QueryResponseSizeLimit int
+	// Default query timeout is QueryTimeoutMult * PingInterval * log10(N+1)
+	QueryTimeoutMult int
+	// Called for every query addressed to the local node, returned
+	// payload is sent back to the originator unless it is nil or
+	// error is returned. Calls are made concurrently and share
+	// MaxConcurrentRpcs slots with outbound RPCs.
+	QueryHandler func(Query) ([]byte, error)
+	// Tag naming failure domain of a member, like zone or rack.
+	// If set, indirect ping helpers are chosen from distinct domains
+	// and every domain gets the same share of probes, so members
+	// of larger domains are probed less often.
+	FailureDomainTag string
+	// Probable partition is detected when at least PartitionThreshold
+	// fraction of members, and no less than PartitionMinSuspects,
+	// are suspected within PartitionWindow. Zero threshold disables
+	// partition detection.
+	PartitionThreshold   float64
+	PartitionMinSuspects int
+	PartitionWindow      time.Duration
+	// Don't declare suspected members dead while partitioned
+	PartitionFreeze bool
+	// Partition lasting longer is considered permanent and
+	// death declarations resume, zero means no limit
+	PartitionTimeout time.Duration
+	// Interval of attempts to reach failed members and seeds,
+	// zero disables reconnecting
+	ReconnectInterval time.Duration
+	// Members dead or left for longer aren't reconnected to
+	ReconnectTimeout time.Duration
+	// Dead and left members are kept as tombstones suppressing stale
+	// gossip about them and removed after TombstoneTimeout,
+	// zero keeps them forever
+	TombstoneTimeout time.Duration
+	// Tombstone older than that can be taken over by a node with
+	// the same name at another address regardless of incarnation,
+	// zero only allows it after the tombstone is reaped
+	DeadMemberReclaimTime time.Duration
+	// Maximum number of outbound RPCs in flight, probes are skipped
+	// and indirect probe requests are nacked while all are busy
+	MaxConcurrentRpcs int
+	// Vivaldi network coordinate settings
+	Coordinate CoordinateParams
+	Rnd        *rand.Rand
+	Logger     Logger
+	Metrics    Metrics
+	Tracer     Tracer
+	WaitGroup  *sync.WaitGroup
+	Ctx        context.Context
 }
 
 // Return default detector parameters
 func DefaultDetectorParams() DetectorParams {
 	return DetectorParams{
-		Transport:         nil,
-		Peers:             nil,
-		PingInterval:      3 * time.Second,
-		PingTimeout:       1 * time.Second,
-		IndirectPingPeers: 1,
-		Rnd:               rand.New(rand.NewSource(time.Now().UnixNano())),
-		Logger:            &LoggerPrintf{},
-		Ctx:               context.Background(),
+		Transport:              nil,
+		Peers:                  nil,
+		PingInterval:           3 * time.Second,
+		PingTimeout:            1 * time.Second,
+		IndirectPingTimeout:    2 * time.Second,
+		IndirectPingPeers:      1,
+		SuspicionMult:          4,
+		RetransmitMult:         4,
+		MaxPiggybackUpdates:    16,
+		MaxHealthScore:         8,
+		EventLogSize:           1024,
+		UserEventSizeLimit:     512,
+		UserEventBufferSize:    512,
+		QuerySizeLimit:         1024,
+		QueryResponseSizeLimit: 1024,
+		QueryTimeoutMult:       16,
+		PartitionThreshold:     0.5,
+		PartitionMinSuspects:   3,
+		PartitionWindow:        30 * time.Second,
+		PartitionTimeout:       10 * time.Minute,
+		ReconnectInterval:      30 * time.Second,
+		ReconnectTimeout:       24 * time.Hour,
+		TombstoneTimeout:       24 * time.Hour,
+		MaxConcurrentRpcs:      64,
+		Coordinate:             DefaultCoordinateParams(),
+		Rnd:                    rand.New(rand.NewSource(time.Now().UnixNano())),
+		Logger:                 &LoggerPrintf{},
+		Metrics:                MetricsNoop{},
+		Tracer:                 TracerNoop{},
+		Ctx:                    context.Background(),
+	}
+}
+
+// Detector parameters which can be changed at runtime
+type DetectorTuning struct {
+	PingInterval        time.Duration
+	PingTimeout         time.Duration
+	IndirectPingTimeout time.Duration
+	IndirectPingPeers   int
+	SuspicionMult       int
+	RetransmitMult      int
+	MaxPiggybackUpdates int
+	MaxHealthScore      int
+}
+
+// Return tunable part of the parameters
+func (p DetectorParams) tuning() DetectorTuning {
+	return DetectorTuning{
+		PingInterval:        p.PingInterval,
+		PingTimeout:         p.PingTimeout,
+		IndirectPingTimeout: p.IndirectPingTimeout,
+		IndirectPingPeers:   p.IndirectPingPeers,
+		SuspicionMult:       p.SuspicionMult,
+		RetransmitMult:      p.RetransmitMult,
+		MaxPiggybackUpdates: p.MaxPiggybackUpdates,
+		MaxHealthScore:      p.MaxHealthScore,
 	}
 }
+
+// Check that tuning values are usable
+func (t DetectorTuning) validate() error {
+	switch {
+	case t.PingInterval <= 0:
+		return errors.New("ping interval must be positive")
+	case t.PingTimeout <= 0:
+		return errors.New("ping timeout must be positive")
+	case t.IndirectPingTimeout <= 0:
+		return errors.New("indirect ping timeout must be positive")
+	case t.IndirectPingPeers < 0:
+		return errors.New("indirect ping peers must not be negative")
+	case t.SuspicionMult < 1:
+		return errors.New("suspicion multiplier must be at least 1")
+	case t.RetransmitMult < 1:
+		return errors.New("retransmit multiplier must be at least 1")
+	case t.MaxPiggybackUpdates < 1:
+		return errors.New("max piggyback updates must be at least 1")
+	case t.MaxHealthScore < 0:
+		return errors.New("max health score must not be negative")
+	}
+
+	return nil
+}
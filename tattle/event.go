@@ -0,0 +1,216 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Type of a membership event
+type MemberEventType int
+
+const (
+	// New member appeared or a dead one came back
+	MemberEventJoin MemberEventType = 1
+	// Alive member changed its incarnation or tags
+	MemberEventUpdate MemberEventType = 2
+	// Member became suspected
+	MemberEventSuspect MemberEventType = 3
+	// Suspected member refuted the suspicion
+	MemberEventAlive MemberEventType = 4
+	// Member was declared dead
+	MemberEventFailed MemberEventType = 5
+	// Member left the cluster
+	MemberEventLeave MemberEventType = 6
+	// Large part of the cluster became unreachable at once,
+	// member is the local node
+	MemberEventPartition MemberEventType = 7
+	// Unreachable members are mostly back, member is the local node
+	MemberEventPartitionHealed MemberEventType = 8
+	// Dead or left member was removed after TombstoneTimeout
+	MemberEventReap MemberEventType = 9
+)
+
+var memberEventNames = map[MemberEventType]string{
+	MemberEventJoin:    "member-join",
+	MemberEventUpdate:  "member-update",
+	MemberEventSuspect: "member-suspect",
+	MemberEventAlive:   "member-alive",
+	MemberEventFailed:  "member-failed",
+	MemberEventLeave:   "member-leave",
+
+	MemberEventPartition:       "partition",
+	MemberEventPartitionHealed: "partition-healed",
+	MemberEventReap:            "member-reap",
+}
+
+func (t MemberEventType) String() string {
+	if name, ok := memberEventNames[t]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+func (t MemberEventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *MemberEventType) UnmarshalText(text []byte) error {
+	for typ, name := range memberEventNames {
+		if strings.EqualFold(name, string(text)) {
+			*t = typ
+
+			return nil
+		}
+	}
+
+	return errors.Errorf("invalid member event type: %s", text)
+}
+
+// Change of a member state as seen by the local detector
+type MemberEvent struct {
+	// Position of the event in the detector event log, starts at 1
+	Index  uint64
+	Type   MemberEventType
+	Member Member
+	Time   time.Time
+}
+
+// Bounded in-memory log of membership events
+type eventLog struct {
+	mu     sync.Mutex
+	events []MemberEvent
+	size   int
+	next   uint64
+	notify chan struct{}
+}
+
+func newEventLog(size int) *eventLog {
+	if size < 1 {
+		size = 1
+	}
+
+	return &eventLog{
+		size:   size,
+		next:   1,
+		notify: make(chan struct{}),
+	}
+}
+
+// Append an event assigning it the next index
+func (l *eventLog) append(typ MemberEventType, m Member) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, MemberEvent{
+		Index:  l.next,
+		Type:   typ,
+		Member: m,
+		Time:   time.Now(),
+	})
+
+	l.next++
+
+	if len(l.events) > l.size {
+		l.events = append(l.events[:0:0], l.events[len(l.events)-l.size:]...)
+	}
+
+	// Wake up everyone waiting for new events
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Return events with index greater than the provided one, a flag telling
+// if some of the requested events were already evicted, and a channel
+// which is closed when the next event is appended
+func (l *eventLog) since(index uint64) ([]MemberEvent, bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var events []MemberEvent
+
+	truncated := len(l.events) > 0 && l.events[0].Index > index+1
+
+	for _, ev := range l.events {
+		if ev.Index > index {
+			events = append(events, ev)
+		}
+	}
+
+	return events, truncated, l.notify
+}
+
+// Return events with index greater than the provided one.
+// The flag tells if some of the requested events were already evicted
+// from the log, and the channel is closed once a new event arrives.
+func (d *Detector) EventsSince(index uint64) ([]MemberEvent, bool, <-chan struct{}) {
+	return d.events.since(index)
+}
+
+// Stream events with index greater than the provided one until
+// context is done or the detector stops. Events evicted from the log
+// before being delivered are skipped.
+func (d *Detector) Subscribe(ctx context.Context, index uint64) <-chan MemberEvent {
+	ch := make(chan MemberEvent)
+
+	pump := func() {
+		defer close(ch)
+
+		for {
+			events, _, notify := d.events.since(index)
+
+			for _, ev := range events {
+				select {
+				case ch <- ev:
+					index = ev.Index
+				case <-ctx.Done():
+					return
+				case <-d.Ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return
+			case <-d.Ctx.Done():
+				return
+			}
+		}
+	}
+
+	if !d.spawn(pump) {
+		close(ch)
+	}
+
+	return ch
+}
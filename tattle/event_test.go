@@ -0,0 +1,363 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventLogSince(t *testing.T) {
+	tests := []struct {
+		name          string
+		size          int
+		appended      int
+		index         uint64
+		wantIndexes   []uint64
+		wantTruncated bool
+	}{
+		{"empty log", 4, 0, 0, nil, false},
+		{"from start", 4, 3, 0, []uint64{1, 2, 3}, false},
+		{"resume", 4, 3, 1, []uint64{2, 3}, false},
+		{"up to date", 4, 3, 3, nil, false},
+		{"evicted", 2, 4, 0, []uint64{3, 4}, true},
+		{"resume at first kept", 2, 4, 2, []uint64{3, 4}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newEventLog(test.size)
+
+			for i := 0; i < test.appended; i++ {
+				l.append(MemberEventJoin, Member{})
+			}
+
+			events, truncated, _ := l.since(test.index)
+
+			var indexes []uint64
+
+			for _, ev := range events {
+				indexes = append(indexes, ev.Index)
+			}
+
+			if !equalIndexes(indexes, test.wantIndexes) {
+				t.Errorf("indexes = %v, want %v", indexes, test.wantIndexes)
+			}
+
+			if truncated != test.wantTruncated {
+				t.Errorf("truncated = %v, want %v", truncated, test.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestEventLogNotify(t *testing.T) {
+	l := newEventLog(4)
+
+	_, _, notify := l.since(0)
+
+	select {
+	case <-notify:
+		t.Fatal("notified before append")
+	default:
+	}
+
+	l.append(MemberEventJoin, Member{})
+
+	select {
+	case <-notify:
+	case <-time.After(time.Second):
+		t.Fatal("not notified after append")
+	}
+}
+
+func TestEventIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		query     string
+		wantIndex uint64
+		wantErr   bool
+	}{
+		{"none", "", "", 0, false},
+		{"header", "7", "", 7, false},
+		{"query", "", "index=5", 5, false},
+		{"header wins", "7", "index=5", 7, false},
+		{"invalid", "seven", "", 0, true},
+		{"negative", "", "index=-1", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet,
+				"/v1/admin/events?"+test.query, nil)
+
+			if test.header != "" {
+				req.Header.Set("Last-Event-ID", test.header)
+			}
+
+			index, err := eventIndex(req)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+
+			if index != test.wantIndex {
+				t.Errorf("index = %d, want %d", index, test.wantIndex)
+			}
+		})
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"json", []byte(`{"Index": 1}`), true},
+		{"multiline", []byte("a\n\tb"), true},
+		{"unicode", []byte("ünïcode"), true},
+		{"control", []byte("a\x00b"), false},
+		{"carriage return", []byte("a\rb"), false},
+		{"invalid utf8", []byte{0xff, 0xfe}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isText(test.data); got != test.want {
+				t.Errorf("isText = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAdminWriteEvent(t *testing.T) {
+	ev := MemberEvent{
+		Index:  3,
+		Type:   MemberEventSuspect,
+		Member: Member{Peer: fakePeer("a"), State: MemberStateSuspect},
+	}
+
+	tests := []struct {
+		name   string
+		codec  Codec
+		binary bool
+	}{
+		{"json", NewCodecJson(), false},
+		{"checksum", NewCodecChecksum(NewCodecJson()), true},
+		{"compressed", NewCodecCompress(NewCodecJson(), 1), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewAdminHttp(AdminHttpParams{Codec: test.codec})
+			buf := new(strings.Builder)
+
+			if err := a.writeEvent(buf, ev); err != nil {
+				t.Fatal(err)
+			}
+
+			frame := readSseEvent(bufio.NewScanner(strings.NewReader(buf.String())))
+
+			if frame["id"] != "3" || frame["event"] != "member-suspect" {
+				t.Fatalf("unexpected event frame %q", buf.String())
+			}
+
+			data := []byte(frame["data"])
+
+			if test.binary {
+				var err error
+
+				if data, err = base64.StdEncoding.DecodeString(frame["data"]); err != nil {
+					t.Fatalf("binary payload is not base64: %s", err)
+				}
+			}
+
+			var decoded MemberEvent
+
+			if err := test.codec.DecodeEvent(strings.NewReader(string(data)),
+				&decoded); err != nil {
+
+				t.Fatalf("decode: %+v", err)
+			}
+
+			if decoded.Index != ev.Index || decoded.Member.Peer == nil ||
+				decoded.Member.Peer.PeerId() != "a" {
+
+				t.Errorf("decoded %+v", decoded)
+			}
+		})
+	}
+}
+
+func TestAdminEventsStream(t *testing.T) {
+	tests := []struct {
+		name          string
+		logSize       int
+		resume        func(last uint64) string
+		wantTruncated bool
+	}{
+		{
+			name:    "resume from header",
+			logSize: 16,
+			resume:  func(last uint64) string { return strconv.FormatUint(last, 10) },
+		},
+		{
+			name:          "evicted events",
+			logSize:       1,
+			resume:        func(uint64) string { return "0" },
+			wantTruncated: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), fakePeer("seed"))
+			params.EventLogSize = test.logSize
+			d := newTestDetector(t, params)
+
+			a := NewAdminHttp(DefaultAdminHttpParams())
+			a.Detector = d
+			a.Logger = d.Logger
+
+			srv := httptest.NewServer(a.Handler())
+			defer srv.Close()
+			defer a.Close()
+
+			d.applyUpdates([]UpdateEvent{
+				{Peer: fakePeer("a"), UpdateType: UpdateTypePeerAlive, SeqNum: 1},
+				{Peer: fakePeer("b"), UpdateType: UpdateTypePeerAlive, SeqNum: 1},
+			})
+
+			events, _, _ := d.EventsSince(0)
+			last := events[len(events)-1].Index
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/admin/events", nil)
+			req = req.WithContext(ctx)
+			req.Header.Set("Last-Event-ID", test.resume(last-1))
+
+			resp, err := http.DefaultClient.Do(req)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//noinspection GoUnhandledErrorResult
+			defer resp.Body.Close()
+
+			if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Fatalf("content type = %s", ct)
+			}
+
+			scanner := bufio.NewScanner(resp.Body)
+
+			if test.wantTruncated {
+				frame := readSseEvent(scanner)
+
+				if frame["event"] != "truncated" || frame["data"] != strconv.FormatUint(last, 10) {
+					t.Fatalf("expected truncated event, got %v", frame)
+				}
+			}
+
+			if frame := readSseEvent(scanner); frame["id"] != strconv.FormatUint(last, 10) {
+				t.Fatalf("expected event %d, got %v", last, frame)
+			}
+
+			// Events appended while streaming are delivered
+			d.applyUpdates([]UpdateEvent{
+				{Peer: fakePeer("c"), UpdateType: UpdateTypePeerAlive, SeqNum: 1},
+			})
+
+			frame := readSseEvent(scanner)
+
+			if frame["id"] != strconv.FormatUint(last+1, 10) ||
+				frame["event"] != "member-join" {
+
+				t.Errorf("expected join event %d, got %v", last+1, frame)
+			}
+		})
+	}
+}
+
+func equalIndexes(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Read the next server-sent event skipping comments, returning its fields
+func readSseEvent(scanner *bufio.Scanner) map[string]string {
+	frame := map[string]string{}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			if len(frame) > 0 {
+				return frame
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ": ", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		if prev, ok := frame[parts[0]]; ok && parts[0] == "data" {
+			frame["data"] = prev + "\n" + parts[1]
+		} else {
+			frame[parts[0]] = parts[1]
+		}
+	}
+
+	return frame
+}
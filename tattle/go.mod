@@ -1,11 +1,12 @@
 module github.com/syhpoon/tattle
 
-go 1.12
+go 1.15
 
 require (
-	github.com/gorilla/mux v1.7.3 // indirect
-	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
-	github.com/modern-go/reflect2 v1.0.1 // indirect
-	github.com/pkg/errors v0.8.1 // indirect
-	github.com/prometheus/client_golang v1.1.0 // indirect
+	github.com/gorilla/mux v1.7.3
+	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.1.0
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 )
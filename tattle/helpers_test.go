@@ -0,0 +1,369 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Create an HTTP transport listening on a random local port, it's
+// started either by a detector or with startTestTransport
+func newTestTransport(
+	t *testing.T,
+	configure func(*TransportHttpParams),
+) (*TransportHttp, HttpPeer) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	params := DefaulTransportHttpParams()
+	params.Listener = listener
+	params.Codec = NewCodecJson()
+	params.Logger = NewLoggerPrintf(ioutil.Discard, 0)
+	params.ShutdownTimeout = time.Second
+
+	if configure != nil {
+		configure(&params)
+	}
+
+	tr := NewTransportHttp(params)
+
+	t.Cleanup(func() {
+		_ = tr.Shutdown(context.Background())
+	})
+
+	addr := listener.Addr().(*net.TCPAddr)
+
+	return tr, HttpPeer{
+		Host:     "127.0.0.1",
+		Port:     uint16(addr.Port),
+		Protocol: "http",
+	}
+}
+
+// Start serving requests of a transport created by newTestTransport
+func startTestTransport(t *testing.T, tr *TransportHttp) {
+	t.Helper()
+
+	if err := tr.Start(context.Background()); err != nil {
+		t.Fatalf("start transport: %s", err)
+	}
+}
+
+// Answer incoming requests with the given response until test ends
+func serveTestRequests(
+	t *testing.T,
+	tr *TransportHttp,
+	respond func(IncomingRequest) Response,
+) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case inReq := <-tr.IncomingRequests():
+				inReq.ResponseChan <- respond(inReq)
+			}
+		}
+	}()
+}
+
+// Wait until cond holds, failing the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// RPC sent through fakeTransport
+type fakeCall struct {
+	Peer    Peer
+	Request Request
+}
+
+// Transport which records outbound RPCs and answers them with respond
+type fakeTransport struct {
+	mu      sync.Mutex
+	calls   []fakeCall
+	respond func(peer Peer, req Request) (Response, error)
+	in      chan IncomingRequest
+}
+
+func newFakeTransport(
+	respond func(peer Peer, req Request) (Response, error),
+) *fakeTransport {
+	if respond == nil {
+		respond = func(Peer, Request) (Response, error) {
+			return Response{}, nil
+		}
+	}
+
+	return &fakeTransport{
+		respond: respond,
+		in:      make(chan IncomingRequest),
+	}
+}
+
+func (f *fakeTransport) Start(ctx context.Context) error    { return nil }
+func (f *fakeTransport) Shutdown(ctx context.Context) error { return nil }
+
+func (f *fakeTransport) Rpc(
+	ctx context.Context,
+	peer Peer,
+	req Request,
+	timeout time.Duration,
+) (Response, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeCall{Peer: peer, Request: req})
+	f.mu.Unlock()
+
+	return f.respond(peer, req)
+}
+
+func (f *fakeTransport) IncomingRequests() <-chan IncomingRequest {
+	return f.in
+}
+
+// Return peers the requests of the given type were sent to
+func (f *fakeTransport) sentTo(req Request) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ids []string
+
+	for _, call := range f.calls {
+		if fmt.Sprintf("%T", call.Request) == fmt.Sprintf("%T", req) {
+			ids = append(ids, call.Peer.PeerId())
+		}
+	}
+
+	return ids
+}
+
+// Return a peer with a distinct address, it's never dialed by fakeTransport
+func fakePeer(id string) HttpPeer {
+	return HttpPeer{Id: id, Host: id + ".test", Port: 9000, Protocol: "http"}
+}
+
+// Return detector parameters with short intervals suitable for tests
+func testDetectorParams(
+	transport Transport,
+	local Peer,
+	peers ...Peer,
+) DetectorParams {
+	params := DefaultDetectorParams()
+	params.Transport = transport
+	params.LocalPeer = local
+	params.Peers = peers
+	params.PingInterval = 50 * time.Millisecond
+	params.PingTimeout = 30 * time.Millisecond
+	params.IndirectPingTimeout = 80 * time.Millisecond
+	params.SuspicionMult = 2
+	params.Logger = NewLoggerPrintf(ioutil.Discard, 0)
+
+	return params
+}
+
+// Create a detector, failing the test on error. It's stopped when
+// the test ends unless it's stopped before.
+func newTestDetector(t *testing.T, params DetectorParams) *Detector {
+	t.Helper()
+
+	d, err := NewDetector(params)
+
+	if err != nil {
+		t.Fatalf("new detector: %+v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = d.Stop(context.Background())
+	})
+
+	return d
+}
+
+// Node of a test cluster talking over the HTTP transport
+type testNode struct {
+	*Detector
+	peer      HttpPeer
+	transport *TransportHttp
+}
+
+// Create and start detectors over HTTP, each joining through the
+// first node. Configure is called with node index before creation.
+func newTestCluster(
+	t *testing.T,
+	n int,
+	configure func(i int, params *DetectorParams),
+) []*testNode {
+	t.Helper()
+
+	nodes := make([]*testNode, n)
+
+	for i := range nodes {
+		tr, peer := newTestTransport(t, nil)
+		peer.Id = fmt.Sprintf("node-%d", i)
+
+		nodes[i] = &testNode{peer: peer, transport: tr}
+	}
+
+	for i, node := range nodes {
+		seed := nodes[0].peer
+
+		if i == 0 && n > 1 {
+			seed = nodes[1].peer
+		}
+
+		params := testDetectorParams(node.transport, node.peer, seed)
+
+		if configure != nil {
+			configure(i, &params)
+		}
+
+		node.Detector = newTestDetector(t, params)
+
+		if err := node.Start(context.Background()); err != nil {
+			t.Fatalf("start %s: %+v", node.peer.Id, err)
+		}
+	}
+
+	return nodes
+}
+
+// Return state of a member as seen by the node, zero if unknown
+func (n *testNode) stateOf(id string) MemberState {
+	return memberState(n.Detector, id)
+}
+
+// Return state of a member as seen by the detector, zero if unknown
+func memberState(d *Detector, id string) MemberState {
+	for _, m := range d.Members() {
+		if m.Peer.PeerId() == id {
+			return m.State
+		}
+	}
+
+	return 0
+}
+
+// Wait until every node sees the member in the given state
+func waitState(
+	t *testing.T,
+	nodes []*testNode,
+	id string,
+	state MemberState,
+	timeout time.Duration,
+) {
+	t.Helper()
+
+	waitFor(t, timeout, fmt.Sprintf("%s to be %s", id, state), func() bool {
+		for _, n := range nodes {
+			if n.peer.Id != id && n.stateOf(id) != state {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// Metrics sink remembering the latest value of every series
+type metricsRecorder struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricsRecorder() *metricsRecorder {
+	return &metricsRecorder{values: map[string]float64{}}
+}
+
+func metricKey(name string, labels []string) string {
+	return strings.Join(append([]string{name}, labels...), "|")
+}
+
+func (m *metricsRecorder) Add(name string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[metricKey(name, labels)] += delta
+}
+
+func (m *metricsRecorder) Set(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[metricKey(name, labels)] = value
+}
+
+// Histograms are recorded as number of observations
+func (m *metricsRecorder) Observe(name string, value float64, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Return value of a series
+func (m *metricsRecorder) value(name string, labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.values[metricKey(name, labels)]
+}
+
+// Return sum of all the series of a metric
+func (m *metricsRecorder) total(name string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sum := 0.0
+
+	for key, v := range m.values {
+		if strings.SplitN(key, "|", 2)[0] == name {
+			sum += v
+		}
+	}
+
+	return sum
+}
@@ -24,6 +24,22 @@
 
 package tattle
 
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Well-known structured logging field names
+const (
+	LogFieldPeerId      = "peer_id"
+	LogFieldIncarnation = "incarnation"
+	LogFieldState       = "state"
+	LogFieldRequest     = "request"
+	LogFieldError       = "error"
+)
+
 // Generic logger interface used by tattle library
 type Logger interface {
 	Debug(format string, args ...interface{})
@@ -31,4 +47,74 @@ type Logger interface {
 	Warning(format string, args ...interface{})
 	Error(format string, args ...interface{})
 	Critical(format string, args ...interface{})
+
+	// With should return a child logger which attaches provided
+	// key/value pairs to every message
+	With(keyvals ...interface{}) Logger
+}
+
+// Logging level
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+	LogLevelCritical
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogLevelDebug:    "DEBUG",
+	LogLevelInfo:     "INFO",
+	LogLevelWarning:  "WARN",
+	LogLevelError:    "ERROR",
+	LogLevelCritical: "CRITICAL",
+}
+
+func (l LogLevel) String() string {
+	if name, ok := logLevelNames[l]; ok {
+		return name
+	}
+
+	return "UNKNOWN"
+}
+
+// Parse a level name, case-insensitive
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarning, nil
+	case "error":
+		return LogLevelError, nil
+	case "critical":
+		return LogLevelCritical, nil
+	default:
+		return 0, errors.Errorf("invalid log level: %s", name)
+	}
+}
+
+// Log level which can be changed while loggers using it are running
+type LogLevelVar struct {
+	level int32
+}
+
+// Create a new level variable
+func NewLogLevelVar(level LogLevel) *LogLevelVar {
+	v := &LogLevelVar{}
+	v.Set(level)
+
+	return v
+}
+
+func (v *LogLevelVar) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&v.level))
+}
+
+func (v *LogLevelVar) Set(level LogLevel) {
+	atomic.StoreInt32(&v.level, int32(level))
 }
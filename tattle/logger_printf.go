@@ -25,36 +25,122 @@
 package tattle
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// Simple Printf Logger implementation
+// Simple Printf Logger implementation.
+// Every message is written as a single line with key=value fields appended.
+// Zero value logs everything to stdout.
 type LoggerPrintf struct {
+	// Messages below this level are discarded
+	Level LogLevel
+	// Overrides Level if set, allows changing level at runtime
+	LevelVar *LogLevelVar
+	// Output writer, os.Stdout if nil
+	Output io.Writer
+
+	fields []interface{}
+}
+
+// Create a new printf logger
+func NewLoggerPrintf(output io.Writer, level LogLevel) *LoggerPrintf {
+	return &LoggerPrintf{
+		Level:  level,
+		Output: output,
+	}
 }
 
 func (log *LoggerPrintf) Debug(format string, args ...interface{}) {
-	log.print("DEBUG", format, args...)
+	log.print(LogLevelDebug, format, args...)
 }
 
 func (log *LoggerPrintf) Info(format string, args ...interface{}) {
-	log.print("INFO", format, args...)
+	log.print(LogLevelInfo, format, args...)
 }
 
 func (log *LoggerPrintf) Warning(format string, args ...interface{}) {
-	log.print("WARN", format, args...)
+	log.print(LogLevelWarning, format, args...)
 }
 
 func (log *LoggerPrintf) Error(format string, args ...interface{}) {
-	log.print("ERROR", format, args...)
+	log.print(LogLevelError, format, args...)
 }
 
 func (log *LoggerPrintf) Critical(format string, args ...interface{}) {
-	log.print("CRITICAL", format, args...)
+	log.print(LogLevelCritical, format, args...)
+}
+
+// Return a child logger with additional fields
+func (log *LoggerPrintf) With(keyvals ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(log.fields)+len(keyvals))
+	fields = append(fields, log.fields...)
+	fields = append(fields, keyvals...)
+
+	return &LoggerPrintf{
+		Level:    log.Level,
+		LevelVar: log.LevelVar,
+		Output:   log.Output,
+		fields:   fields,
+	}
+}
+
+func (log *LoggerPrintf) print(level LogLevel, format string, args ...interface{}) {
+	minLevel := log.Level
+
+	if log.LevelVar != nil {
+		minLevel = log.LevelVar.Level()
+	}
+
+	if level < minLevel {
+		return
+	}
+
+	out := log.Output
+
+	if out == nil {
+		out = os.Stdout
+	}
+
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(time.Now().Format(time.RFC3339))
+	buf.WriteString(" [")
+	buf.WriteString(level.String())
+	buf.WriteString("] ")
+	buf.WriteString(strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+
+	for i := 0; i < len(log.fields); i += 2 {
+		var val interface{} = "MISSING"
+
+		if i+1 < len(log.fields) {
+			val = log.fields[i+1]
+		}
+
+		buf.WriteByte(' ')
+		buf.WriteString(logValue(log.fields[i]))
+		buf.WriteByte('=')
+		buf.WriteString(logValue(val))
+	}
+
+	buf.WriteByte('\n')
+
+	// Single write so that concurrent messages are not interleaved
+	_, _ = out.Write(buf.Bytes())
 }
 
-func (log *LoggerPrintf) print(level, format string, args ...interface{}) {
-	ts := time.Now().Format(time.RFC3339)
+// Format a field value, quoting it if necessary
+func logValue(val interface{}) string {
+	str := fmt.Sprint(val)
+
+	if str == "" || strings.ContainsAny(str, " =\"\t\n") {
+		return strconv.Quote(str)
+	}
 
-	fmt.Printf("%s [%s] %s", ts, level, fmt.Sprintf(format, args))
+	return str
 }
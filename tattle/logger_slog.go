@@ -0,0 +1,86 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Slog level used for critical messages
+const SlogLevelCritical = slog.LevelError + 4
+
+// Logger adapter for the standard library structured logger
+type LoggerSlog struct {
+	Logger *slog.Logger
+}
+
+// Create a new slog adapter
+func NewLoggerSlog(logger *slog.Logger) *LoggerSlog {
+	return &LoggerSlog{
+		Logger: logger,
+	}
+}
+
+func (log *LoggerSlog) Debug(format string, args ...interface{}) {
+	log.print(slog.LevelDebug, format, args...)
+}
+
+func (log *LoggerSlog) Info(format string, args ...interface{}) {
+	log.print(slog.LevelInfo, format, args...)
+}
+
+func (log *LoggerSlog) Warning(format string, args ...interface{}) {
+	log.print(slog.LevelWarn, format, args...)
+}
+
+func (log *LoggerSlog) Error(format string, args ...interface{}) {
+	log.print(slog.LevelError, format, args...)
+}
+
+func (log *LoggerSlog) Critical(format string, args ...interface{}) {
+	log.print(SlogLevelCritical, format, args...)
+}
+
+// Return a child logger with additional attributes
+func (log *LoggerSlog) With(keyvals ...interface{}) Logger {
+	return &LoggerSlog{
+		Logger: log.Logger.With(keyvals...),
+	}
+}
+
+func (log *LoggerSlog) print(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+
+	if !log.Logger.Enabled(ctx, level) {
+		return
+	}
+
+	log.Logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
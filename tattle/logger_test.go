@@ -0,0 +1,208 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		level LogLevel
+		fails bool
+	}{
+		{name: "debug", level: LogLevelDebug},
+		{name: "INFO", level: LogLevelInfo},
+		{name: "warn", level: LogLevelWarning},
+		{name: "Warning", level: LogLevelWarning},
+		{name: "error", level: LogLevelError},
+		{name: "critical", level: LogLevelCritical},
+		{name: "verbose", fails: true},
+		{name: "", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			level, err := ParseLogLevel(test.name)
+
+			if (err != nil) != test.fails {
+				t.Fatalf("error %v", err)
+			}
+
+			if !test.fails && level != test.level {
+				t.Errorf("level %s, want %s", level, test.level)
+			}
+		})
+	}
+}
+
+func TestLoggerPrintf(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  LogLevel
+		fields []interface{}
+		log    func(Logger)
+		// Expected line without the timestamp, empty if nothing is logged
+		line string
+	}{
+		{
+			name: "formatted",
+			log:  func(l Logger) { l.Info("hello %s %d", "world", 42) },
+			line: "[INFO] hello world 42",
+		},
+		{
+			name:  "filtered",
+			level: LogLevelWarning,
+			log:   func(l Logger) { l.Info("hidden") },
+		},
+		{
+			name:  "at level",
+			level: LogLevelWarning,
+			log:   func(l Logger) { l.Warning("shown") },
+			line:  "[WARN] shown",
+		},
+		{
+			name:   "fields",
+			fields: []interface{}{LogFieldPeerId, "a", LogFieldIncarnation, 3},
+			log:    func(l Logger) { l.Error("failed") },
+			line:   "[ERROR] failed peer_id=a incarnation=3",
+		},
+		{
+			name:   "quoted fields",
+			fields: []interface{}{"error", "no route", "empty", ""},
+			log:    func(l Logger) { l.Critical("boom") },
+			line:   `[CRITICAL] boom error="no route" empty=""`,
+		},
+		{
+			name:   "missing value",
+			fields: []interface{}{"key"},
+			log:    func(l Logger) { l.Debug("odd") },
+			line:   "[DEBUG] odd key=MISSING",
+		},
+		{
+			name: "trailing newline",
+			log:  func(l Logger) { l.Info("line\n") },
+			line: "[INFO] line",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+
+			var logger Logger = NewLoggerPrintf(buf, test.level)
+
+			if test.fields != nil {
+				logger = logger.With(test.fields...)
+			}
+
+			test.log(logger)
+
+			if test.line == "" {
+				if buf.Len() != 0 {
+					t.Errorf("unexpected output %q", buf.String())
+				}
+
+				return
+			}
+
+			out := buf.String()
+
+			if strings.Count(out, "\n") != 1 || !strings.HasSuffix(out, "\n") {
+				t.Fatalf("expected a single line, got %q", out)
+			}
+
+			// Strip the timestamp
+			if line := out[strings.Index(out, " ")+1 : len(out)-1]; line != test.line {
+				t.Errorf("line %q, want %q", line, test.line)
+			}
+		})
+	}
+}
+
+func TestLoggerPrintfLevelVar(t *testing.T) {
+	buf := new(bytes.Buffer)
+	level := NewLogLevelVar(LogLevelError)
+
+	logger := NewLoggerPrintf(buf, LogLevelDebug)
+	logger.LevelVar = level
+
+	child := logger.With("k", "v")
+
+	child.Info("hidden")
+	level.Set(LogLevelInfo)
+	child.Info("shown")
+
+	if out := buf.String(); strings.Contains(out, "hidden") ||
+		!strings.Contains(out, "shown k=v") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestLoggerSlog(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	handler := slog.NewJSONHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})
+
+	logger := NewLoggerSlog(slog.New(handler)).With(LogFieldPeerId, "a")
+
+	logger.Debug("hidden")
+	logger.Warning("member %s failed", "b")
+	logger.Critical("fatal")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", buf.String())
+	}
+
+	tests := []struct {
+		msg   string
+		level string
+	}{
+		{msg: "member b failed", level: "WARN"},
+		{msg: "fatal", level: "ERROR+4"},
+	}
+
+	for i, test := range tests {
+		var rec map[string]interface{}
+
+		if err := json.Unmarshal([]byte(lines[i]), &rec); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec["msg"] != test.msg || rec["level"] != test.level ||
+			rec[LogFieldPeerId] != "a" {
+			t.Errorf("unexpected record %v", rec)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// State of a cluster member as seen by the local detector
+type MemberState int
+
+const (
+	MemberStateAlive   MemberState = 1
+	MemberStateSuspect MemberState = 2
+	MemberStateDead    MemberState = 3
+	// Member left the cluster gracefully or was forced to leave
+	MemberStateLeft MemberState = 4
+)
+
+var memberStateNames = map[MemberState]string{
+	MemberStateAlive:   "alive",
+	MemberStateSuspect: "suspect",
+	MemberStateDead:    "dead",
+	MemberStateLeft:    "left",
+}
+
+func (s MemberState) String() string {
+	if name, ok := memberStateNames[s]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+func (s MemberState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *MemberState) UnmarshalText(text []byte) error {
+	for state, name := range memberStateNames {
+		if strings.EqualFold(name, string(text)) {
+			*s = state
+
+			return nil
+		}
+	}
+
+	return errors.Errorf("invalid member state: %s", text)
+}
+
+// Cluster member
+type Member struct {
+	Peer        Peer
+	State       MemberState
+	Incarnation uint64
+	Tags        map[string]string
+	// Last time the member was heard from directly
+	LastSeen time.Time
+	// Last time the member changed its state
+	StateChange time.Time
+	// Round-trip time of the last acknowledged direct ping
+	Rtt time.Duration
+	// Last known network coordinate, never modified in place
+	Coordinate *Coordinate
+
+	// Member was added from the initial peer list and
+	// hasn't announced itself yet
+	seed bool
+}
+
+// Check if the member has announced itself, members added
+// from the initial peer list are only known by address until then
+func (m Member) Confirmed() bool {
+	return !m.seed
+}
+
+// Return a deep copy of the member
+func (m *Member) clone() Member {
+	c := *m
+	c.Tags = copyTags(m.Tags)
+
+	return c
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(tags))
+
+	for k, v := range tags {
+		c[k] = v
+	}
+
+	return c
+}
+
+// Thread-safe table of known members keyed by peer id
+type memberList struct {
+	mu      sync.RWMutex
+	members map[string]*Member
+}
+
+func newMemberList() *memberList {
+	return &memberList{
+		members: map[string]*Member{},
+	}
+}
+
+// Run f with exclusive access to the member table
+func (ml *memberList) update(f func(members map[string]*Member)) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	f(ml.members)
+}
+
+// Return a copy of the member with the given id
+func (ml *memberList) get(id string) (Member, bool) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	m, ok := ml.members[id]
+
+	if !ok {
+		return Member{}, false
+	}
+
+	return m.clone(), true
+}
+
+// Return copies of all the members sorted by peer id
+func (ml *memberList) list() []Member {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	members := make([]Member, 0, len(ml.members))
+
+	for _, m := range ml.members {
+		members = append(members, m.clone())
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Peer.PeerId() < members[j].Peer.PeerId()
+	})
+
+	return members
+}
+
+// Return copies of members in one of the given states
+func (ml *memberList) inStates(states ...MemberState) []Member {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	var members []Member
+
+	for _, m := range ml.members {
+		for _, state := range states {
+			if m.State == state {
+				members = append(members, m.clone())
+
+				break
+			}
+		}
+	}
+
+	return members
+}
+
+// Return peers of members in one of the given states
+func (ml *memberList) peers(states ...MemberState) []Peer {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	var peers []Peer
+
+	for _, m := range ml.members {
+		for _, state := range states {
+			if m.State == state {
+				peers = append(peers, m.Peer)
+
+				break
+			}
+		}
+	}
+
+	return peers
+}
+
+// Return number of members per state
+func (ml *memberList) counts() map[MemberState]int {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	counts := map[MemberState]int{}
+
+	for state := range memberStateNames {
+		counts[state] = 0
+	}
+
+	for _, m := range ml.members {
+		counts[m.State]++
+	}
+
+	return counts
+}
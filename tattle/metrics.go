@@ -24,25 +24,229 @@
 
 package tattle
 
-import "github.com/prometheus/client_golang/prometheus"
-
-var (
-	NumberOfInjectTimeouts = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "detector_incoming_request_inject_timeout",
-			Help: "Number of timed-out attempts to inject an incoming request"},
-		[]string{"request_type"})
-
-	NumberOfProcessTimeouts = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "detector_incoming_request_process_timeout",
-			Help: "Number of timed-out attempts to process an incoming request"},
-		[]string{"request_type"})
+// Metric names
+const (
+	MetricInjectTimeouts  = "detector_incoming_request_inject_timeout"
+	MetricProcessTimeouts = "detector_incoming_request_process_timeout"
+	MetricDecodeErrors    = "transport_decode_errors"
+	MetricEncodeErrors    = "transport_encode_errors"
+	MetricBytesIn         = "transport_bytes_in"
+	MetricBytesOut        = "transport_bytes_out"
+
+	MetricProbesSent           = "detector_probes_sent"
+	MetricAcksReceived         = "detector_acks_received"
+	MetricProbeRtt             = "detector_probe_rtt_seconds"
+	MetricIndirectProbes       = "detector_indirect_probes_served"
+	MetricSuspicionsRaised     = "detector_suspicions_raised"
+	MetricSuspicionsRefuted    = "detector_suspicions_refuted"
+	MetricDeathsDeclared       = "detector_deaths_declared"
+	MetricMembers              = "detector_members"
+	MetricBroadcastQueueDepth  = "detector_broadcast_queue_depth"
+	MetricBroadcastRetransmits = "detector_broadcast_retransmits"
+	MetricPartitionsDetected   = "detector_partitions_detected"
+	MetricPartitioned          = "detector_partitioned"
+	MetricReconnectAttempts    = "detector_reconnect_attempts"
+	MetricTombstones           = "detector_tombstones"
+	MetricRpcInflight          = "detector_rpc_inflight"
+	MetricRpcQueued            = "detector_rpc_queued"
+	MetricRpcQueueWait         = "detector_rpc_queue_wait_seconds"
+	MetricRpcRejected          = "detector_rpc_rejected"
+)
+
+// Probe and rpc types used as metric labels
+const (
+	probeTypeDirect   = "direct"
+	probeTypeIndirect = "indirect"
+	// Query acks and handlers rejected for lack of rpc slots
+	rpcTypeQuery = "query"
 )
 
-func init() {
-	prometheus.MustRegister(
-		NumberOfInjectTimeouts,
-		NumberOfProcessTimeouts,
-	)
+type MetricType int
+
+const (
+	MetricTypeCounter   MetricType = 1
+	MetricTypeGauge     MetricType = 2
+	MetricTypeHistogram MetricType = 3
+)
+
+// Description of a metric exported by the library
+type MetricDesc struct {
+	Name   string
+	Help   string
+	Type   MetricType
+	Labels []string
+	// Histogram buckets, default ones are used if empty
+	Buckets []float64
+}
+
+// All the metrics exported by the library
+var MetricDescs = []MetricDesc{
+	{
+		Name:   MetricInjectTimeouts,
+		Help:   "Number of timed-out attempts to inject an incoming request",
+		Type:   MetricTypeCounter,
+		Labels: []string{"request_type"},
+	},
+	{
+		Name:   MetricProcessTimeouts,
+		Help:   "Number of timed-out attempts to process an incoming request",
+		Type:   MetricTypeCounter,
+		Labels: []string{"request_type"},
+	},
+	{
+		Name:   MetricDecodeErrors,
+		Help:   "Number of messages which could not be decoded",
+		Type:   MetricTypeCounter,
+		Labels: []string{"message_type", "reason"},
+	},
+	{
+		Name:   MetricEncodeErrors,
+		Help:   "Number of messages which could not be encoded",
+		Type:   MetricTypeCounter,
+		Labels: []string{"message_type"},
+	},
+	{
+		Name:   MetricBytesIn,
+		Help:   "Number of bytes received",
+		Type:   MetricTypeCounter,
+		Labels: []string{"message_type"},
+	},
+	{
+		Name:   MetricBytesOut,
+		Help:   "Number of bytes sent",
+		Type:   MetricTypeCounter,
+		Labels: []string{"message_type"},
+	},
+	{
+		Name:   MetricProbesSent,
+		Help:   "Number of probes sent to peers",
+		Type:   MetricTypeCounter,
+		Labels: []string{"probe_type"},
+	},
+	{
+		Name:   MetricAcksReceived,
+		Help:   "Number of probes acknowledged by peers",
+		Type:   MetricTypeCounter,
+		Labels: []string{"probe_type"},
+	},
+	{
+		Name:   MetricProbeRtt,
+		Help:   "Round-trip time of acknowledged probes",
+		Type:   MetricTypeHistogram,
+		Labels: []string{"probe_type"},
+		Buckets: []float64{
+			.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	},
+	{
+		Name:   MetricIndirectProbes,
+		Help:   "Number of indirect probes performed on behalf of other peers",
+		Type:   MetricTypeCounter,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricSuspicionsRaised,
+		Help:   "Number of peers marked as suspicious",
+		Type:   MetricTypeCounter,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricSuspicionsRefuted,
+		Help:   "Number of suspicions refuted by suspected peers",
+		Type:   MetricTypeCounter,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricDeathsDeclared,
+		Help:   "Number of peers declared dead",
+		Type:   MetricTypeCounter,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricMembers,
+		Help:   "Number of known members by state",
+		Type:   MetricTypeGauge,
+		Labels: []string{"state"},
+	},
+	{
+		Name:   MetricBroadcastQueueDepth,
+		Help:   "Number of updates waiting to be piggybacked",
+		Type:   MetricTypeGauge,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricBroadcastRetransmits,
+		Help:   "Number of updates piggybacked again after the first send",
+		Type:   MetricTypeCounter,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricPartitionsDetected,
+		Help:   "Number of probable network partitions detected",
+		Type:   MetricTypeCounter,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricPartitioned,
+		Help:   "Whether a network partition is currently detected",
+		Type:   MetricTypeGauge,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricReconnectAttempts,
+		Help:   "Number of attempts to reach failed members and seeds",
+		Type:   MetricTypeCounter,
+		Labels: []string{"result"},
+	},
+	{
+		Name:   MetricTombstones,
+		Help:   "Number of dead and left members waiting to be reaped",
+		Type:   MetricTypeGauge,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricRpcInflight,
+		Help:   "Number of outbound RPCs in flight",
+		Type:   MetricTypeGauge,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricRpcQueued,
+		Help:   "Number of outbound RPCs waiting for a free slot",
+		Type:   MetricTypeGauge,
+		Labels: []string{},
+	},
+	{
+		Name:   MetricRpcQueueWait,
+		Help:   "Time outbound RPCs spent waiting for a free slot",
+		Type:   MetricTypeHistogram,
+		Labels: []string{},
+		Buckets: []float64{
+			0, .001, .005, .01, .05, .1, .5, 1, 5},
+	},
+	{
+		Name:   MetricRpcRejected,
+		Help:   "Number of probes and queries skipped because RPC slots were busy",
+		Type:   MetricTypeCounter,
+		Labels: []string{"probe_type"},
+	},
 }
+
+// Metrics is a sink for the library metrics.
+// Label values are passed in the order defined by the metric description.
+type Metrics interface {
+	// Add should increase a counter by delta
+	Add(name string, delta float64, labels ...string)
+
+	// Set should set a gauge value
+	Set(name string, value float64, labels ...string)
+
+	// Observe should record a value into a histogram
+	Observe(name string, value float64, labels ...string)
+}
+
+// Metrics implementation which discards everything
+type MetricsNoop struct{}
+
+func (m MetricsNoop) Add(name string, delta float64, labels ...string)     {}
+func (m MetricsNoop) Set(name string, value float64, labels ...string)     {}
+func (m MetricsNoop) Observe(name string, value float64, labels ...string) {}
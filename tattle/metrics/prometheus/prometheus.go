@@ -0,0 +1,161 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+// Package prometheus exports detector metrics to Prometheus
+package prometheus
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/syhpoon/tattle"
+)
+
+// Parameters for Metrics instance
+type Params struct {
+	// Registerer to register metrics with,
+	// prometheus.DefaultRegisterer if nil
+	Registerer prometheus.Registerer
+	Namespace  string
+	// Per-instance labels, e.g. cluster name or node id
+	ConstLabels prometheus.Labels
+}
+
+// Prometheus metrics sink
+type Metrics struct {
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+// Create default parameters for Prometheus metrics
+func DefaultParams() Params {
+	return Params{
+		Registerer: prometheus.DefaultRegisterer,
+	}
+}
+
+// Create a new Prometheus metrics sink and register all the metrics.
+// Metrics which are already registered with identical
+// descriptions are shared.
+func New(params Params) (*Metrics, error) {
+	reg := params.Registerer
+
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &Metrics{
+		counters:   map[string]*prometheus.CounterVec{},
+		gauges:     map[string]*prometheus.GaugeVec{},
+		histograms: map[string]*prometheus.HistogramVec{},
+	}
+
+	for _, desc := range tattle.MetricDescs {
+		var col prometheus.Collector
+
+		switch desc.Type {
+		case tattle.MetricTypeCounter:
+			col = prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace:   params.Namespace,
+				Name:        desc.Name,
+				Help:        desc.Help,
+				ConstLabels: params.ConstLabels,
+			}, desc.Labels)
+		case tattle.MetricTypeGauge:
+			col = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace:   params.Namespace,
+				Name:        desc.Name,
+				Help:        desc.Help,
+				ConstLabels: params.ConstLabels,
+			}, desc.Labels)
+		case tattle.MetricTypeHistogram:
+			col = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace:   params.Namespace,
+				Name:        desc.Name,
+				Help:        desc.Help,
+				ConstLabels: params.ConstLabels,
+				Buckets:     desc.Buckets,
+			}, desc.Labels)
+		default:
+			return nil, errors.Errorf(
+				"unexpected type %d of metric %s", desc.Type, desc.Name)
+		}
+
+		if err := reg.Register(col); err != nil {
+			are, ok := err.(prometheus.AlreadyRegisteredError)
+
+			if !ok {
+				return nil, errors.Wrapf(err,
+					"error registering metric %s", desc.Name)
+			}
+
+			col = are.ExistingCollector
+		}
+
+		switch c := col.(type) {
+		case *prometheus.CounterVec:
+			m.counters[desc.Name] = c
+		case *prometheus.GaugeVec:
+			m.gauges[desc.Name] = c
+		case *prometheus.HistogramVec:
+			m.histograms[desc.Name] = c
+		}
+	}
+
+	return m, nil
+}
+
+// Increase a counter
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+	if c, ok := m.counters[name]; ok {
+		c.WithLabelValues(labels...).Add(delta)
+	}
+}
+
+// Set a gauge value
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	if g, ok := m.gauges[name]; ok {
+		g.WithLabelValues(labels...).Set(value)
+	}
+}
+
+// Record an observation
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	if h, ok := m.histograms[name]; ok {
+		h.WithLabelValues(labels...).Observe(value)
+	}
+}
+
+// Return a handler serving metrics of the gatherer,
+// prometheus.DefaultGatherer if nil
+func Handler(gatherer prometheus.Gatherer) http.Handler {
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,164 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/syhpoon/tattle"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	newMetrics := func(node string) *Metrics {
+		m, err := New(Params{
+			Registerer:  reg,
+			Namespace:   "tattle",
+			ConstLabels: prometheus.Labels{"node": node},
+		})
+
+		if err != nil {
+			t.Fatalf("new metrics: %+v", err)
+		}
+
+		return m
+	}
+
+	a, b := newMetrics("a"), newMetrics("b")
+
+	// Identical registrations are shared
+	shared := newMetrics("a")
+
+	a.Add(tattle.MetricProbesSent, 2, "direct")
+	shared.Add(tattle.MetricProbesSent, 1, "direct")
+	b.Add(tattle.MetricProbesSent, 5, "direct")
+	a.Set(tattle.MetricPartitioned, 1)
+	a.Observe(tattle.MetricRpcQueueWait, 0.5)
+	a.Add("unknown_metric", 1)
+
+	tests := []struct {
+		name  string
+		col   prometheus.Collector
+		value float64
+	}{
+		{
+			name:  "counter of a",
+			col:   a.counters[tattle.MetricProbesSent].WithLabelValues("direct"),
+			value: 3,
+		},
+		{
+			name:  "counter of b",
+			col:   b.counters[tattle.MetricProbesSent].WithLabelValues("direct"),
+			value: 5,
+		},
+		{
+			name:  "gauge",
+			col:   a.gauges[tattle.MetricPartitioned].WithLabelValues(),
+			value: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if v := testutil.ToFloat64(test.col); v != test.value {
+				t.Errorf("value %v, want %v", v, test.value)
+			}
+		})
+	}
+
+	families, err := reg.Gather()
+
+	if err != nil {
+		t.Fatalf("gather: %s", err)
+	}
+
+	found := false
+
+	for _, f := range families {
+		if f.GetName() != "tattle_"+tattle.MetricRpcQueueWait {
+			continue
+		}
+
+		found = true
+
+		if len(f.Metric) != 1 ||
+			f.Metric[0].GetHistogram().GetSampleCount() != 1 {
+			t.Errorf("unexpected histogram %v", f)
+		}
+	}
+
+	if !found {
+		t.Error("histogram is not registered")
+	}
+}
+
+func TestNewConflict(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	// Same name with different labels can't be registered
+	reg.MustRegister(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: tattle.MetricProbesSent,
+		Help: "conflicting",
+	}, []string{"other"}))
+
+	if _, err := New(Params{
+		Registerer: reg,
+	}); err == nil {
+		t.Error("expected a registration error")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	m, err := New(Params{Registerer: reg, Namespace: "tattle"})
+
+	if err != nil {
+		t.Fatalf("new metrics: %+v", err)
+	}
+
+	m.Add(tattle.MetricProbesSent, 1, "direct")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	Handler(reg).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	want := `tattle_` + tattle.MetricProbesSent + `{probe_type="direct"} 1`
+
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("body %q doesn't contain %q", rec.Body.String(), want)
+	}
+}
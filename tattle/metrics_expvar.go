@@ -0,0 +1,135 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"expvar"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Expvar metrics sink.
+// Every metric is published as an expvar.Map keyed by labels,
+// histograms are exported as sum and count.
+type MetricsExpvar struct {
+	prefix string
+	labels string
+	vars   map[string]*expvar.Map
+	names  map[string][]string
+	gauges sync.Map
+}
+
+// expvar.Publish panics on duplicates, so published maps are shared
+// between all the instances
+var expvarMu sync.Mutex
+
+// Create a new expvar metrics sink.
+// Every variable name is prefixed with prefix and every key
+// includes provided per-instance labels.
+func NewMetricsExpvar(prefix string, labels map[string]string) *MetricsExpvar {
+	keys := make([]string, 0, len(labels))
+
+	for k := range labels {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+
+	m := &MetricsExpvar{
+		prefix: prefix,
+		labels: strings.Join(pairs, ","),
+		vars:   map[string]*expvar.Map{},
+		names:  map[string][]string{},
+	}
+
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	for _, desc := range MetricDescs {
+		name := prefix + desc.Name
+
+		v, ok := expvar.Get(name).(*expvar.Map)
+
+		if !ok {
+			v = expvar.NewMap(name)
+		}
+
+		m.vars[desc.Name] = v
+		m.names[desc.Name] = desc.Labels
+	}
+
+	return m
+}
+
+// Increase a counter
+func (m *MetricsExpvar) Add(name string, delta float64, labels ...string) {
+	if v, ok := m.vars[name]; ok {
+		v.AddFloat(m.key(name, labels), delta)
+	}
+}
+
+// Set a gauge value
+func (m *MetricsExpvar) Set(name string, value float64, labels ...string) {
+	if v, ok := m.vars[name]; ok {
+		key := m.key(name, labels)
+		f, _ := m.gauges.LoadOrStore(name+"|"+key, new(expvar.Float))
+
+		f.(*expvar.Float).Set(value)
+		v.Set(key, f.(*expvar.Float))
+	}
+}
+
+// Record an observation
+func (m *MetricsExpvar) Observe(name string, value float64, labels ...string) {
+	if v, ok := m.vars[name]; ok {
+		key := m.key(name, labels)
+
+		v.AddFloat(key+":sum", value)
+		v.AddFloat(key+":count", 1)
+	}
+}
+
+func (m *MetricsExpvar) key(name string, labels []string) string {
+	pairs := make([]string, 0, len(labels)+1)
+
+	if m.labels != "" {
+		pairs = append(pairs, m.labels)
+	}
+
+	for i, val := range labels {
+		if i < len(m.names[name]) {
+			pairs = append(pairs, m.names[name][i]+"="+val)
+		}
+	}
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,195 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricDescs(t *testing.T) {
+	seen := map[string]bool{}
+
+	for _, desc := range MetricDescs {
+		if seen[desc.Name] {
+			t.Errorf("metric %s is described twice", desc.Name)
+		}
+
+		seen[desc.Name] = true
+
+		if desc.Help == "" {
+			t.Errorf("metric %s has no help", desc.Name)
+		}
+
+		if desc.Type < MetricTypeCounter || desc.Type > MetricTypeHistogram {
+			t.Errorf("metric %s has unexpected type %d", desc.Name, desc.Type)
+		}
+	}
+}
+
+// Expvar variables are global, every run publishes its own
+var expvarTestRuns int
+
+func TestMetricsExpvar(t *testing.T) {
+	expvarTestRuns++
+	prefix := fmt.Sprintf("test%d_", expvarTestRuns)
+
+	a := NewMetricsExpvar(prefix, map[string]string{"node": "a"})
+	b := NewMetricsExpvar(prefix, map[string]string{"node": "b"})
+
+	a.Add(MetricProbesSent, 2, probeTypeDirect)
+	b.Add(MetricProbesSent, 1, probeTypeIndirect)
+	a.Set(MetricMembers, 3, "alive")
+	a.Set(MetricMembers, 4, "alive")
+	a.Observe(MetricProbeRtt, 0.25, probeTypeDirect)
+	a.Observe(MetricProbeRtt, 0.5, probeTypeDirect)
+
+	tests := []struct {
+		metric string
+		key    string
+		value  string
+	}{
+		{MetricProbesSent, "node=a,probe_type=direct", "2"},
+		{MetricProbesSent, "node=b,probe_type=indirect", "1"},
+		{MetricMembers, "node=a,state=alive", "4"},
+		{MetricProbeRtt, "node=a,probe_type=direct:sum", "0.75"},
+		{MetricProbeRtt, "node=a,probe_type=direct:count", "2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.metric+"/"+test.key, func(t *testing.T) {
+			v, ok := expvar.Get(prefix + test.metric).(*expvar.Map)
+
+			if !ok {
+				t.Fatal("metric is not published")
+			}
+
+			got := v.Get(test.key)
+
+			if got == nil || strings.TrimSpace(got.String()) != test.value {
+				t.Errorf("value %v, want %s", got, test.value)
+			}
+		})
+	}
+}
+
+func TestDetectorProtocolMetrics(t *testing.T) {
+	rec := newMetricsRecorder()
+
+	nodes := newTestCluster(t, 2, func(i int, params *DetectorParams) {
+		if i == 0 {
+			params.Metrics = rec
+			params.Transport.(*TransportHttp).Metrics = rec
+		}
+	})
+
+	waitFor(t, 5*time.Second, "acks", func() bool {
+		return rec.value(MetricAcksReceived, probeTypeDirect) > 0
+	})
+
+	if err := nodes[1].Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %+v", err)
+	}
+
+	waitState(t, nodes[:1], "node-1", MemberStateDead, 5*time.Second)
+
+	tests := []struct {
+		name   string
+		labels []string
+	}{
+		{name: MetricProbesSent, labels: []string{probeTypeDirect}},
+		{name: MetricAcksReceived, labels: []string{probeTypeDirect}},
+		{name: MetricProbeRtt, labels: []string{probeTypeDirect}},
+		{name: MetricSuspicionsRaised},
+		{name: MetricDeathsDeclared},
+		{name: MetricBytesOut},
+		{name: MetricBytesIn},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := rec.total(test.name)
+
+			if test.labels != nil {
+				v = rec.value(test.name, test.labels...)
+			}
+
+			if v <= 0 {
+				t.Errorf("%s is not recorded", test.name)
+			}
+		})
+	}
+
+	waitFor(t, 5*time.Second, "members gauge", func() bool {
+		return rec.value(MetricMembers, MemberStateDead.String()) == 1
+	})
+}
+
+func TestPiggybackRetransmits(t *testing.T) {
+	rec := newMetricsRecorder()
+
+	params := testDetectorParams(newFakeTransport(nil),
+		fakePeer("local"), fakePeer("seed"))
+	params.Metrics = rec
+
+	d := newTestDetector(t, params)
+
+	// Drop the announcement of the local node
+	d.broadcasts = newBroadcastQueue()
+
+	d.broadcasts.queue(UpdateEvent{
+		Peer: fakePeer("a"), UpdateType: UpdateTypePeerAlive, SeqNum: 1})
+	d.broadcasts.queue(UpdateEvent{
+		Peer: fakePeer("b"), UpdateType: UpdateTypePeerAlive, SeqNum: 1})
+
+	tests := []struct {
+		name  string
+		queue string
+		want  float64
+	}{
+		{name: "first send"},
+		{name: "resend", want: 2},
+		{name: "new update", queue: "c", want: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.queue != "" {
+				d.broadcasts.queue(UpdateEvent{Peer: fakePeer(test.queue),
+					UpdateType: UpdateTypePeerAlive, SeqNum: 1})
+			}
+
+			d.piggyback()
+
+			if got := rec.value(MetricBroadcastRetransmits); got != test.want {
+				t.Errorf("retransmits %v, want %v", got, test.want)
+			}
+		})
+	}
+}
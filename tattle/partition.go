@@ -0,0 +1,163 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Tracks recent suspicions to tell a network partition
+// from ordinary member failures
+type partitionTracker struct {
+	mu sync.Mutex
+	// Members suspected recently and when
+	suspected   map[string]time.Time
+	partitioned bool
+	since       time.Time
+}
+
+func newPartitionTracker() *partitionTracker {
+	return &partitionTracker{
+		suspected: map[string]time.Time{},
+	}
+}
+
+// Check if a partition is currently detected
+func (d *Detector) Partitioned() bool {
+	d.partition.mu.Lock()
+	defer d.partition.mu.Unlock()
+
+	return d.partition.partitioned
+}
+
+// Check if death declarations are currently frozen
+func (d *Detector) deathsFrozen() bool {
+	return d.PartitionFreeze && d.Partitioned()
+}
+
+// Remember that the member was suspected
+func (d *Detector) noteSuspicion(id string) {
+	d.partition.mu.Lock()
+	defer d.partition.mu.Unlock()
+
+	if _, ok := d.partition.suspected[id]; !ok {
+		d.partition.suspected[id] = time.Now()
+	}
+}
+
+// Detect a partition if too many members were suspected within
+// the window and heal it once most of them are back
+func (d *Detector) checkPartition() {
+	if d.PartitionThreshold <= 0 {
+		return
+	}
+
+	// Members not refuting suspicions are still unreachable
+	states := map[string]MemberState{}
+	live := 1
+
+	for _, m := range d.members.inStates(
+		MemberStateAlive, MemberStateSuspect, MemberStateDead) {
+		states[m.Peer.PeerId()] = m.State
+
+		if m.State != MemberStateDead {
+			live++
+		}
+	}
+
+	now := time.Now()
+
+	d.partition.mu.Lock()
+
+	p := d.partition
+	unreachable := 0
+
+	for id, at := range p.suspected {
+		state, ok := states[id]
+
+		switch {
+		case !ok || state == MemberStateAlive:
+			delete(p.suspected, id)
+		case !p.partitioned && now.Sub(at) > d.PartitionWindow:
+			delete(p.suspected, id)
+		default:
+			unreachable++
+
+			// Dead members are a part of the cluster we lost
+			if state == MemberStateDead {
+				live++
+			}
+		}
+	}
+
+	threshold := int(math.Ceil(d.PartitionThreshold * float64(live)))
+
+	if threshold < d.PartitionMinSuspects {
+		threshold = d.PartitionMinSuspects
+	}
+
+	var event MemberEventType
+
+	switch {
+	case !p.partitioned && unreachable >= threshold:
+		p.partitioned = true
+		p.since = now
+		event = MemberEventPartition
+
+		d.Metrics.Add(MetricPartitionsDetected, 1)
+
+	// Heal with hysteresis, or give up on a partition
+	// which is not transient after all
+	case p.partitioned && (unreachable < (threshold+1)/2 ||
+		(d.PartitionTimeout > 0 && now.Sub(p.since) > d.PartitionTimeout)):
+		p.partitioned = false
+		p.suspected = map[string]time.Time{}
+		event = MemberEventPartitionHealed
+	}
+
+	partitioned := p.partitioned
+
+	d.partition.mu.Unlock()
+
+	if partitioned {
+		d.Metrics.Set(MetricPartitioned, 1)
+	} else {
+		d.Metrics.Set(MetricPartitioned, 0)
+	}
+
+	switch event {
+	case MemberEventPartition:
+		d.Logger.Warning("probable network partition: %d of %d members "+
+			"became unreachable", unreachable, live)
+
+		d.events.append(event, d.LocalMember())
+	case MemberEventPartitionHealed:
+		d.Logger.Info("network partition healed")
+
+		d.events.append(event, d.LocalMember())
+	}
+}
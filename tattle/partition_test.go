@@ -0,0 +1,138 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Create an unstarted detector knowing n alive members peer-0..peer-n-1
+func newPartitionDetector(t *testing.T, n int, freeze bool) *Detector {
+	t.Helper()
+
+	params := testDetectorParams(newFakeTransport(nil), fakePeer("local"),
+		fakePeer("seed"))
+	// Keep suspicions from expiring during the test
+	params.PingInterval = time.Hour
+	params.PartitionFreeze = freeze
+
+	d := newTestDetector(t, params)
+
+	var updates []UpdateEvent
+
+	for i := 0; i < n; i++ {
+		updates = append(updates, UpdateEvent{
+			Peer:       fakePeer(fmt.Sprintf("peer-%d", i)),
+			UpdateType: UpdateTypePeerAlive,
+			SeqNum:     1,
+		})
+	}
+
+	d.applyUpdates(updates)
+
+	return d
+}
+
+// Gossip updates of the given type about peer-0..peer-n-1
+func gossip(d *Detector, updateType UpdateType, seqNum uint64, n int) {
+	var updates []UpdateEvent
+
+	for i := 0; i < n; i++ {
+		updates = append(updates, UpdateEvent{
+			Peer:       fakePeer(fmt.Sprintf("peer-%d", i)),
+			UpdateType: updateType,
+			SeqNum:     seqNum,
+		})
+	}
+
+	d.applyUpdates(updates)
+}
+
+func TestCheckPartition(t *testing.T) {
+	tests := []struct {
+		name        string
+		suspected   int
+		refuted     int
+		partitioned bool
+	}{
+		{name: "few suspects", suspected: 2},
+		{name: "below threshold", suspected: 5},
+		{name: "threshold reached", suspected: 7, partitioned: true},
+		{name: "partly healed", suspected: 7, refuted: 3, partitioned: true},
+		{name: "healed", suspected: 7, refuted: 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// 10 members, local node and seed make 12 live nodes
+			d := newPartitionDetector(t, 10, false)
+
+			gossip(d, UpdateTypePeerSuspicious, 1, test.suspected)
+			d.checkPartition()
+
+			gossip(d, UpdateTypePeerAlive, 2, test.refuted)
+			d.checkPartition()
+
+			if d.Partitioned() != test.partitioned {
+				t.Errorf("partitioned %v, want %v",
+					d.Partitioned(), test.partitioned)
+			}
+		})
+	}
+}
+
+func TestDeadGossipDuringPartition(t *testing.T) {
+	tests := []struct {
+		name        string
+		freeze      bool
+		partitioned bool
+		state       MemberState
+	}{
+		{name: "no partition", freeze: true, state: MemberStateDead},
+		{name: "freeze disabled", partitioned: true, state: MemberStateDead},
+		{name: "frozen", freeze: true, partitioned: true,
+			state: MemberStateSuspect},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newPartitionDetector(t, 1, test.freeze)
+
+			d.partition.mu.Lock()
+			d.partition.partitioned = test.partitioned
+			d.partition.mu.Unlock()
+
+			gossip(d, UpdateTypePeerDead, 1, 1)
+
+			for _, m := range d.Members() {
+				if m.Peer.PeerId() == "peer-0" && m.State != test.state {
+					t.Errorf("member is %s, want %s", m.State, test.state)
+				}
+			}
+		})
+	}
+}
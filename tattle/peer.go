@@ -24,6 +24,90 @@
 
 package tattle
 
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Member address. Peers may also implement SameAddress(other Peer) bool,
+// otherwise they are at the same address only when they are equal.
 type Peer interface {
 	IsTattlePeer()
+
+	// PeerId should return an identifier unique within the cluster
+	PeerId() string
+}
+
+// Implemented by peers which can tell if the other one has the same
+// address regardless of its id
+type addressComparer interface {
+	SameAddress(other Peer) bool
+}
+
+// Check if both peers have the same address
+func sameAddress(a, b Peer) bool {
+	if c, ok := a.(addressComparer); ok {
+		return c.SameAddress(b)
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// Check if any of the peers has the same address as the given one
+func containsAddress(peers []Peer, peer Peer) bool {
+	for _, p := range peers {
+		if sameAddress(p, peer) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	peerTypesMu sync.RWMutex
+	peerTypes   = map[string]reflect.Type{}
+	peerNames   = map[reflect.Type]string{}
+)
+
+// Register a concrete peer type under a name, so that codecs are able
+// to encode and decode peers stored in interface fields
+func RegisterPeerType(name string, peer Peer) {
+	peerTypesMu.Lock()
+	defer peerTypesMu.Unlock()
+
+	typ := reflect.TypeOf(peer)
+
+	peerTypes[name] = typ
+	peerNames[typ] = name
+}
+
+// Return a registered name of the peer type
+func peerTypeName(peer Peer) (string, error) {
+	peerTypesMu.RLock()
+	defer peerTypesMu.RUnlock()
+
+	name, ok := peerNames[reflect.TypeOf(peer)]
+
+	if !ok {
+		return "", errors.Errorf("unregistered peer type: %T", peer)
+	}
+
+	return name, nil
+}
+
+// Return a pointer to a new zero value of the registered peer type
+func newPeerOfType(name string) (interface{}, error) {
+	peerTypesMu.RLock()
+	defer peerTypesMu.RUnlock()
+
+	typ, ok := peerTypes[name]
+
+	if !ok {
+		return nil, errors.Errorf("unknown peer type: %s", name)
+	}
+
+	return reflect.New(typ).Interface(), nil
 }
@@ -0,0 +1,475 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestProbePeer(t *testing.T) {
+	errUnreachable := errors.New("unreachable")
+
+	tests := []struct {
+		name     string
+		direct   error
+		indirect func(helper string) (Response, error)
+		state    MemberState
+		health   int
+	}{
+		{
+			name:  "direct ack",
+			state: MemberStateAlive,
+		},
+		{
+			name:   "indirect ack",
+			direct: errUnreachable,
+			indirect: func(helper string) (Response, error) {
+				if helper == "h1" {
+					return Response{Nack: true}, nil
+				}
+
+				return Response{}, nil
+			},
+			state: MemberStateAlive,
+		},
+		{
+			name:   "all nacks",
+			direct: errUnreachable,
+			indirect: func(string) (Response, error) {
+				return Response{Nack: true}, nil
+			},
+			state: MemberStateSuspect,
+		},
+		{
+			name:   "helpers unreachable",
+			direct: errUnreachable,
+			indirect: func(string) (Response, error) {
+				return Response{}, errUnreachable
+			},
+			state:  MemberStateSuspect,
+			health: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := newFakeTransport(
+				func(peer Peer, req Request) (Response, error) {
+					if _, ok := req.(RequestIndirectPing); ok {
+						return test.indirect(peer.PeerId())
+					}
+
+					return Response{}, test.direct
+				})
+
+			d := newTestDetector(t, testDetectorParams(transport,
+				fakePeer("local"), fakePeer("target"), fakePeer("h1"),
+				fakePeer("h2")))
+
+			d.probePeer(fakePeer("target"),
+				[]Peer{fakePeer("h1"), fakePeer("h2")})
+
+			if state := memberState(d, "target"); state != test.state {
+				t.Errorf("target is %s, want %s", state, test.state)
+			}
+
+			if health := d.HealthScore(); health != test.health {
+				t.Errorf("health score %d, want %d", health, test.health)
+			}
+
+			if test.direct != nil {
+				if sent := transport.sentTo(RequestIndirectPing{}); len(sent) == 0 {
+					t.Error("no indirect pings sent")
+				}
+			}
+		})
+	}
+}
+
+func TestPingOnBehalf(t *testing.T) {
+	tests := []struct {
+		name   string
+		target Peer
+		err    error
+		nack   bool
+	}{
+		{name: "target answers", target: fakePeer("target")},
+		{name: "target unreachable", target: fakePeer("target"),
+			err: errors.New("unreachable"), nack: true},
+		{name: "no target", nack: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := newFakeTransport(func(Peer, Request) (Response, error) {
+				return Response{}, test.err
+			})
+
+			d := newTestDetector(t, testDetectorParams(transport,
+				fakePeer("local"), fakePeer("seed")))
+
+			ch := make(chan Response, 1)
+
+			d.pingOnBehalf(IncomingRequest{ResponseChan: ch},
+				RequestIndirectPing{TargetPeer: test.target})
+
+			if resp := <-ch; resp.Nack != test.nack {
+				t.Errorf("nack %v, want %v", resp.Nack, test.nack)
+			}
+		})
+	}
+}
+
+// Peer type which is never registered
+type unregisteredPeer struct{}
+
+func (p unregisteredPeer) IsTattlePeer()  {}
+func (p unregisteredPeer) PeerId() string { return "unregistered" }
+
+func TestPeerTypeRegistry(t *testing.T) {
+	codec := NewCodecJson()
+
+	tests := []struct {
+		name  string
+		peer  Peer
+		fails bool
+	}{
+		{name: "http peer", peer: fakePeer("a")},
+		{name: "unregistered peer", peer: unregisteredPeer{}, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+
+			err := codec.EncodeRequest(
+				RequestIndirectPing{TargetPeer: test.peer}, buf)
+
+			if (err != nil) != test.fails {
+				t.Fatalf("encode error %v", err)
+			}
+
+			if test.fails {
+				return
+			}
+
+			var req RequestIndirectPing
+
+			if err := codec.DecodeRequest(buf, &req); err != nil {
+				t.Fatalf("decode: %+v", err)
+			}
+
+			if req.TargetPeer != test.peer {
+				t.Errorf("decoded %#v, want %#v", req.TargetPeer, test.peer)
+			}
+		})
+	}
+
+	// Unknown type names are rejected when decoding
+	var req RequestIndirectPing
+
+	err := codec.DecodeRequest(bytes.NewBufferString(
+		`{"TargetPeer":{"Type":"carrier-pigeon","Peer":{}}}`), &req)
+
+	if err == nil {
+		t.Error("decoded a peer of unknown type")
+	}
+}
+
+func TestSameAddress(t *testing.T) {
+	peer := HttpPeer{Id: "a", Host: "10.0.0.1", Port: 9000, Protocol: "http"}
+
+	moved := peer
+	moved.Port = 9001
+
+	https := peer
+	https.Protocol = "https"
+
+	tests := []struct {
+		name  string
+		a, b  Peer
+		equal bool
+	}{
+		{name: "same peer", a: peer, b: peer, equal: true},
+		{name: "other id", a: peer, b: HttpPeer{Host: "10.0.0.1", Port: 9000,
+			Protocol: "http"}, equal: true},
+		{name: "other port", a: peer, b: moved},
+		{name: "other protocol", a: peer, b: https},
+		{name: "other type", a: peer, b: unregisteredPeer{}},
+		{name: "equal peers without method", a: unregisteredPeer{},
+			b: unregisteredPeer{}, equal: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sameAddress(test.a, test.b); got != test.equal {
+				t.Errorf("same address = %v, want %v", got, test.equal)
+			}
+		})
+	}
+}
+
+// Create a detector in zone "a" knowing alive members tagged
+// with zones given by their id prefix, "x" means no zone
+func newDomainDetector(t *testing.T, helpers int, ids ...string) *Detector {
+	t.Helper()
+
+	params := testDetectorParams(newFakeTransport(nil),
+		fakePeer("local"), fakePeer(ids[0]))
+	params.Tags = map[string]string{"zone": "a"}
+	params.FailureDomainTag = "zone"
+	params.IndirectPingPeers = helpers
+
+	d := newTestDetector(t, params)
+
+	var updates []UpdateEvent
+
+	for _, id := range ids {
+		var tags map[string]string
+
+		if id[0] != 'x' {
+			tags = map[string]string{"zone": id[:1]}
+		}
+
+		updates = append(updates, UpdateEvent{
+			Peer: fakePeer(id), UpdateType: UpdateTypePeerAlive, SeqNum: 1, Tags: tags,
+		})
+	}
+
+	d.applyUpdates(updates)
+
+	return d
+}
+
+// Return zones of the peers, "x" for untagged ones
+func peerZones(peers []Peer) []string {
+	zones := make([]string, len(peers))
+
+	for i, p := range peers {
+		zones[i] = p.PeerId()[:1]
+	}
+
+	return zones
+}
+
+func TestPickHelpers(t *testing.T) {
+	tests := []struct {
+		name    string
+		domains bool
+		helpers int
+		members []string
+		target  string
+		// Expected zones of helpers in any order
+		wantZones []string
+	}{
+		{
+			name:      "without failure domains",
+			helpers:   3,
+			members:   []string{"a1", "a2", "b1", "b2"},
+			target:    "b1",
+			wantZones: []string{"a", "a", "b"},
+		},
+		{
+			name:      "remote domains first",
+			domains:   true,
+			helpers:   2,
+			members:   []string{"a1", "a2", "b1", "b2", "c1", "c2"},
+			target:    "b1",
+			wantZones: []string{"b", "c"},
+		},
+		{
+			name:      "distinct domains",
+			domains:   true,
+			helpers:   3,
+			members:   []string{"a1", "b1", "b2", "b3", "c1", "x1"},
+			target:    "a1",
+			wantZones: []string{"b", "c", "x"},
+		},
+		{
+			name:      "local domain fills up",
+			domains:   true,
+			helpers:   4,
+			members:   []string{"a1", "a2", "b1", "b2", "c1"},
+			target:    "b1",
+			wantZones: []string{"a", "a", "b", "c"},
+		},
+		{
+			name:      "only local domain",
+			domains:   true,
+			helpers:   3,
+			members:   []string{"a1", "a2", "a3"},
+			target:    "a1",
+			wantZones: []string{"a", "a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newDomainDetector(t, test.helpers, test.members...)
+
+			if !test.domains {
+				d.FailureDomainTag = ""
+			}
+
+			for i := 0; i < 20; i++ {
+				helpers := d.pickHelpers(fakePeer(test.target))
+				seen := map[string]bool{}
+
+				for _, h := range helpers {
+					if h.PeerId() == test.target || seen[h.PeerId()] {
+						t.Fatalf("unexpected helpers %v", helpers)
+					}
+
+					seen[h.PeerId()] = true
+				}
+
+				zones := peerZones(helpers)
+				sort.Strings(zones)
+
+				if fmt.Sprint(zones) != fmt.Sprint(test.wantZones) {
+					t.Fatalf("helper zones %v, want %v", zones, test.wantZones)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeTargetsDomains(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []string
+	}{
+		{"single member zone", []string{"a1", "b1", "b2", "b3", "b4", "b5",
+			"b6", "b7", "b8", "b9", "b10"}},
+		{"untagged members", []string{"a1", "a2", "b1", "x1", "x2", "x3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newDomainDetector(t, 3, test.members...)
+
+			domains := map[string]int{}
+
+			for _, id := range test.members {
+				domains[id[:1]]++
+			}
+
+			const rounds = 60
+
+			probes := map[string]int{}
+			members := map[string]int{}
+
+			for i := 0; i < rounds; i++ {
+				targets := d.probeTargets()
+
+				// Every round probes one member of every domain
+				zones := peerZones(targets)
+				sort.Strings(zones)
+
+				if len(zones) != len(domains) {
+					t.Fatalf("round probes zones %v", zones)
+				}
+
+				for _, p := range targets {
+					probes[p.PeerId()[:1]]++
+					members[p.PeerId()]++
+				}
+			}
+
+			for zone := range domains {
+				if probes[zone] != rounds {
+					t.Errorf("zone %s probed %d times, want %d",
+						zone, probes[zone], rounds)
+				}
+			}
+
+			// Members of a domain take turns
+			for _, id := range test.members {
+				size := domains[id[:1]]
+				min, max := rounds/size, (rounds+size-1)/size
+
+				if n := members[id]; n < min || n > max {
+					t.Errorf("%s probed %d times, want %d to %d", id, n, min, max)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeTargetsDomainChanges(t *testing.T) {
+	d := newDomainDetector(t, 3, "a1", "a2", "a3", "b1")
+
+	var probed string
+
+	for _, p := range d.probeTargets() {
+		if p.PeerId()[:1] == "a" {
+			probed = p.PeerId()
+		}
+	}
+
+	// Member still waiting for its turn fails
+	d.members.update(func(members map[string]*Member) {
+		for _, id := range []string{"a1", "a2", "a3"} {
+			if id != probed {
+				d.transition(members[id], MemberStateDead, 1)
+
+				break
+			}
+		}
+	})
+
+	for i := 0; i < 3; i++ {
+		for _, p := range d.probeTargets() {
+			if memberState(d, p.PeerId()) == MemberStateDead {
+				t.Fatalf("dead member %s is probed", p.PeerId())
+			}
+		}
+	}
+}
+
+func TestFanoutTargets(t *testing.T) {
+	d := newDomainDetector(t, 3, "a1", "a2", "a3", "b1", "b2", "c1", "x1")
+
+	for i := 0; i < 20; i++ {
+		targets := d.fanoutTargets()
+
+		if len(targets) != 7 {
+			t.Fatalf("got %d targets, want 7", len(targets))
+		}
+
+		// Every domain comes up once before any comes up again
+		zones := peerZones(targets[:4])
+		sort.Strings(zones)
+
+		if fmt.Sprint(zones) != "[a b c x]" {
+			t.Fatalf("first members come from zones %v", peerZones(targets))
+		}
+	}
+}
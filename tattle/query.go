@@ -0,0 +1,568 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// Returned when query name and payload exceed the size limit
+	ErrQueryTooLarge = errors.New("query is too large")
+)
+
+// Query disseminated through the cluster, matching nodes respond
+// directly to the originator
+type Query struct {
+	// Random id, unique for the originator
+	Id   uint64
+	Name string
+	// Node which collects responses
+	From    Peer
+	Payload []byte `json:",omitempty"`
+	// Only nodes with these ids respond if not empty
+	FilterNodes []string `json:",omitempty"`
+	// Only nodes whose tags match the regexps respond
+	FilterTags map[string]string `json:",omitempty"`
+	// Ask matching nodes to acknowledge the query upon receipt
+	RequestAck bool `json:",omitempty"`
+	// Responses are ignored after this moment, which assumes
+	// reasonably synchronized clocks
+	Deadline time.Time
+}
+
+// Key identifying the query in dedup and broadcast buffers
+func (q Query) key() string {
+	return q.From.PeerId() + "/" + strconv.FormatUint(q.Id, 10)
+}
+
+// Check if the node with the given id and tags is addressed by the query,
+// filters are the compiled FilterTags of the query
+func (q Query) matches(
+	id string,
+	tags map[string]string,
+	filters map[string]*regexp.Regexp,
+) bool {
+	if len(q.FilterNodes) > 0 {
+		found := false
+
+		for _, node := range q.FilterNodes {
+			if node == id {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	for key, re := range filters {
+		val, ok := tags[key]
+
+		if !ok || (re != nil && !re.MatchString(val)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Compile tag filters of a query, expressions must match whole tag values.
+// Empty expressions are compiled to nil.
+func compileTagFilters(
+	filters map[string]string) (map[string]*regexp.Regexp, error) {
+
+	compiled := make(map[string]*regexp.Regexp, len(filters))
+
+	for key, expr := range filters {
+		// Empty expression only requires the tag to be present
+		if expr == "" {
+			compiled[key] = nil
+
+			continue
+		}
+
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid filter for tag %s", key)
+		}
+
+		compiled[key] = re
+	}
+
+	return compiled, nil
+}
+
+// Options of a query
+type QueryOptions struct {
+	// Only nodes with these ids respond if not empty
+	FilterNodes []string
+	// Only nodes whose tags match the regexps respond, nodes missing
+	// a tag never match and an empty regexp only requires the tag
+	FilterTags map[string]string
+	// Ask matching nodes to acknowledge the query upon receipt
+	RequestAck bool
+	// Time to wait for responses, default timeout is
+	// QueryTimeoutMult * PingInterval * ceil(log10(N+1))
+	Timeout time.Duration
+}
+
+// Response of a single node to a query
+type NodeResponse struct {
+	// Id of the responding node
+	From    string
+	Payload []byte
+}
+
+// Sent by a node which received a query directly back to its originator
+type RequestQueryResponse struct {
+	QueryId uint64
+	// Id of the responding node
+	From    string
+	Ack     bool   `json:",omitempty"`
+	Payload []byte `json:",omitempty"`
+}
+
+func (r RequestQueryResponse) IsTattleTransportRequest() {}
+
+// Stream of acks and responses to a query.
+// Both channels are closed once the query deadline passes or
+// the query is closed, so they can be read until exhausted.
+type QueryResponse struct {
+	id       uint64
+	deadline time.Time
+	acks     chan string
+	resps    chan NodeResponse
+	detector *Detector
+
+	mu        sync.Mutex
+	closed    bool
+	timer     *time.Timer
+	seenAcks  map[string]bool
+	seenResps map[string]bool
+}
+
+// Channel of ids of nodes which acknowledged the query
+func (r *QueryResponse) Acks() <-chan string {
+	return r.acks
+}
+
+// Channel of node responses
+func (r *QueryResponse) Responses() <-chan NodeResponse {
+	return r.resps
+}
+
+// Moment after which responses are not accepted
+func (r *QueryResponse) Deadline() time.Time {
+	return r.deadline
+}
+
+// Check if the query no longer accepts responses
+func (r *QueryResponse) Finished() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.closed
+}
+
+// Stop accepting responses
+func (r *QueryResponse) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.closed = true
+	close(r.acks)
+	close(r.resps)
+
+	if r.timer != nil {
+		r.detector.stopTimer(r.timer)
+	}
+
+	r.detector.forgetQuery(r.id)
+}
+
+// Pass an ack or a response to the caller, every node is counted once.
+// Messages which don't fit into channel buffers are dropped.
+func (r *QueryResponse) deliver(resp RequestQueryResponse) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+
+	if resp.Ack {
+		if r.seenAcks[resp.From] {
+			return false
+		}
+
+		r.seenAcks[resp.From] = true
+
+		select {
+		case r.acks <- resp.From:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if r.seenResps[resp.From] {
+		return false
+	}
+
+	r.seenResps[resp.From] = true
+
+	select {
+	case r.resps <- NodeResponse{From: resp.From, Payload: resp.Payload}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Size of query response channels
+const queryResponseBuffer = 1024
+
+// Fire a query and collect responses of matching nodes until
+// the deadline. Name and payload together must fit into QuerySizeLimit.
+// The local node handles the query too if it matches the filters.
+func (d *Detector) Query(
+	name string,
+	payload []byte,
+	opts QueryOptions,
+) (*QueryResponse, error) {
+	if name == "" {
+		return nil, errors.New("query name is empty")
+	}
+
+	if size := len(name) + len(payload); size > d.QuerySizeLimit {
+		return nil, errors.Wrapf(ErrQueryTooLarge,
+			"%d bytes, limit is %d", size, d.QuerySizeLimit)
+	}
+
+	if d.LocalPeer == nil {
+		return nil, errors.New("local peer is not set")
+	}
+
+	if d.isLeaving() {
+		return nil, errors.WithStack(ErrLeft)
+	}
+
+	filters, err := compileTagFilters(opts.FilterTags)
+
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := opts.Timeout
+
+	if timeout <= 0 {
+		timeout = d.queryTimeout()
+	}
+
+	q := Query{
+		Id:          d.randomId(),
+		Name:        name,
+		From:        d.LocalPeer,
+		Payload:     payload,
+		FilterNodes: opts.FilterNodes,
+		FilterTags:  opts.FilterTags,
+		RequestAck:  opts.RequestAck,
+		Deadline:    time.Now().Add(timeout),
+	}
+
+	resp := &QueryResponse{
+		id:        q.Id,
+		deadline:  q.Deadline,
+		acks:      make(chan string, queryResponseBuffer),
+		resps:     make(chan NodeResponse, queryResponseBuffer),
+		detector:  d,
+		seenAcks:  map[string]bool{},
+		seenResps: map[string]bool{},
+	}
+
+	d.queryMu.Lock()
+
+	// Pending queries are closed once the detector stops
+	if d.queries == nil {
+		d.queryMu.Unlock()
+
+		return nil, errors.New("detector is stopped")
+	}
+
+	d.queries[q.Id] = resp
+	d.queryMu.Unlock()
+
+	resp.mu.Lock()
+	resp.timer = d.afterFunc(timeout, resp.Close)
+	resp.mu.Unlock()
+
+	d.receiveQuery(q, filters)
+
+	return resp, nil
+}
+
+// Stop tracking responses to the query
+func (d *Detector) forgetQuery(id uint64) {
+	d.queryMu.Lock()
+	defer d.queryMu.Unlock()
+
+	delete(d.queries, id)
+}
+
+// Close all pending queries, no new queries are accepted afterwards
+func (d *Detector) closeQueries() {
+	d.queryMu.Lock()
+
+	pending := make([]*QueryResponse, 0, len(d.queries))
+
+	for _, resp := range d.queries {
+		pending = append(pending, resp)
+	}
+
+	d.queries = nil
+	d.queryMu.Unlock()
+
+	for _, resp := range pending {
+		resp.Close()
+	}
+}
+
+// Return a random query id
+func (d *Detector) randomId() uint64 {
+	var id uint64
+
+	d.random(func(rnd *rand.Rand) {
+		id = rnd.Uint64()
+	})
+
+	return id
+}
+
+// Return default query timeout
+func (d *Detector) queryTimeout() time.Duration {
+	n := len(d.members.peers(MemberStateAlive, MemberStateSuspect)) + 1
+	scale := math.Ceil(math.Log10(float64(n + 1)))
+
+	return time.Duration(float64(d.QueryTimeoutMult) * scale *
+		float64(d.Tuning().PingInterval))
+}
+
+// Apply queries received from other peers
+func (d *Detector) applyQueries(queries []Query) {
+	for _, q := range queries {
+		if q.From == nil || len(q.Name)+len(q.Payload) > d.QuerySizeLimit {
+			continue
+		}
+
+		d.receiveQuery(q, nil)
+	}
+}
+
+// Handle and rebroadcast a query unless it was seen before or expired.
+// Tag filters of the query are compiled unless provided.
+func (d *Detector) receiveQuery(q Query, filters map[string]*regexp.Regexp) {
+	now := time.Now()
+
+	if now.After(q.Deadline) {
+		return
+	}
+
+	d.queryMu.Lock()
+
+	for key, deadline := range d.seenQueries {
+		if now.After(deadline) {
+			delete(d.seenQueries, key)
+		}
+	}
+
+	_, seen := d.seenQueries[q.key()]
+	d.seenQueries[q.key()] = q.Deadline
+
+	d.queryMu.Unlock()
+
+	if seen {
+		return
+	}
+
+	if filters == nil {
+		var err error
+
+		if filters, err = compileTagFilters(q.FilterTags); err != nil {
+			d.Logger.With(LogFieldPeerId, q.From.PeerId(), LogFieldError, err).
+				Debug("dropping %s query", q.Name)
+
+			return
+		}
+	}
+
+	d.queryBroadcasts.queue(q.key(), q)
+
+	local := d.LocalMember()
+
+	if local.Peer == nil || !q.matches(local.Peer.PeerId(), local.Tags, filters) {
+		return
+	}
+
+	if q.RequestAck {
+		// Acks to the local node are delivered without an rpc
+		if !d.isLocal(q.From) && !d.rpcPool.available() {
+			d.rejectQuery(q, "acknowledging")
+		} else {
+			d.spawn(func() {
+				d.respondQuery(q, RequestQueryResponse{
+					QueryId: q.Id,
+					From:    local.Peer.PeerId(),
+					Ack:     true,
+				})
+			})
+		}
+	}
+
+	if d.QueryHandler == nil {
+		return
+	}
+
+	// Drop rather than pile up goroutines waiting for slots
+	if !d.rpcPool.available() {
+		d.rejectQuery(q, "handling")
+
+		return
+	}
+
+	d.spawn(func() {
+		ctx, cancel := context.WithDeadline(d.Ctx, q.Deadline)
+		defer cancel()
+
+		// Handlers take rpc slots, so that a flood of queries
+		// doesn't run an unbounded number of them at once
+		if err := d.acquireRpc(ctx); err != nil {
+			d.Logger.With(LogFieldError, err).
+				Warning("not handling %s query", q.Name)
+
+			return
+		}
+
+		payload, err := d.QueryHandler(q)
+
+		d.releaseRpc()
+
+		if err != nil {
+			d.Logger.With(LogFieldError, err).
+				Warning("error handling %s query", q.Name)
+
+			return
+		}
+
+		if payload == nil {
+			return
+		}
+
+		if len(payload) > d.QueryResponseSizeLimit {
+			d.Logger.Warning("response to %s query is too large: %d bytes",
+				q.Name, len(payload))
+
+			return
+		}
+
+		d.respondQuery(q, RequestQueryResponse{
+			QueryId: q.Id,
+			From:    local.Peer.PeerId(),
+			Payload: payload,
+		})
+	})
+}
+
+// Count query work dropped because all rpc slots are busy
+func (d *Detector) rejectQuery(q Query, action string) {
+	d.Metrics.Add(MetricRpcRejected, 1, rpcTypeQuery)
+
+	d.Logger.With(LogFieldPeerId, q.From.PeerId()).
+		Debug("all rpc slots are busy, not %s %s query", action, q.Name)
+}
+
+// Send an ack or a response to the query originator
+func (d *Detector) respondQuery(q Query, resp RequestQueryResponse) {
+	if d.isLocal(q.From) {
+		d.deliverQueryResponse(resp)
+
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(d.Ctx, q.Deadline)
+	defer cancel()
+
+	if _, err := d.rpc(ctx, q.From, resp,
+		time.Until(q.Deadline)); err != nil {
+		d.Logger.With(LogFieldPeerId, q.From.PeerId(), LogFieldError, err).
+			Warning("error responding to %s query", q.Name)
+	}
+}
+
+// Pass a response to the pending query it belongs to
+func (d *Detector) deliverQueryResponse(resp RequestQueryResponse) {
+	d.queryMu.Lock()
+	pending, ok := d.queries[resp.QueryId]
+	d.queryMu.Unlock()
+
+	if ok {
+		pending.deliver(resp)
+	}
+}
+
+// Return queries to piggyback onto an outgoing message
+func (d *Detector) piggybackQueries() []Query {
+	msgs := d.queryBroadcasts.get(
+		d.Tuning().MaxPiggybackUpdates, d.retransmitLimit())
+
+	var queries []Query
+
+	now := time.Now()
+
+	for _, msg := range msgs {
+		// No point in spreading expired queries
+		if q := msg.(Query); now.Before(q.Deadline) {
+			queries = append(queries, q)
+		}
+	}
+
+	return queries
+}
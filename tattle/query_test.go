@@ -0,0 +1,272 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryMatches(t *testing.T) {
+	tags := map[string]string{"zone": "us-east-1", "role": "db"}
+
+	tests := []struct {
+		name    string
+		nodes   []string
+		filters map[string]string
+		match   bool
+	}{
+		{name: "no filters", match: true},
+		{name: "node listed", nodes: []string{"a", "local"}, match: true},
+		{name: "node not listed", nodes: []string{"a", "b"}},
+		{name: "tag matches", filters: map[string]string{"zone": "us-.*"},
+			match: true},
+		{name: "partial match", filters: map[string]string{"zone": "east"}},
+		{name: "all tags match",
+			filters: map[string]string{"zone": "us-east-1", "role": "db|cache"},
+			match:   true},
+		{name: "one tag differs",
+			filters: map[string]string{"zone": "us-east-1", "role": "cache"}},
+		{name: "missing tag", filters: map[string]string{"rack": "x?"}},
+		{name: "empty expression", filters: map[string]string{"role": ""},
+			match: true},
+		{name: "empty expression missing tag",
+			filters: map[string]string{"rack": ""}},
+		{name: "node and tag", nodes: []string{"local"},
+			filters: map[string]string{"role": "db"}, match: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters, err := compileTagFilters(test.filters)
+
+			if err != nil {
+				t.Fatalf("compile: %+v", err)
+			}
+
+			q := Query{FilterNodes: test.nodes, FilterTags: test.filters}
+
+			if match := q.matches("local", tags, filters); match != test.match {
+				t.Errorf("match %v, want %v", match, test.match)
+			}
+		})
+	}
+}
+
+func TestQueryValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		payload []byte
+		opts    QueryOptions
+	}{
+		{name: "empty name"},
+		{name: "too large", query: "q", payload: make([]byte, 1<<20)},
+		{name: "invalid filter", query: "q",
+			opts: QueryOptions{FilterTags: map[string]string{"zone": "("}}},
+	}
+
+	params := testDetectorParams(newFakeTransport(nil), fakePeer("local"),
+		fakePeer("seed"))
+	d := newTestDetector(t, params)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := d.Query(test.query, test.payload, test.opts); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestQueryLocalResponse(t *testing.T) {
+	params := testDetectorParams(newFakeTransport(nil), fakePeer("local"),
+		fakePeer("seed"))
+	params.QueryHandler = func(q Query) ([]byte, error) {
+		return append([]byte("re: "), q.Payload...), nil
+	}
+
+	d := newTestDetector(t, params)
+
+	resp, err := d.Query("echo", []byte("hi"), QueryOptions{
+		RequestAck: true,
+		Timeout:    time.Second,
+	})
+
+	if err != nil {
+		t.Fatalf("query: %+v", err)
+	}
+
+	if ack := <-resp.Acks(); ack != "local" {
+		t.Errorf("ack from %q", ack)
+	}
+
+	r := <-resp.Responses()
+
+	if r.From != "local" || string(r.Payload) != "re: hi" {
+		t.Errorf("unexpected response %+v", r)
+	}
+
+	resp.Close()
+
+	d.queryMu.Lock()
+	pending := len(d.queries)
+	d.queryMu.Unlock()
+
+	if pending != 0 {
+		t.Errorf("%d queries still pending after close", pending)
+	}
+
+	if _, ok := <-resp.Responses(); ok {
+		t.Error("responses are not closed")
+	}
+}
+
+func TestQueryHandlerConcurrency(t *testing.T) {
+	release := make(chan struct{})
+
+	var running, peak int32
+
+	metrics := newMetricsRecorder()
+
+	params := testDetectorParams(newFakeTransport(nil), fakePeer("local"),
+		fakePeer("seed"))
+	params.MaxConcurrentRpcs = 2
+	params.Metrics = metrics
+	params.QueryHandler = func(q Query) ([]byte, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		for {
+			p := atomic.LoadInt32(&peak)
+
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		<-release
+
+		return []byte("done"), nil
+	}
+
+	d := newTestDetector(t, params)
+
+	query := func() *QueryResponse {
+		resp, err := d.Query("block", nil, QueryOptions{Timeout: 5 * time.Second})
+
+		if err != nil {
+			t.Fatalf("query: %+v", err)
+		}
+
+		return resp
+	}
+
+	resps := []*QueryResponse{query(), query()}
+
+	waitFor(t, time.Second, "handlers to start", func() bool {
+		return atomic.LoadInt32(&running) == 2
+	})
+
+	// Running handlers hold every slot, so the rest are dropped
+	for i := 0; i < 4; i++ {
+		query()
+	}
+
+	if got := metrics.value(MetricRpcRejected, rpcTypeQuery); got != 4 {
+		t.Errorf("rejected %v queries, want 4", got)
+	}
+
+	close(release)
+
+	for _, resp := range resps {
+		if r := <-resp.Responses(); string(r.Payload) != "done" {
+			t.Errorf("unexpected response %+v", r)
+		}
+	}
+
+	if peak := atomic.LoadInt32(&peak); peak > 2 {
+		t.Errorf("%d handlers ran at once, limit is 2", peak)
+	}
+}
+
+func TestQueryAckRejected(t *testing.T) {
+	metrics := newMetricsRecorder()
+	tr := newFakeTransport(nil)
+
+	params := testDetectorParams(tr, fakePeer("local"), fakePeer("seed"))
+	params.MaxConcurrentRpcs = 1
+	params.Metrics = metrics
+
+	d := newTestDetector(t, params)
+
+	newQuery := func(id uint64) Query {
+		return Query{Id: id, Name: "ack", From: fakePeer("seed"),
+			RequestAck: true, Deadline: time.Now().Add(5 * time.Second)}
+	}
+
+	if err := d.acquireRpc(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	d.applyQueries([]Query{newQuery(1)})
+
+	if got := metrics.value(MetricRpcRejected, rpcTypeQuery); got != 1 {
+		t.Errorf("rejected %v acks, want 1", got)
+	}
+
+	d.releaseRpc()
+	d.applyQueries([]Query{newQuery(2)})
+
+	waitFor(t, 5*time.Second, "ack", func() bool {
+		return len(tr.sentTo(RequestQueryResponse{})) == 1
+	})
+}
+
+func TestQueryClosedOnStop(t *testing.T) {
+	params := testDetectorParams(newFakeTransport(nil), fakePeer("local"),
+		fakePeer("seed"))
+	d := newTestDetector(t, params)
+
+	resp, err := d.Query("pending", nil, QueryOptions{Timeout: time.Hour})
+
+	if err != nil {
+		t.Fatalf("query: %+v", err)
+	}
+
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %+v", err)
+	}
+
+	if !resp.Finished() {
+		t.Error("query is not closed after stop")
+	}
+
+	if _, err := d.Query("late", nil, QueryOptions{}); err == nil {
+		t.Error("query accepted after stop")
+	}
+}
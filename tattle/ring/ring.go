@@ -0,0 +1,497 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+// Package ring maintains a consistent hash ring of cluster members
+// driven by membership events of a tattle detector.
+package ring
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/syhpoon/tattle"
+)
+
+var (
+	ErrNoMembership = errors.New("membership source is required")
+)
+
+// Source of membership, implemented by *tattle.Detector
+type Membership interface {
+	Members() []tattle.Member
+	LocalMember() tattle.Member
+	Subscribe(ctx context.Context, index uint64) <-chan tattle.MemberEvent
+}
+
+// Ring parameters
+type RingParams struct {
+	Membership Membership
+	// Number of virtual nodes of a member with weight 1
+	VirtualNodes int
+	// Tag holding member weight, a non-negative number.
+	// Members without the tag have weight 1, weight 0 owns nothing.
+	WeightTag string
+	// Weights are gossiped by members, larger ones are lowered to MaxWeight
+	// so that a single member can't make everyone allocate huge rings
+	MaxWeight float64
+	// Members in these states own keys
+	States []tattle.MemberState
+	// Hash function used for keys and virtual nodes
+	Hash func([]byte) uint64
+	// Called with ownership changes after the ring is updated.
+	// Calls are made one by one from Run.
+	Handler   func(Change)
+	Logger    tattle.Logger
+	WaitGroup *sync.WaitGroup
+	Ctx       context.Context
+}
+
+// Return default ring parameters
+func DefaultRingParams() RingParams {
+	return RingParams{
+		VirtualNodes: 128,
+		WeightTag:    "weight",
+		MaxWeight:    100,
+		// Suspected members keep their keys to avoid needless churn
+		States: []tattle.MemberState{
+			tattle.MemberStateAlive,
+			tattle.MemberStateSuspect,
+		},
+		Hash:   defaultHash,
+		Logger: &tattle.LoggerPrintf{},
+		Ctx:    context.Background(),
+	}
+}
+
+// Consistent hash ring. Lookups are safe for concurrent use.
+type Ring struct {
+	RingParams
+
+	mu    sync.RWMutex
+	state *ringState
+}
+
+// Immutable ring snapshot
+type ringState struct {
+	// Sorted virtual node tokens and ids of their owners
+	tokens []uint64
+	owners []string
+	// Owning members by id
+	members map[string]tattle.Member
+}
+
+// Range of hash space whose primary owner changed.
+// Start is exclusive and End is inclusive, the range wraps around
+// if Start >= End.
+type Range struct {
+	Start uint64
+	End   uint64
+	// Previous and new owners, empty if the ring was empty
+	From string
+	To   string
+}
+
+// Check if the hash belongs to the range
+func (r Range) Contains(hash uint64) bool {
+	if r.Start < r.End {
+		return hash > r.Start && hash <= r.End
+	}
+
+	return hash > r.Start || hash <= r.End
+}
+
+// Ownership change caused by membership events
+type Change struct {
+	// Events which caused the change
+	Events []tattle.MemberEvent
+	// Ids of members which started or stopped owning keys
+	Added   []string
+	Removed []string
+	// Ranges whose primary owner changed, replicas returned
+	// by Lookup with n > 1 may change outside of them
+	Moved []Range
+}
+
+// Create a new ring from the current membership
+func NewRing(params RingParams) (*Ring, error) {
+	if params.Membership == nil {
+		return nil, errors.WithStack(ErrNoMembership)
+	}
+
+	if params.VirtualNodes < 1 {
+		return nil, errors.New("virtual nodes must be at least 1")
+	}
+
+	if !(params.MaxWeight > 0) {
+		return nil, errors.New("max weight must be positive")
+	}
+
+	r := &Ring{
+		RingParams: params,
+	}
+
+	r.state = r.build()
+
+	return r, nil
+}
+
+// Follow membership events updating the ring until context is done
+func (r *Ring) Run() error {
+	if r.WaitGroup != nil {
+		defer r.WaitGroup.Done()
+	}
+
+	// Membership is taken from the source on every update,
+	// so replaying old events is harmless
+	events := r.Membership.Subscribe(r.Ctx, 0)
+
+	for {
+		var batch []tattle.MemberEvent
+
+		select {
+		case <-r.Ctx.Done():
+			return nil
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			batch = append(batch, ev)
+		}
+
+		// Apply whatever has piled up at once
+	drain:
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					break drain
+				}
+
+				batch = append(batch, ev)
+			default:
+				break drain
+			}
+		}
+
+		r.update(batch)
+	}
+}
+
+// Return the hash of the key
+func (r *Ring) Hash(key string) uint64 {
+	return r.RingParams.Hash([]byte(key))
+}
+
+// Return up to n distinct members owning the key, primary owner first
+func (r *Ring) Lookup(key string, n int) []tattle.Member {
+	state := r.current()
+
+	if len(state.tokens) == 0 || n < 1 {
+		return nil
+	}
+
+	if n > len(state.members) {
+		n = len(state.members)
+	}
+
+	hash := r.Hash(key)
+	idx := state.search(hash)
+	seen := make(map[string]bool, n)
+	owners := make([]tattle.Member, 0, n)
+
+	for i := 0; i < len(state.tokens) && len(owners) < n; i++ {
+		id := state.owners[(idx+i)%len(state.tokens)]
+
+		if !seen[id] {
+			seen[id] = true
+			owners = append(owners, state.members[id])
+		}
+	}
+
+	return owners
+}
+
+// Return ids of members owning keys, sorted
+func (r *Ring) Members() []string {
+	state := r.current()
+	ids := make([]string, 0, len(state.members))
+
+	for id := range state.members {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+func (r *Ring) current() *ringState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.state
+}
+
+// Rebuild the ring and notify the handler if ownership changed
+func (r *Ring) update(events []tattle.MemberEvent) {
+	next := r.build()
+
+	r.mu.Lock()
+	prev := r.state
+	r.state = next
+	r.mu.Unlock()
+
+	change := diff(prev, next)
+
+	if len(change.Added) == 0 && len(change.Removed) == 0 &&
+		len(change.Moved) == 0 {
+		return
+	}
+
+	change.Events = events
+
+	r.Logger.With("added", len(change.Added), "removed",
+		len(change.Removed), "moved", len(change.Moved)).
+		Debug("hash ring changed")
+
+	if r.Handler != nil {
+		r.Handler(change)
+	}
+}
+
+// Build ring state from the current membership
+func (r *Ring) build() *ringState {
+	state := &ringState{
+		members: map[string]tattle.Member{},
+	}
+
+	members := r.Membership.Members()
+
+	if local := r.Membership.LocalMember(); local.Peer != nil {
+		members = append(members, local)
+	}
+
+	type vnode struct {
+		token uint64
+		owner string
+	}
+
+	var vnodes []vnode
+
+	for _, m := range members {
+		if m.Peer == nil || !m.Confirmed() || !r.owning(m.State) {
+			continue
+		}
+
+		id := m.Peer.PeerId()
+		count := r.virtualNodes(m)
+
+		if count == 0 {
+			continue
+		}
+
+		state.members[id] = m
+
+		for i := 0; i < count; i++ {
+			vnodes = append(vnodes, vnode{
+				token: r.RingParams.Hash([]byte(id + "#" + strconv.Itoa(i))),
+				owner: id,
+			})
+		}
+	}
+
+	// Owner ids break token collisions deterministically
+	sort.Slice(vnodes, func(i, j int) bool {
+		if vnodes[i].token != vnodes[j].token {
+			return vnodes[i].token < vnodes[j].token
+		}
+
+		return vnodes[i].owner < vnodes[j].owner
+	})
+
+	state.tokens = make([]uint64, len(vnodes))
+	state.owners = make([]string, len(vnodes))
+
+	for i, v := range vnodes {
+		state.tokens[i] = v.token
+		state.owners[i] = v.owner
+	}
+
+	return state
+}
+
+func (r *Ring) owning(state tattle.MemberState) bool {
+	for _, s := range r.States {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return number of virtual nodes of the member according to its weight
+func (r *Ring) virtualNodes(m tattle.Member) int {
+	val, ok := m.Tags[r.WeightTag]
+
+	if !ok || r.WeightTag == "" {
+		return r.VirtualNodes
+	}
+
+	weight, err := strconv.ParseFloat(val, 64)
+
+	if err != nil || weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+		r.Logger.With(tattle.LogFieldPeerId, m.Peer.PeerId()).
+			Warning("invalid weight %q, using 1", val)
+
+		return r.VirtualNodes
+	}
+
+	if weight > r.MaxWeight {
+		r.Logger.With(tattle.LogFieldPeerId, m.Peer.PeerId()).
+			Warning("weight %q is too large, using %g", val, r.MaxWeight)
+
+		weight = r.MaxWeight
+	}
+
+	return int(math.Round(weight * float64(r.VirtualNodes)))
+}
+
+// Return index of the first token not less than the hash,
+// wrapping around to the first one
+func (s *ringState) search(hash uint64) int {
+	idx := sort.Search(len(s.tokens), func(i int) bool {
+		return s.tokens[i] >= hash
+	})
+
+	if idx == len(s.tokens) {
+		idx = 0
+	}
+
+	return idx
+}
+
+// Return primary owner of the hash, empty for an empty ring
+func (s *ringState) owner(hash uint64) string {
+	if len(s.tokens) == 0 {
+		return ""
+	}
+
+	return s.owners[s.search(hash)]
+}
+
+// Compute ownership change between two ring states
+func diff(prev, next *ringState) Change {
+	var change Change
+
+	for id := range next.members {
+		if _, ok := prev.members[id]; !ok {
+			change.Added = append(change.Added, id)
+		}
+	}
+
+	for id := range prev.members {
+		if _, ok := next.members[id]; !ok {
+			change.Removed = append(change.Removed, id)
+		}
+	}
+
+	sort.Strings(change.Added)
+	sort.Strings(change.Removed)
+
+	// Ownership is constant between consecutive tokens of both rings
+	bounds := make([]uint64, 0, len(prev.tokens)+len(next.tokens))
+	bounds = append(bounds, prev.tokens...)
+	bounds = append(bounds, next.tokens...)
+
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	uniq := bounds[:0]
+
+	for i, b := range bounds {
+		if i == 0 || b != bounds[i-1] {
+			uniq = append(uniq, b)
+		}
+	}
+
+	bounds = uniq
+
+	if len(bounds) == 0 {
+		return change
+	}
+
+	for i, end := range bounds {
+		// First segment wraps around from the last bound
+		start := bounds[(i+len(bounds)-1)%len(bounds)]
+		from, to := prev.owner(end), next.owner(end)
+
+		if from == to {
+			continue
+		}
+
+		// Merge with the previous segment when possible
+		if n := len(change.Moved); n > 0 && change.Moved[n-1].End == start &&
+			change.Moved[n-1].From == from && change.Moved[n-1].To == to {
+			change.Moved[n-1].End = end
+
+			continue
+		}
+
+		change.Moved = append(change.Moved, Range{
+			Start: start,
+			End:   end,
+			From:  from,
+			To:    to,
+		})
+	}
+
+	return change
+}
+
+// FNV-1a with a final avalanche step, plain FNV distributes
+// similar short keys poorly
+func defaultHash(data []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+
+	return mix64(h.Sum64())
+}
+
+// Finalizer of MurmurHash3
+func mix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb93e53baa4d1
+	k ^= k >> 33
+
+	return k
+}
@@ -0,0 +1,466 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package ring
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/syhpoon/tattle"
+)
+
+// Membership source with a fixed member list
+type fakeMembership struct {
+	mu      sync.Mutex
+	members []tattle.Member
+	events  chan tattle.MemberEvent
+}
+
+func (f *fakeMembership) Members() []tattle.Member {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]tattle.Member(nil), f.members...)
+}
+
+func (f *fakeMembership) LocalMember() tattle.Member {
+	return tattle.Member{}
+}
+
+func (f *fakeMembership) Subscribe(
+	ctx context.Context, index uint64) <-chan tattle.MemberEvent {
+
+	return f.events
+}
+
+func (f *fakeMembership) set(members []tattle.Member) {
+	f.mu.Lock()
+	f.members = members
+	f.mu.Unlock()
+}
+
+// Create an alive member with optional weight
+func member(id string, weight string) tattle.Member {
+	m := tattle.Member{
+		Peer:  tattle.HttpPeer{Id: id, Host: id + ".test", Port: 9000},
+		State: tattle.MemberStateAlive,
+	}
+
+	if weight != "" {
+		m.Tags = map[string]string{"weight": weight}
+	}
+
+	return m
+}
+
+func newTestRing(t *testing.T, members ...tattle.Member) (*Ring, *fakeMembership) {
+	t.Helper()
+
+	source := &fakeMembership{
+		members: members,
+		events:  make(chan tattle.MemberEvent),
+	}
+
+	params := DefaultRingParams()
+	params.Membership = source
+	params.Logger = tattle.NewLoggerPrintf(ioutil.Discard, 0)
+
+	r, err := NewRing(params)
+
+	if err != nil {
+		t.Fatalf("new ring: %+v", err)
+	}
+
+	return r, source
+}
+
+// Return share of keys owned by every member
+func keyShares(r *Ring, keys int) map[string]float64 {
+	shares := map[string]float64{}
+
+	for i := 0; i < keys; i++ {
+		owner := r.Lookup(fmt.Sprintf("key-%d", i), 1)[0]
+		shares[owner.Peer.PeerId()] += 1.0 / float64(keys)
+	}
+
+	return shares
+}
+
+func TestNewRing(t *testing.T) {
+	tests := []struct {
+		name      string
+		change    func(p *RingParams)
+		wantCause error
+		wantErr   bool
+	}{
+		{"defaults", func(p *RingParams) {}, nil, false},
+		{"no membership", func(p *RingParams) { p.Membership = nil },
+			ErrNoMembership, true},
+		{"no virtual nodes", func(p *RingParams) { p.VirtualNodes = 0 }, nil, true},
+		{"no max weight", func(p *RingParams) { p.MaxWeight = 0 }, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := DefaultRingParams()
+			params.Membership = &fakeMembership{}
+			test.change(&params)
+
+			_, err := NewRing(params)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+
+			if test.wantCause != nil && errors.Cause(err) != test.wantCause {
+				t.Errorf("err = %v, want %v", err, test.wantCause)
+			}
+		})
+	}
+}
+
+func TestRingDistribution(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []tattle.Member
+		want    map[string]float64
+	}{
+		{
+			name:    "single member",
+			members: []tattle.Member{member("a", "")},
+			want:    map[string]float64{"a": 1},
+		},
+		{
+			name: "equal members",
+			members: []tattle.Member{
+				member("a", ""), member("b", ""), member("c", ""), member("d", ""),
+			},
+			want: map[string]float64{"a": 0.25, "b": 0.25, "c": 0.25, "d": 0.25},
+		},
+		{
+			name: "weighted members",
+			members: []tattle.Member{
+				member("a", "2"), member("b", "1"), member("c", "0.5"),
+				member("d", "0.5"),
+			},
+			want: map[string]float64{"a": 0.5, "b": 0.25, "c": 0.125, "d": 0.125},
+		},
+		{
+			name: "zero and invalid weights",
+			members: []tattle.Member{
+				member("a", ""), member("b", "heavy"), member("c", "0"),
+				member("d", "-1"),
+			},
+			want: map[string]float64{"a": 1.0 / 3, "b": 1.0 / 3, "d": 1.0 / 3},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := newTestRing(t, test.members...)
+			shares := keyShares(r, 20000)
+
+			if len(shares) != len(test.want) {
+				t.Fatalf("owners %v, want %v", shares, test.want)
+			}
+
+			// Shares of 128 virtual nodes per unit of weight stay
+			// within a third of the ideal
+			for id, want := range test.want {
+				if got := shares[id]; math.Abs(got-want) > want/3 {
+					t.Errorf("%s owns %.3f of keys, want %.3f", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRingVirtualNodes(t *testing.T) {
+	r, _ := newTestRing(t)
+
+	tests := []struct {
+		name   string
+		weight string
+		want   int
+	}{
+		{"no weight", "", 128},
+		{"double", "2", 256},
+		{"fraction", "0.5", 64},
+		{"zero", "0", 0},
+		{"negative", "-1", 128},
+		{"not a number", "heavy", 128},
+		{"infinite", "Inf", 128},
+		{"maximum", "100", 12800},
+		{"too large", "1e12", 12800},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := r.virtualNodes(member("a", test.weight)); got != test.want {
+				t.Errorf("virtual nodes = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRingLookup(t *testing.T) {
+	suspect := member("s", "")
+	suspect.State = tattle.MemberStateSuspect
+
+	dead := member("x", "")
+	dead.State = tattle.MemberStateDead
+
+	r, _ := newTestRing(t, member("a", ""), member("b", ""), suspect, dead)
+
+	tests := []struct {
+		name string
+		n    int
+		want int
+	}{
+		{"primary", 1, 1},
+		{"replicas", 2, 2},
+		{"more than members", 5, 3},
+		{"none", 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			owners := r.Lookup("key", test.n)
+
+			if len(owners) != test.want {
+				t.Fatalf("got %d owners, want %d", len(owners), test.want)
+			}
+
+			seen := map[string]bool{}
+
+			for _, m := range owners {
+				id := m.Peer.PeerId()
+
+				if seen[id] || id == "x" {
+					t.Errorf("unexpected owners %v", owners)
+				}
+
+				seen[id] = true
+			}
+
+			// Primary owner doesn't depend on number of replicas
+			if test.n > 0 && owners[0].Peer.PeerId() !=
+				r.Lookup("key", 1)[0].Peer.PeerId() {
+
+				t.Errorf("primary owner changed")
+			}
+		})
+	}
+
+	if got := r.Members(); fmt.Sprint(got) != "[a b s]" {
+		t.Errorf("members = %v", got)
+	}
+
+	empty, _ := newTestRing(t)
+
+	if owners := empty.Lookup("key", 1); owners != nil {
+		t.Errorf("empty ring returned %v", owners)
+	}
+}
+
+func TestRangeContains(t *testing.T) {
+	tests := []struct {
+		name string
+		r    Range
+		hash uint64
+		want bool
+	}{
+		{"inside", Range{Start: 10, End: 20}, 15, true},
+		{"start is exclusive", Range{Start: 10, End: 20}, 10, false},
+		{"end is inclusive", Range{Start: 10, End: 20}, 20, true},
+		{"outside", Range{Start: 10, End: 20}, 30, false},
+		{"wrapped high", Range{Start: 20, End: 10}, math.MaxUint64, true},
+		{"wrapped low", Range{Start: 20, End: 10}, 5, true},
+		{"wrapped outside", Range{Start: 20, End: 10}, 15, false},
+		{"whole ring", Range{Start: 10, End: 10}, 3, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.r.Contains(test.hash); got != test.want {
+				t.Errorf("contains = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRingChange(t *testing.T) {
+	initial := []tattle.Member{member("a", ""), member("b", ""), member("c", "")}
+
+	tests := []struct {
+		name        string
+		members     []tattle.Member
+		wantAdded   []string
+		wantRemoved []string
+		// Approximate share of keys changing their primary owner
+		wantMoved float64
+	}{
+		{
+			name:      "member added",
+			members:   append(initial[:3:3], member("d", "")),
+			wantAdded: []string{"d"},
+			wantMoved: 0.25,
+		},
+		{
+			name:        "member removed",
+			members:     initial[:2],
+			wantRemoved: []string{"c"},
+			wantMoved:   1.0 / 3,
+		},
+		{
+			name:      "weight changed",
+			members:   []tattle.Member{member("a", "2"), initial[1], initial[2]},
+			wantMoved: 0.25,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, source := newTestRing(t, initial...)
+
+			const keys = 20000
+
+			before := make([]string, keys)
+
+			for i := range before {
+				before[i] = r.Lookup(fmt.Sprintf("key-%d", i), 1)[0].Peer.PeerId()
+			}
+
+			var changes []Change
+
+			r.Handler = func(c Change) { changes = append(changes, c) }
+
+			source.set(test.members)
+			r.update(nil)
+
+			if len(changes) != 1 {
+				t.Fatalf("got %d changes, want 1", len(changes))
+			}
+
+			change := changes[0]
+
+			if fmt.Sprint(change.Added) != fmt.Sprint(test.wantAdded) ||
+				fmt.Sprint(change.Removed) != fmt.Sprint(test.wantRemoved) {
+
+				t.Errorf("added %v, removed %v", change.Added, change.Removed)
+			}
+
+			moved := 0
+
+			for i, prev := range before {
+				key := fmt.Sprintf("key-%d", i)
+				owner := r.Lookup(key, 1)[0].Peer.PeerId()
+				hash := r.Hash(key)
+
+				inRange := false
+
+				for _, rng := range change.Moved {
+					if rng.Contains(hash) {
+						inRange = rng.From == prev && rng.To == owner
+
+						break
+					}
+				}
+
+				if owner != prev {
+					moved++
+
+					if !inRange {
+						t.Fatalf("%s moved from %s to %s outside of moved ranges",
+							key, prev, owner)
+					}
+				} else if inRange {
+					t.Fatalf("%s is in a moved range but kept its owner", key)
+				}
+			}
+
+			share := float64(moved) / keys
+
+			if math.Abs(share-test.wantMoved) > test.wantMoved/3 {
+				t.Errorf("%.3f of keys moved, want about %.3f", share, test.wantMoved)
+			}
+
+			// Rebuilding the same membership changes nothing
+			r.update(nil)
+
+			if len(changes) != 1 {
+				t.Errorf("unexpected change %+v", changes[1])
+			}
+		})
+	}
+}
+
+func TestRingRun(t *testing.T) {
+	r, source := newTestRing(t, member("a", ""))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	changes := make(chan Change, 1)
+
+	r.Ctx = ctx
+	r.Handler = func(c Change) { changes <- c }
+
+	done := make(chan error)
+
+	go func() {
+		done <- r.Run()
+	}()
+
+	source.set([]tattle.Member{member("a", ""), member("b", "")})
+	source.events <- tattle.MemberEvent{Index: 1, Type: tattle.MemberEventJoin,
+		Member: member("b", "")}
+
+	select {
+	case c := <-changes:
+		if fmt.Sprint(c.Added) != "[b]" || len(c.Events) != 1 {
+			t.Errorf("unexpected change %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ring didn't follow membership")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run: %+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't return")
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Bounds number of concurrent outbound RPCs
+type rpcPool struct {
+	slots   chan struct{}
+	waiting int64
+}
+
+func newRpcPool(size int) *rpcPool {
+	return &rpcPool{
+		slots: make(chan struct{}, size),
+	}
+}
+
+// Check if a slot can be taken without waiting
+func (p *rpcPool) available() bool {
+	return len(p.slots) < cap(p.slots)
+}
+
+// Take a free slot, waiting for one until context is done
+func (d *Detector) acquireRpc(ctx context.Context) error {
+	select {
+	case d.rpcPool.slots <- struct{}{}:
+		d.Metrics.Observe(MetricRpcQueueWait, 0)
+		d.Metrics.Set(MetricRpcInflight, float64(len(d.rpcPool.slots)))
+
+		return nil
+	default:
+	}
+
+	start := time.Now()
+
+	d.Metrics.Set(MetricRpcQueued,
+		float64(atomic.AddInt64(&d.rpcPool.waiting, 1)))
+
+	defer func() {
+		d.Metrics.Set(MetricRpcQueued,
+			float64(atomic.AddInt64(&d.rpcPool.waiting, -1)))
+		d.Metrics.Observe(MetricRpcQueueWait, time.Since(start).Seconds())
+	}()
+
+	select {
+	case d.rpcPool.slots <- struct{}{}:
+		d.Metrics.Set(MetricRpcInflight, float64(len(d.rpcPool.slots)))
+
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "waiting for a free rpc slot")
+	}
+}
+
+func (d *Detector) releaseRpc() {
+	<-d.rpcPool.slots
+
+	d.Metrics.Set(MetricRpcInflight, float64(len(d.rpcPool.slots)))
+}
+
+// Send an RPC through the pool. The call is canceled when
+// the detector stops even if the context is not derived from its one.
+func (d *Detector) rpc(
+	ctx context.Context,
+	peer Peer,
+	req Request,
+	timeout time.Duration,
+) (Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-d.Ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := d.acquireRpc(ctx); err != nil {
+		return Response{}, err
+	}
+
+	defer d.releaseRpc()
+
+	return d.Transport.Rpc(ctx, peer, req, timeout)
+}
+
+// Run f in a goroutine the detector waits for when it stops.
+// Nothing is run once the detector is stopped, false is returned then.
+func (d *Detector) spawn(f func()) bool {
+	d.lifeMu.Lock()
+	defer d.lifeMu.Unlock()
+
+	if d.draining {
+		return false
+	}
+
+	d.inflight.Add(1)
+
+	go func() {
+		defer d.inflight.Done()
+
+		f()
+	}()
+
+	return true
+}
+
+// Spawn f after the delay unless the detector stops before
+func (d *Detector) afterFunc(delay time.Duration, f func()) *time.Timer {
+	d.lifeMu.Lock()
+	defer d.lifeMu.Unlock()
+
+	var timer *time.Timer
+
+	timer = time.AfterFunc(delay, func() {
+		d.lifeMu.Lock()
+		delete(d.timers, timer)
+		d.lifeMu.Unlock()
+
+		d.spawn(f)
+	})
+
+	if d.draining {
+		timer.Stop()
+	} else {
+		d.timers[timer] = struct{}{}
+	}
+
+	return timer
+}
+
+// Stop a timer started with afterFunc
+func (d *Detector) stopTimer(timer *time.Timer) {
+	d.lifeMu.Lock()
+	defer d.lifeMu.Unlock()
+
+	timer.Stop()
+	delete(d.timers, timer)
+}
@@ -0,0 +1,180 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcquireRpc(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		taken    int
+		release  bool
+		wantErr  bool
+		inflight float64
+	}{
+		{name: "free slot", size: 2, taken: 1, inflight: 2},
+		{name: "slot released", size: 1, taken: 1, release: true, inflight: 1},
+		{name: "timed out", size: 1, taken: 1, wantErr: true, inflight: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := newMetricsRecorder()
+
+			params := testDetectorParams(newFakeTransport(nil),
+				fakePeer("local"), fakePeer("seed"))
+			params.MaxConcurrentRpcs = test.size
+			params.Metrics = metrics
+
+			d := newTestDetector(t, params)
+
+			for i := 0; i < test.taken; i++ {
+				if err := d.acquireRpc(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if test.release {
+				time.AfterFunc(20*time.Millisecond, d.releaseRpc)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(),
+				200*time.Millisecond)
+			defer cancel()
+
+			if err := d.acquireRpc(ctx); (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+
+			if got := metrics.value(MetricRpcInflight); got != test.inflight {
+				t.Errorf("inflight = %v, want %v", got, test.inflight)
+			}
+
+			// Queued gauge drops back once the caller stops waiting
+			if got := metrics.value(MetricRpcQueued); got != 0 {
+				t.Errorf("queued = %v, want 0", got)
+			}
+
+			if got := metrics.total(MetricRpcQueueWait); got != float64(test.taken+1) {
+				t.Errorf("queue wait observed %v times, want %d", got, test.taken+1)
+			}
+		})
+	}
+}
+
+func TestRpcWaitingForSlotStops(t *testing.T) {
+	params := testDetectorParams(newFakeTransport(nil),
+		fakePeer("local"), fakePeer("seed"))
+	params.MaxConcurrentRpcs = 1
+
+	d := newTestDetector(t, params)
+
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.acquireRpc(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		_, err := d.rpc(context.Background(), fakePeer("seed"), RequestDirectPing{}, 0)
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("rpc succeeded without a free slot")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rpc kept waiting after stop")
+	}
+}
+
+func TestRpcRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		label string
+	}{
+		{name: "probe skipped", label: probeTypeDirect},
+		{name: "indirect ping nacked", label: probeTypeIndirect},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := newMetricsRecorder()
+			tr := newFakeTransport(nil)
+
+			params := testDetectorParams(tr, fakePeer("local"), fakePeer("seed"))
+			params.MaxConcurrentRpcs = 1
+			params.Metrics = metrics
+
+			d := newTestDetector(t, params)
+
+			if err := d.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			// Every slot is busy from now on
+			if err := d.acquireRpc(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			defer d.releaseRpc()
+
+			if test.label == probeTypeIndirect {
+				ch := make(chan Response, 1)
+
+				tr.in <- IncomingRequest{
+					Ctx:          context.Background(),
+					Request:      RequestIndirectPing{TargetPeer: fakePeer("seed")},
+					ResponseChan: ch,
+				}
+
+				if resp := <-ch; !resp.Nack {
+					t.Error("indirect ping wasn't nacked")
+				}
+			}
+
+			waitFor(t, 5*time.Second, "rejected rpc", func() bool {
+				return metrics.value(MetricRpcRejected, test.label) > 0
+			})
+		})
+	}
+}
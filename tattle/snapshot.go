@@ -0,0 +1,443 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Minimal number of records in a snapshot file before it's compacted
+const snapshotCompactMin = 1024
+
+// Single line of a snapshot file, only one of the fields is set
+type snapshotRecord struct {
+	// Member is alive, carries its latest known state
+	Alive *UpdateEvent `json:"alive,omitempty"`
+	// Member with this id is not alive anymore
+	Gone string `json:"gone,omitempty"`
+	// Incarnation of the local node
+	Incarnation *uint64 `json:"incarnation,omitempty"`
+	// Local node left the cluster gracefully
+	Leave bool `json:"leave,omitempty"`
+}
+
+// Append-only log of membership changes used to rejoin known members
+// after a restart. Log is compacted into the current state once it grows
+// much larger than the state itself.
+type snapshot struct {
+	path   string
+	logger Logger
+
+	mu          sync.Mutex
+	file        *os.File
+	records     int
+	alive       map[string]UpdateEvent
+	incarnation uint64
+	left        bool
+}
+
+// Open a snapshot file replaying its contents, file is created if missing
+func openSnapshot(path string, logger Logger) (*snapshot, error) {
+	s := &snapshot{
+		path:   path,
+		logger: logger,
+		alive:  map[string]UpdateEvent{},
+	}
+
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	// Compacting at startup drops whatever history was replayed
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Read the snapshot file rebuilding the state
+func (s *snapshot) replay() error {
+	f, err := os.Open(s.path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "error opening snapshot")
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, int(DefaultMaxMessageSize))
+
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		var rec snapshotRecord
+
+		// Last line may be truncated if the process crashed
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			s.logger.With(LogFieldError, err).
+				Warning("skipping invalid snapshot record at line %d", line)
+
+			continue
+		}
+
+		s.apply(rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "error reading snapshot")
+	}
+
+	return nil
+}
+
+// Apply a record to the state
+func (s *snapshot) apply(rec snapshotRecord) {
+	switch {
+	case rec.Alive != nil && rec.Alive.Peer != nil:
+		s.alive[rec.Alive.Peer.PeerId()] = *rec.Alive
+	case rec.Gone != "":
+		delete(s.alive, rec.Gone)
+	case rec.Incarnation != nil:
+		s.incarnation = *rec.Incarnation
+		s.left = false
+	case rec.Leave:
+		s.left = true
+	}
+}
+
+// Return members alive at the moment of the last record
+// sorted by id, nothing if the node left the cluster
+func (s *snapshot) aliveMembers() []UpdateEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.left {
+		return nil
+	}
+
+	members := make([]UpdateEvent, 0, len(s.alive))
+
+	for _, update := range s.alive {
+		members = append(members, update)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Peer.PeerId() < members[j].Peer.PeerId()
+	})
+
+	return members
+}
+
+// Return recorded local incarnation and whether the node left the cluster
+func (s *snapshot) local() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.incarnation, s.left
+}
+
+// Drop remembered members and the leave flag
+func (s *snapshot) forget() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.alive = map[string]UpdateEvent{}
+	s.left = false
+
+	return s.compactLocked()
+}
+
+// Record a member being alive
+func (s *snapshot) memberAlive(update UpdateEvent) {
+	s.append(snapshotRecord{Alive: &update}, false)
+}
+
+// Record a member not being alive anymore
+func (s *snapshot) memberGone(id string) {
+	s.append(snapshotRecord{Gone: id}, false)
+}
+
+// Record local incarnation
+func (s *snapshot) localIncarnation(incarnation uint64) {
+	s.append(snapshotRecord{Incarnation: &incarnation}, false)
+}
+
+// Record graceful leave of the local node, syncing it to disk
+func (s *snapshot) leave() {
+	s.append(snapshotRecord{Leave: true}, true)
+}
+
+// Apply and persist a record, compacting the log if it grew too large
+func (s *snapshot) append(rec snapshotRecord, sync bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return
+	}
+
+	s.apply(rec)
+
+	if err := s.write(s.file, rec); err != nil {
+		s.logger.With(LogFieldError, err).Error("error writing snapshot")
+
+		return
+	}
+
+	s.records++
+
+	if sync {
+		if err := s.file.Sync(); err != nil {
+			s.logger.With(LogFieldError, err).Error("error syncing snapshot")
+		}
+	}
+
+	if s.records > snapshotCompactMin && s.records > 4*(len(s.alive)+1) {
+		if err := s.compactLocked(); err != nil {
+			s.logger.With(LogFieldError, err).Error("error compacting snapshot")
+		}
+	}
+}
+
+func (s *snapshot) write(f *os.File, rec snapshotRecord) error {
+	data, err := json.Marshal(rec)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = f.Write(append(data, '\n'))
+
+	return errors.WithStack(err)
+}
+
+// Replace the log with records describing the current state
+func (s *snapshot) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.compactLocked()
+}
+
+func (s *snapshot) compactLocked() error {
+	tmpPath := s.path + ".compact"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return errors.Wrap(err, "error creating snapshot")
+	}
+
+	incarnation := s.incarnation
+	records := []snapshotRecord{{Incarnation: &incarnation}}
+
+	for _, update := range s.alive {
+		update := update
+		records = append(records, snapshotRecord{Alive: &update})
+	}
+
+	if s.left {
+		records = append(records, snapshotRecord{Leave: true})
+	}
+
+	for _, rec := range records {
+		if err = s.write(f, rec); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = errors.WithStack(f.Sync())
+	}
+
+	if err == nil {
+		err = errors.WithStack(os.Rename(tmpPath, s.path))
+	}
+
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+
+		return errors.Wrap(err, "error compacting snapshot")
+	}
+
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+
+	s.file = f
+	s.records = len(records)
+
+	return nil
+}
+
+// Close the snapshot file, further records are ignored
+func (s *snapshot) close() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Sync()
+
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+
+	s.file = nil
+
+	return errors.WithStack(err)
+}
+
+// Load membership snapshot remembering its members as seeds.
+// Local incarnation continues from the recorded one, so that the cluster
+// prefers our announcements to whatever it remembers about us.
+func (d *Detector) restoreSnapshot() error {
+	snap, err := openSnapshot(d.SnapshotPath, d.Logger)
+
+	if err != nil {
+		return err
+	}
+
+	incarnation, left := snap.local()
+
+	d.snapshot = snap
+	d.incarnation = incarnation + 1
+
+	if left {
+		d.Logger.Info("node left the cluster before restart, " +
+			"not rejoining remembered members")
+
+		if err := snap.forget(); err != nil {
+			_ = snap.close()
+
+			return err
+		}
+	}
+
+	now := time.Now()
+
+	d.members.update(func(members map[string]*Member) {
+		for _, update := range snap.aliveMembers() {
+			id := update.Peer.PeerId()
+
+			if d.isLocal(update.Peer) {
+				continue
+			}
+
+			d.rejoinPeers = append(d.rejoinPeers, update.Peer)
+
+			if _, ok := members[id]; ok {
+				continue
+			}
+
+			members[id] = &Member{
+				Peer:        update.Peer,
+				State:       MemberStateAlive,
+				Incarnation: update.SeqNum,
+				Tags:        copyTags(update.Tags),
+				StateChange: now,
+				seed:        true,
+			}
+		}
+	})
+
+	snap.localIncarnation(d.incarnation)
+
+	return nil
+}
+
+// Persist member state change into the snapshot,
+// must be called with member list locked
+func (d *Detector) recordMember(m *Member) {
+	if d.snapshot == nil {
+		return
+	}
+
+	switch m.State {
+	case MemberStateAlive:
+		d.snapshot.memberAlive(UpdateEvent{
+			Peer:       m.Peer,
+			UpdateType: UpdateTypePeerAlive,
+			SeqNum:     m.Incarnation,
+			Tags:       copyTags(m.Tags),
+		})
+	case MemberStateDead, MemberStateLeft:
+		d.snapshot.memberGone(m.Peer.PeerId())
+	}
+}
+
+// Exchange full state with one of the members remembered
+// in the snapshot to catch up with the cluster quickly
+func (d *Detector) rejoin() {
+	peers := append([]Peer(nil), d.rejoinPeers...)
+
+	d.shufflePeers(peers)
+
+	for _, peer := range peers {
+		if err := d.pushPull(d.Ctx, peer); err != nil {
+			d.Logger.With(LogFieldPeerId, peer.PeerId(), LogFieldError, err).
+				Debug("error rejoining through remembered member")
+
+			continue
+		}
+
+		d.Logger.With(LogFieldPeerId, peer.PeerId()).
+			Info("rejoined the cluster")
+
+		return
+	}
+
+	d.Logger.Warning("unable to rejoin any remembered member")
+}
+
+// Record local incarnation in the snapshot if it's enabled
+func (d *Detector) persistIncarnation(incarnation uint64) {
+	if d.snapshot != nil {
+		d.snapshot.localIncarnation(incarnation)
+	}
+}
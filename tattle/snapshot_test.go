@@ -0,0 +1,248 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Encode snapshot records as lines of a snapshot file
+func snapshotLines(t *testing.T, records ...snapshotRecord) []string {
+	t.Helper()
+
+	lines := make([]string, 0, len(records))
+
+	for _, rec := range records {
+		data, err := json.Marshal(rec)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines = append(lines, string(data))
+	}
+
+	return lines
+}
+
+func TestSnapshotReplay(t *testing.T) {
+	alive := func(id string) snapshotRecord {
+		return snapshotRecord{Alive: &UpdateEvent{
+			Peer:       fakePeer(id),
+			UpdateType: UpdateTypePeerAlive,
+			SeqNum:     1,
+		}}
+	}
+
+	incarnation := func(inc uint64) snapshotRecord {
+		return snapshotRecord{Incarnation: &inc}
+	}
+
+	tests := []struct {
+		name        string
+		lines       []string
+		alive       []string
+		incarnation uint64
+		left        bool
+	}{
+		{
+			name:  "missing file",
+			alive: []string{},
+		},
+		{
+			name: "alive and gone",
+			lines: snapshotLines(t,
+				incarnation(3),
+				alive("a"),
+				alive("b"),
+				snapshotRecord{Gone: "a"}),
+			alive:       []string{"b"},
+			incarnation: 3,
+		},
+		{
+			name: "truncated last record",
+			lines: append(snapshotLines(t, incarnation(5), alive("a")),
+				`{"gone":`),
+			alive:       []string{"a"},
+			incarnation: 5,
+		},
+		{
+			name: "left",
+			lines: snapshotLines(t,
+				alive("a"),
+				incarnation(7),
+				snapshotRecord{Leave: true}),
+			alive:       []string{},
+			incarnation: 7,
+			left:        true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot")
+
+			if test.lines != nil {
+				data := strings.Join(test.lines, "\n") + "\n"
+
+				if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err := openSnapshot(path, NewLoggerPrintf(ioutil.Discard, 0))
+
+			if err != nil {
+				t.Fatalf("open: %+v", err)
+			}
+
+			defer s.close()
+
+			ids := []string{}
+
+			for _, update := range s.aliveMembers() {
+				ids = append(ids, update.Peer.PeerId())
+			}
+
+			if fmt.Sprint(ids) != fmt.Sprint(test.alive) {
+				t.Errorf("alive members %v, want %v", ids, test.alive)
+			}
+
+			incarnation, left := s.local()
+
+			if incarnation != test.incarnation || left != test.left {
+				t.Errorf("local %d/%v, want %d/%v",
+					incarnation, left, test.incarnation, test.left)
+			}
+		})
+	}
+}
+
+func TestSnapshotCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+
+	s, err := openSnapshot(path, NewLoggerPrintf(ioutil.Discard, 0))
+
+	if err != nil {
+		t.Fatalf("open: %+v", err)
+	}
+
+	peer := fakePeer("a")
+
+	for i := 0; i < 3*snapshotCompactMin; i++ {
+		s.memberAlive(UpdateEvent{
+			Peer:       peer,
+			UpdateType: UpdateTypePeerAlive,
+			SeqNum:     uint64(i),
+		})
+	}
+
+	if err := s.close(); err != nil {
+		t.Fatalf("close: %+v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(data), "\n"); lines > snapshotCompactMin+1 {
+		t.Errorf("snapshot has %d records, expected it to be compacted", lines)
+	}
+
+	s, err = openSnapshot(path, NewLoggerPrintf(ioutil.Discard, 0))
+
+	if err != nil {
+		t.Fatalf("reopen: %+v", err)
+	}
+
+	defer s.close()
+
+	alive := s.aliveMembers()
+
+	if len(alive) != 1 || alive[0].SeqNum != 3*snapshotCompactMin-1 {
+		t.Errorf("unexpected members after compaction: %+v", alive)
+	}
+}
+
+// Transitions evicted from a tiny event log must still be persisted
+func TestSnapshotRestoresMembers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	local := fakePeer("local")
+
+	params := testDetectorParams(newFakeTransport(nil), local, fakePeer("seed"))
+	params.SnapshotPath = path
+	params.EventLogSize = 1
+
+	d := newTestDetector(t, params)
+
+	var updates []UpdateEvent
+
+	for i := 0; i < 10; i++ {
+		updates = append(updates, UpdateEvent{
+			Peer:       fakePeer(fmt.Sprintf("peer-%d", i)),
+			UpdateType: UpdateTypePeerAlive,
+			SeqNum:     1,
+		})
+	}
+
+	updates = append(updates,
+		UpdateEvent{Peer: fakePeer("peer-3"), UpdateType: UpdateTypePeerDead, SeqNum: 1},
+		UpdateEvent{Peer: fakePeer("peer-7"), UpdateType: UpdateTypePeerLeft, SeqNum: 1},
+	)
+
+	d.applyUpdates(updates)
+
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %+v", err)
+	}
+
+	params = testDetectorParams(newFakeTransport(nil), local)
+	params.SnapshotPath = path
+
+	restored := newTestDetector(t, params)
+
+	states := map[string]MemberState{}
+
+	for _, m := range restored.Members() {
+		states[m.Peer.PeerId()] = m.State
+	}
+
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("peer-%d", i)
+		_, ok := states[id]
+
+		if want := i != 3 && i != 7; ok != want {
+			t.Errorf("%s restored: %v, want %v", id, ok, want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Name of the HTTP header used to propagate trace context (W3C Trace Context)
+const TraceParentHeader = "traceparent"
+
+// Identifiers of a span which are propagated between peers
+type SpanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Sampled bool
+}
+
+// Check if span context holds non-zero identifiers
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceId != [16]byte{} && sc.SpanId != [8]byte{}
+}
+
+// Format span context as a W3C traceparent header value
+func (sc SpanContext) TraceParent() string {
+	flags := 0
+
+	if sc.Sampled {
+		flags = 1
+	}
+
+	return fmt.Sprintf("00-%s-%s-%02x",
+		hex.EncodeToString(sc.TraceId[:]), hex.EncodeToString(sc.SpanId[:]), flags)
+}
+
+// Parse a W3C traceparent header value
+func ParseTraceParent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errors.Errorf("invalid traceparent: %s", value)
+	}
+
+	if _, err := hex.Decode(sc.TraceId[:], []byte(parts[1])); err != nil {
+		return sc, errors.Wrapf(err, "invalid trace id: %s", parts[1])
+	}
+
+	if _, err := hex.Decode(sc.SpanId[:], []byte(parts[2])); err != nil {
+		return sc, errors.Wrapf(err, "invalid span id: %s", parts[2])
+	}
+
+	var flags [1]byte
+
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, errors.Wrapf(err, "invalid trace flags: %s", parts[3])
+	}
+
+	sc.Sampled = flags[0]&1 == 1
+
+	if !sc.IsValid() {
+		return sc, errors.Errorf("invalid traceparent: %s", value)
+	}
+
+	return sc, nil
+}
+
+// Span is a single traced operation
+type Span interface {
+	// Context should return identifiers of the span
+	Context() SpanContext
+
+	// SetAttribute should attach a key/value pair to the span
+	SetAttribute(key string, value interface{})
+
+	// RecordError should attach an error to the span
+	RecordError(err error)
+
+	// End should finish the span
+	End()
+}
+
+// Tracer is a general abstraction for creating spans.
+// It can be adapted to OpenTelemetry or any other tracing library.
+type Tracer interface {
+	// Start should begin a new span which is a child of
+	// ParentSpanContext(ctx) if that is valid, and return
+	// a context holding the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type spanKey struct{}
+type remoteParentKey struct{}
+
+// Return a new context holding the span
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// Return a span stored in context, nil if none
+func SpanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanKey{}).(Span)
+
+	return span
+}
+
+// Return a new context holding a span context received from a remote peer
+func ContextWithRemoteParent(
+	ctx context.Context, sc SpanContext) context.Context {
+
+	return context.WithValue(ctx, remoteParentKey{}, sc)
+}
+
+// Return a span context new spans should be children of:
+// current span in context if any, or a remote parent otherwise
+func ParentSpanContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.Context()
+	}
+
+	sc, _ := ctx.Value(remoteParentKey{}).(SpanContext)
+
+	return sc
+}
+
+// Generate a new span context, inheriting trace id from parent if it's valid
+func newSpanContext(parent SpanContext) SpanContext {
+	sc := SpanContext{Sampled: true}
+
+	if parent.IsValid() {
+		sc.TraceId = parent.TraceId
+		sc.Sampled = parent.Sampled
+	} else {
+		_, _ = rand.Read(sc.TraceId[:])
+	}
+
+	_, _ = rand.Read(sc.SpanId[:])
+
+	return sc
+}
+
+// Tracer which records nothing, but passes remote trace context through
+type TracerNoop struct{}
+
+func (t TracerNoop) Start(
+	ctx context.Context, name string) (context.Context, Span) {
+
+	span := noopSpan{sc: ParentSpanContext(ctx)}
+
+	return ContextWithSpan(ctx, span), span
+}
+
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (s noopSpan) Context() SpanContext                       { return s.sc }
+func (s noopSpan) SetAttribute(key string, value interface{}) {}
+func (s noopSpan) RecordError(err error)                      {}
+func (s noopSpan) End()                                       {}
@@ -0,0 +1,123 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+// Package otel adapts OpenTelemetry tracers to detector tracing
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/syhpoon/tattle"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer adapter for OpenTelemetry
+type Tracer struct {
+	Tracer trace.Tracer
+}
+
+// Create a new tracer which starts spans with the OpenTelemetry tracer
+func New(tracer trace.Tracer) *Tracer {
+	return &Tracer{Tracer: tracer}
+}
+
+// Start a new span, remote trace context and spans of other
+// tracers in context become its parent
+func (t *Tracer) Start(
+	ctx context.Context, name string) (context.Context, tattle.Span) {
+
+	if _, ok := tattle.SpanFromContext(ctx).(otelSpan); !ok {
+		if parent := tattle.ParentSpanContext(ctx); parent.IsValid() {
+			ctx = trace.ContextWithRemoteSpanContext(ctx, otelSpanContext(parent))
+		}
+	}
+
+	ctx, span := t.Tracer.Start(ctx, name)
+	wrapped := otelSpan{span: span}
+
+	return tattle.ContextWithSpan(ctx, wrapped), wrapped
+}
+
+// Convert span context into the OpenTelemetry one
+func otelSpanContext(sc tattle.SpanContext) trace.SpanContext {
+	var flags trace.TraceFlags
+
+	if sc.Sampled {
+		flags = trace.FlagsSampled
+	}
+
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    sc.TraceId,
+		SpanID:     sc.SpanId,
+		TraceFlags: flags,
+		Remote:     true,
+	})
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) Context() tattle.SpanContext {
+	sc := s.span.SpanContext()
+
+	return tattle.SpanContext{
+		TraceId: sc.TraceID(),
+		SpanId:  sc.SpanID(),
+		Sampled: sc.IsSampled(),
+	}
+}
+
+func (s otelSpan) SetAttribute(key string, value interface{}) {
+	var attr attribute.KeyValue
+
+	switch v := value.(type) {
+	case string:
+		attr = attribute.String(key, v)
+	case bool:
+		attr = attribute.Bool(key, v)
+	case int:
+		attr = attribute.Int(key, v)
+	case int64:
+		attr = attribute.Int64(key, v)
+	case float64:
+		attr = attribute.Float64(key, v)
+	default:
+		attr = attribute.String(key, fmt.Sprint(v))
+	}
+
+	s.span.SetAttributes(attr)
+}
+
+func (s otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
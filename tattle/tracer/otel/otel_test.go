@@ -0,0 +1,125 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package otel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syhpoon/tattle"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := New(provider.Tracer("tattle"))
+
+	remote, err := tattle.ParseTraceParent(
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	if err != nil {
+		t.Fatalf("parse traceparent: %s", err)
+	}
+
+	ctx := tattle.ContextWithRemoteParent(context.Background(), remote)
+
+	ctx, probe := tracer.Start(ctx, "tattle.probe")
+	_, rpc := tracer.Start(ctx, "tattle.rpc.direct_ping")
+
+	rpc.SetAttribute("peer_id", "b")
+	rpc.SetAttribute("nack", true)
+	rpc.SetAttribute("attempt", 2)
+	rpc.SetAttribute("rtt", time.Second)
+	rpc.RecordError(errors.New("timeout"))
+	rpc.End()
+	probe.End()
+
+	ended := recorder.Ended()
+
+	if len(ended) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(ended))
+	}
+
+	rpcSpan, probeSpan := ended[0], ended[1]
+
+	tests := []struct {
+		name      string
+		span      sdktrace.ReadOnlySpan
+		wrapped   tattle.Span
+		parent    tattle.SpanContext
+		remote    bool
+		wantError bool
+	}{
+		{"probe continues remote trace", probeSpan, probe, remote, true, false},
+		{"rpc is a child of probe", rpcSpan, rpc, probe.Context(), false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parent := test.span.Parent()
+
+			if test.parent.TraceId != parent.TraceID() ||
+				test.parent.SpanId != parent.SpanID() {
+				t.Errorf("parent = %s, want %s", parent.SpanID(), test.parent.SpanId)
+			}
+
+			if parent.IsRemote() != test.remote {
+				t.Errorf("parent remote = %v, want %v", parent.IsRemote(), test.remote)
+			}
+
+			sc := test.span.SpanContext()
+
+			if test.wrapped.Context().SpanId != sc.SpanID() ||
+				test.wrapped.Context().TraceId != remote.TraceId {
+				t.Errorf("wrapped span context %+v doesn't match %s",
+					test.wrapped.Context(), sc.SpanID())
+			}
+
+			if got := test.span.Status().Code == codes.Error; got != test.wantError {
+				t.Errorf("error status = %v, want %v", got, test.wantError)
+			}
+		})
+	}
+
+	attrs := map[string]string{}
+
+	for _, kv := range rpcSpan.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+
+	want := map[string]string{
+		"peer_id": "b", "nack": "true", "attempt": "2", "rtt": "1s"}
+
+	for key, val := range want {
+		if attrs[key] != val {
+			t.Errorf("attribute %s = %q, want %q", key, attrs[key], val)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Finished span recorded by TracerMemory
+type SpanRecord struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanContext
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Errors     []string
+}
+
+// Tracer which keeps finished spans in memory, useful for tests and debugging
+type TracerMemory struct {
+	mu    sync.Mutex
+	spans []SpanRecord
+}
+
+// Create a new in-memory tracer
+func NewTracerMemory() *TracerMemory {
+	return &TracerMemory{}
+}
+
+// Start a new span
+func (t *TracerMemory) Start(
+	ctx context.Context, name string) (context.Context, Span) {
+
+	parent := ParentSpanContext(ctx)
+
+	span := &memorySpan{
+		tracer: t,
+		rec: SpanRecord{
+			Name:       name,
+			Context:    newSpanContext(parent),
+			Parent:     parent,
+			Start:      time.Now(),
+			Attributes: map[string]interface{}{},
+		},
+	}
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// Return a copy of all the finished spans
+func (t *TracerMemory) Spans() []SpanRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := make([]SpanRecord, len(t.spans))
+	copy(spans, t.spans)
+
+	return spans
+}
+
+// Drop all the recorded spans
+func (t *TracerMemory) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.spans = nil
+}
+
+func (t *TracerMemory) record(rec SpanRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.spans = append(t.spans, rec)
+}
+
+type memorySpan struct {
+	tracer *TracerMemory
+	mu     sync.Mutex
+	rec    SpanRecord
+	ended  bool
+}
+
+func (s *memorySpan) Context() SpanContext {
+	return s.rec.Context
+}
+
+func (s *memorySpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rec.Attributes[key] = value
+}
+
+func (s *memorySpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rec.Errors = append(s.rec.Errors, err.Error())
+}
+
+func (s *memorySpan) End() {
+	s.mu.Lock()
+
+	if s.ended {
+		s.mu.Unlock()
+
+		return
+	}
+
+	s.ended = true
+	s.rec.End = time.Now()
+
+	attrs := make(map[string]interface{}, len(s.rec.Attributes))
+
+	for k, v := range s.rec.Attributes {
+		attrs[k] = v
+	}
+
+	rec := s.rec
+	rec.Attributes = attrs
+
+	s.mu.Unlock()
+
+	s.tracer.record(rec)
+}
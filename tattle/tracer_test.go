@@ -0,0 +1,257 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	const traceId, spanId = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+
+	valid := "00-" + traceId + "-" + spanId + "-01"
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+		sampled bool
+	}{
+		{"sampled", valid, false, true},
+		{"not sampled",
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", false, false},
+		{"surrounding spaces", " " + valid + " ", false, true},
+		{"future version with extra fields", "01" + valid[2:] + "-ext", false, true},
+		{"forbidden version",
+			"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true, false},
+		{"short trace id", "00-0af76519-b7ad6b7169203331-01", true, false},
+		{"bad hex", "00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01",
+			true, false},
+		{"zero trace id",
+			"00-00000000000000000000000000000000-b7ad6b7169203331-01", true, false},
+		{"zero span id",
+			"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", true, false},
+		{"empty", "", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc, err := ParseTraceParent(test.value)
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", sc)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if sc.Sampled != test.sampled {
+				t.Errorf("sampled = %v, want %v", sc.Sampled, test.sampled)
+			}
+
+			if id := hex.EncodeToString(sc.TraceId[:]); id != traceId {
+				t.Errorf("trace id = %s, want %s", id, traceId)
+			}
+
+			if id := hex.EncodeToString(sc.SpanId[:]); id != spanId {
+				t.Errorf("span id = %s, want %s", id, spanId)
+			}
+		})
+	}
+}
+
+func TestSpanContextRoundTrip(t *testing.T) {
+	for _, sampled := range []bool{true, false} {
+		sc := newSpanContext(SpanContext{})
+		sc.Sampled = sampled
+
+		parsed, err := ParseTraceParent(sc.TraceParent())
+
+		if err != nil {
+			t.Fatalf("parse %s: %s", sc.TraceParent(), err)
+		}
+
+		if parsed != sc {
+			t.Errorf("round trip changed %+v into %+v", sc, parsed)
+		}
+	}
+}
+
+func TestTracerMemoryParents(t *testing.T) {
+	tracer := NewTracerMemory()
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := tracer.Start(ctx, "child")
+
+	child.SetAttribute("result", "ack")
+	child.RecordError(errors.New("boom"))
+	child.End()
+	child.End()
+	root.End()
+
+	spans := tracer.Spans()
+
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	if spans[0].Parent != root.Context() {
+		t.Errorf("child parent = %+v, want %+v", spans[0].Parent, root.Context())
+	}
+
+	if spans[0].Context.TraceId != root.Context().TraceId {
+		t.Error("child has a different trace id")
+	}
+
+	if spans[0].Attributes["result"] != "ack" || len(spans[0].Errors) != 1 {
+		t.Errorf("unexpected child record: %+v", spans[0])
+	}
+
+	if spans[1].Parent.IsValid() {
+		t.Errorf("root has a parent: %+v", spans[1].Parent)
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	clientTracer, serverTracer := NewTracerMemory(), NewTracerMemory()
+
+	client, _ := newTestTransport(t, func(p *TransportHttpParams) {
+		p.Tracer = clientTracer
+	})
+	server, serverPeer := newTestTransport(t, func(p *TransportHttpParams) {
+		p.Tracer = serverTracer
+	})
+
+	startTestTransport(t, client)
+	startTestTransport(t, server)
+
+	remoteParents := make(chan SpanContext, 1)
+
+	serveTestRequests(t, server, func(inReq IncomingRequest) Response {
+		remoteParents <- ParentSpanContext(inReq.Ctx)
+
+		return Response{}
+	})
+
+	ctx, probe := clientTracer.Start(context.Background(), "tattle.probe")
+
+	if _, err := client.Rpc(ctx, serverPeer, RequestDirectPing{},
+		time.Second); err != nil {
+		t.Fatalf("rpc: %s", err)
+	}
+
+	probe.End()
+
+	var rpc, handler SpanRecord
+
+	waitFor(t, time.Second, "server span", func() bool {
+		return len(serverTracer.Spans()) == 1
+	})
+
+	for _, span := range clientTracer.Spans() {
+		if span.Name == "tattle.rpc.direct_ping" {
+			rpc = span
+		}
+	}
+
+	handler = serverTracer.Spans()[0]
+
+	if rpc.Parent != probe.Context() {
+		t.Errorf("rpc span parent = %+v, want probe span", rpc.Parent)
+	}
+
+	if handler.Name != "tattle.http.direct_ping" {
+		t.Errorf("unexpected server span %s", handler.Name)
+	}
+
+	if handler.Parent != rpc.Context {
+		t.Errorf("server span parent = %+v, want rpc span %+v",
+			handler.Parent, rpc.Context)
+	}
+
+	if parent := <-remoteParents; parent != handler.Context {
+		t.Errorf("detector got parent %+v, want server span", parent)
+	}
+}
+
+func TestRpcTraceParentHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		tracer     Tracer
+		wantHeader bool
+	}{
+		{"noop tracer", &TracerNoop{}, false},
+		{"recording tracer", NewTracerMemory(), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := make(chan http.Header, 1)
+
+			srv := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, req *http.Request) {
+					headers <- req.Header
+					_ = NewCodecJson().EncodeResponse(Response{}, w)
+				}))
+
+			defer srv.Close()
+
+			client, _ := newTestTransport(t, func(p *TransportHttpParams) {
+				p.Tracer = test.tracer
+			})
+
+			addr := srv.Listener.Addr().(*net.TCPAddr)
+			peer := HttpPeer{Host: "127.0.0.1", Port: uint16(addr.Port), Protocol: "http"}
+
+			if _, err := client.Rpc(context.Background(), peer, RequestDirectPing{},
+				time.Second); err != nil {
+				t.Fatalf("rpc: %+v", err)
+			}
+
+			value := (<-headers).Get(TraceParentHeader)
+
+			if (value != "") != test.wantHeader {
+				t.Fatalf("traceparent = %q, want header %v", value, test.wantHeader)
+			}
+
+			if _, err := ParseTraceParent(value); test.wantHeader && err != nil {
+				t.Errorf("invalid traceparent %q: %s", value, err)
+			}
+		})
+	}
+}
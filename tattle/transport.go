@@ -24,7 +24,10 @@
 
 package tattle
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type UpdateType int
 
@@ -32,12 +35,31 @@ const (
 	UpdateTypePeerAlive      UpdateType = 1
 	UpdateTypePeerSuspicious UpdateType = 2
 	UpdateTypePeerDead       UpdateType = 3
+	UpdateTypePeerLeft       UpdateType = 4
 )
 
+var updateTypeNames = map[UpdateType]string{
+	UpdateTypePeerAlive:      "alive",
+	UpdateTypePeerSuspicious: "suspicious",
+	UpdateTypePeerDead:       "dead",
+	UpdateTypePeerLeft:       "left",
+}
+
+func (t UpdateType) String() string {
+	if name, ok := updateTypeNames[t]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
 type UpdateEvent struct {
 	Peer       Peer
 	UpdateType UpdateType
-	SeqNum     uint64
+	// Incarnation number of the peer
+	SeqNum uint64
+	// Peer tags, only set for alive updates
+	Tags map[string]string `json:",omitempty"`
 }
 
 type Request interface {
@@ -45,30 +67,60 @@ type Request interface {
 }
 
 type RequestDirectPing struct {
-	Updates []UpdateEvent
+	Updates    []UpdateEvent
+	UserEvents []UserEvent `json:",omitempty"`
+	Queries    []Query     `json:",omitempty"`
+	// Id and network coordinate of the sender
+	From       string      `json:",omitempty"`
+	Coordinate *Coordinate `json:",omitempty"`
 }
 
 func (r RequestDirectPing) IsTattleTransportRequest() {}
 
 type RequestIndirectPing struct {
 	Updates    []UpdateEvent
+	UserEvents []UserEvent `json:",omitempty"`
+	Queries    []Query     `json:",omitempty"`
 	TargetPeer Peer
 }
 
 func (r RequestIndirectPing) IsTattleTransportRequest() {}
 
+// Full state exchange used to join a cluster.
+// Response carries full state of the remote peer.
+type RequestPushPull struct {
+	State []UpdateEvent
+}
+
+func (r RequestPushPull) IsTattleTransportRequest() {}
+
 type Response struct {
-	Updates []UpdateEvent
+	Updates    []UpdateEvent
+	UserEvents []UserEvent `json:",omitempty"`
+	Queries    []Query     `json:",omitempty"`
+	// Network coordinate of the pinged peer
+	Coordinate *Coordinate `json:",omitempty"`
+	// Set by an indirect ping helper which failed to reach the target
+	Nack bool
 }
 
 type IncomingRequest struct {
+	// Request context, carries trace context of the remote caller
+	Ctx          context.Context
 	Request      Request
 	ResponseChan chan<- Response
 }
 
 // Transport is a general abstraction responsible for sending messages
-// between peers
+// between peers. Detector starts the transport and shuts it down
+// when it stops.
 type Transport interface {
-	Rpc(peer Peer, req Request, timeout time.Duration) (Response, error)
+	// Start serving incoming requests
+	Start(ctx context.Context) error
+	// Stop accepting requests and wait for the ones in progress
+	// until context is done
+	Shutdown(ctx context.Context) error
+	Rpc(ctx context.Context, peer Peer, req Request,
+		timeout time.Duration) (Response, error)
 	IncomingRequests() <-chan IncomingRequest
 }
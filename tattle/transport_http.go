@@ -26,13 +26,18 @@ package tattle
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -49,13 +54,22 @@ type TransportHttpParams struct {
 	RpcTimeout             time.Duration
 	DetectorInjectTimeout  time.Duration
 	DetectorProcessTimeout time.Duration
-	TLSCertFile            string
-	TLSKeyFile             string
-	Logger                 Logger
-	IncomingBufferSize     int
-	HttpClient             http.Client
-	Codec                  Codec
-	Ctx                    context.Context
+	// Requests in progress are given that long to complete upon
+	// shutdown before connections are closed, zero means no limit
+	// other than the shutdown context
+	ShutdownTimeout    time.Duration
+	TLSCertFile        string
+	TLSKeyFile         string
+	Logger             Logger
+	IncomingBufferSize int
+	// Bodies larger than this are sent with gzip Content-Encoding,
+	// zero disables compression
+	CompressThreshold int
+	HttpClient        http.Client
+	Metrics           Metrics
+	Tracer            Tracer
+	Codec             Codec
+	Ctx               context.Context
 }
 
 // Peer for Http transport
@@ -66,9 +80,79 @@ type HttpPeer struct {
 	Protocol string
 }
 
+func init() {
+	RegisterPeerType("http", HttpPeer{})
+}
+
 // Implement Peer interface
 func (p HttpPeer) IsTattlePeer() {}
 
+// Return peer address as URL
+func (p HttpPeer) String() string {
+	return fmt.Sprintf("%s://%s",
+		p.Protocol, net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port))))
+}
+
+// Check if the other peer is an HttpPeer with the same address,
+// ids are not compared
+func (p HttpPeer) SameAddress(other Peer) bool {
+	o, ok := other.(HttpPeer)
+
+	return ok && o.Protocol == p.Protocol && o.Host == p.Host && o.Port == p.Port
+}
+
+// Return peer id, falling back to its address if id is not set
+func (p HttpPeer) PeerId() string {
+	if p.Id != "" {
+		return p.Id
+	}
+
+	return net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port)))
+}
+
+// Parse a peer in [id@][proto://]host:port form,
+// protocol defaults to defaultProto
+func ParseHttpPeer(spec, defaultProto string) (HttpPeer, error) {
+	peer := HttpPeer{Protocol: defaultProto}
+	addr := spec
+
+	if idx := strings.Index(addr, "@"); idx >= 0 {
+		peer.Id = addr[:idx]
+		addr = addr[idx+1:]
+	}
+
+	if idx := strings.Index(addr, "://"); idx >= 0 {
+		peer.Protocol = addr[:idx]
+		addr = addr[idx+3:]
+	}
+
+	if peer.Protocol != "http" && peer.Protocol != "https" {
+		return peer, errors.Errorf(
+			"invalid peer %q: unsupported protocol %s", spec, peer.Protocol)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return peer, errors.Errorf("invalid peer %q: %s", spec, err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+
+	if err != nil || port == 0 {
+		return peer, errors.Errorf("invalid peer %q: bad port %s", spec, portStr)
+	}
+
+	if host == "" {
+		return peer, errors.Errorf("invalid peer %q: empty host", spec)
+	}
+
+	peer.Host = host
+	peer.Port = uint16(port)
+
+	return peer, nil
+}
+
 // TransportHttp uses HTTP protocol to exchange messages between peers
 type TransportHttp struct {
 	TransportHttpParams
@@ -76,6 +160,19 @@ type TransportHttp struct {
 	router *mux.Router
 	server http.Server
 	inChan chan IncomingRequest
+
+	// Current TLS certificate, replaced by ReloadCertificate
+	certMu sync.RWMutex
+	cert   *tls.Certificate
+
+	// Guards lifecycle state below
+	lifeMu   sync.Mutex
+	started  bool
+	shutdown bool
+	// Closed once the server stops serving
+	served chan struct{}
+	// Error the server stopped with, set before served is closed
+	serveErr error
 }
 
 // Create default parameters for Http transport
@@ -86,8 +183,11 @@ func DefaulTransportHttpParams() TransportHttpParams {
 		DetectorInjectTimeout:  1 * time.Second,
 		DetectorProcessTimeout: 5 * time.Second,
 		RpcTimeout:             5 * time.Second,
+		ShutdownTimeout:        10 * time.Second,
 		IncomingBufferSize:     100,
 		HttpClient:             http.Client{},
+		Metrics:                MetricsNoop{},
+		Tracer:                 TracerNoop{},
 		Ctx:                    context.Background(),
 	}
 }
@@ -105,75 +205,293 @@ func NewTransportHttp(params TransportHttpParams) *TransportHttp {
 		},
 		TransportHttpParams: params,
 		inChan:              make(chan IncomingRequest, params.IncomingBufferSize),
+		served:              make(chan struct{}),
 	}
 }
 
-// Run main loop
-func (t *TransportHttp) Run(errch chan<- error) {
+// Start serving requests in the background
+func (t *TransportHttp) Start(ctx context.Context) error {
+	t.lifeMu.Lock()
+	defer t.lifeMu.Unlock()
+
+	switch {
+	case t.started:
+		return errors.New("http transport is already started")
+	case t.shutdown:
+		return errors.New("http transport is shut down")
+	case ctx.Err() != nil:
+		return errors.WithStack(ctx.Err())
+	}
+
 	// API endpoints
 	t.setupHandlers()
 
-	ctx, cancel := context.WithCancel(t.Ctx)
-	defer cancel()
-
-	// Shutdown http server upon global signal
-	go func() {
-		<-ctx.Done()
-		_ = t.server.Shutdown(ctx)
-	}()
-
 	useTls := t.TLSCertFile != "" && t.TLSKeyFile != ""
 	mode := ""
 
 	if useTls {
 		mode = " [TLS]"
+
+		if err := t.ReloadCertificate(); err != nil {
+			return err
+		}
+
+		t.server.TLSConfig = &tls.Config{
+			GetCertificate: t.getCertificate,
+		}
 	}
 
-	t.Logger.Info("starting HTTP transport %s at %s",
+	t.Logger.Info("starting HTTP transport%s at %s",
 		mode, t.Listener.Addr().String())
 
-	var err error
+	t.started = true
 
-	if useTls {
-		err = t.server.ServeTLS(t.Listener, t.TLSCertFile, t.TLSKeyFile)
-	} else {
-		err = t.server.Serve(t.Listener)
+	go func() {
+		defer close(t.served)
+
+		var err error
+
+		if useTls {
+			err = t.server.ServeTLS(t.Listener, "", "")
+		} else {
+			err = t.server.Serve(t.Listener)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			t.Logger.Error("HTTP transport stopped serving: %s", err)
+
+			t.serveErr = errors.WithStack(err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop accepting new requests and wait for the ones in progress.
+// Connections still busy once ShutdownTimeout passes or context is done
+// are closed. Calls after the first one return immediately.
+func (t *TransportHttp) Shutdown(ctx context.Context) error {
+	t.lifeMu.Lock()
+
+	started, shutdown := t.started, t.shutdown
+	t.shutdown = true
+
+	t.lifeMu.Unlock()
+
+	if !started || shutdown {
+		return nil
 	}
 
+	if t.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, t.ShutdownTimeout)
+		defer cancel()
+	}
+
+	var errs MultiError
+
+	if err := t.server.Shutdown(ctx); err != nil {
+		// Drain deadline passed, drop remaining connections
+		_ = t.server.Close()
+
+		errs = append(errs, errors.Wrap(err, "error draining HTTP requests"))
+	}
+
+	<-t.served
+
+	if t.serveErr != nil {
+		errs = append(errs, t.serveErr)
+	}
+
+	t.Logger.Info("HTTP transport is shut down")
+
+	return errs.errorOrNil()
+}
+
+// Register f to be called when shutdown begins, long-lived
+// responses like event streams should end upon it
+func (t *TransportHttp) OnShutdown(f func()) {
+	t.server.RegisterOnShutdown(f)
+}
+
+// Load TLS certificate and key from the configured files again,
+// new connections use the reloaded certificate
+func (t *TransportHttp) ReloadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(t.TLSCertFile, t.TLSKeyFile)
+
 	if err != nil {
-		errch <- errors.WithStack(err)
+		return errors.Wrap(err, "error loading TLS certificate")
 	}
+
+	t.certMu.Lock()
+	t.cert = &cert
+	t.certMu.Unlock()
+
+	return nil
+}
+
+func (t *TransportHttp) getCertificate(
+	*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	t.certMu.RLock()
+	defer t.certMu.RUnlock()
+
+	return t.cert, nil
 }
 
 func (t *TransportHttp) setupHandlers() {
 	// POST /v1/ping/direct - Direct ping
 	t.router.HandleFunc("/v1/ping/direct", t.pingDirectHandler).
 		Methods(http.MethodPost)
+
+	// POST /v1/ping/indirect - Indirect ping
+	t.router.HandleFunc("/v1/ping/indirect", t.pingIndirectHandler).
+		Methods(http.MethodPost)
+
+	// POST /v1/query/response - Response to a query
+	t.router.HandleFunc("/v1/query/response", t.queryResponseHandler).
+		Methods(http.MethodPost)
+
+	// POST /v1/pushpull - Full state exchange
+	t.router.HandleFunc("/v1/pushpull", t.pushPullHandler).
+		Methods(http.MethodPost)
 }
 
 func (t *TransportHttp) pingDirectHandler(
 	w http.ResponseWriter,
 	req *http.Request,
 ) {
+	ctx, span := t.startServerSpan(req, "direct_ping")
+	defer span.End()
+
+	preq := RequestDirectPing{}
+
+	if t.decodeRequest(w, req, "direct_ping", &preq) {
+		t.injectRequest(ctx, w, req, "direct_ping", preq)
+	}
+}
+
+func (t *TransportHttp) pingIndirectHandler(
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx, span := t.startServerSpan(req, "indirect_ping")
+	defer span.End()
+
+	preq := RequestIndirectPing{}
+
+	if t.decodeRequest(w, req, "indirect_ping", &preq) {
+		t.injectRequest(ctx, w, req, "indirect_ping", preq)
+	}
+}
+
+func (t *TransportHttp) queryResponseHandler(
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx, span := t.startServerSpan(req, "query_response")
+	defer span.End()
+
+	preq := RequestQueryResponse{}
+
+	if t.decodeRequest(w, req, "query_response", &preq) {
+		t.injectRequest(ctx, w, req, "query_response", preq)
+	}
+}
+
+func (t *TransportHttp) pushPullHandler(
+	w http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx, span := t.startServerSpan(req, "push_pull")
+	defer span.End()
+
+	preq := RequestPushPull{}
+
+	if t.decodeRequest(w, req, "push_pull", &preq) {
+		t.injectRequest(ctx, w, req, "push_pull", preq)
+	}
+}
+
+// Start a span for an incoming request, continuing caller's trace if any
+func (t *TransportHttp) startServerSpan(
+	req *http.Request,
+	msgType string,
+) (context.Context, Span) {
+	ctx := t.Ctx
+
+	if hdr := req.Header.Get(TraceParentHeader); hdr != "" {
+		if sc, err := ParseTraceParent(hdr); err == nil {
+			ctx = ContextWithRemoteParent(ctx, sc)
+		}
+	}
+
+	return t.Tracer.Start(ctx, "tattle.http."+msgType)
+}
+
+// Decode request body into dst, responding with an error if that fails
+func (t *TransportHttp) decodeRequest(
+	w http.ResponseWriter,
+	req *http.Request,
+	msgType string,
+	dst Request,
+) bool {
 	var resp Response
 
 	//noinspection GoUnhandledErrorResult
 	defer req.Body.Close()
 
-	preq := RequestDirectPing{}
+	counter := &countingReader{reader: req.Body}
+	body, err := decodeContent(counter, req.Header.Get("Content-Encoding"))
+
+	if err != nil {
+		t.Logger.Error("error reading request body: %s", err)
+
+		t.apiResponse(w, req, http.StatusUnsupportedMediaType,
+			"unsupported content encoding", resp)
+
+		return false
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer body.Close()
 
-	if err := t.Codec.DecodeRequest(req.Body, &preq); err != nil {
+	if err := t.Codec.DecodeRequest(body, dst); err != nil {
 		t.Logger.Error("error decoding request body: %s", err)
 
-		t.apiResponse(w, http.StatusBadRequest,
-			"error decoding request body", resp)
+		t.Metrics.Add(MetricDecodeErrors, 1, msgType, decodeErrorReason(err))
 
-		return
+		code := http.StatusBadRequest
+
+		if errors.Cause(err) == ErrMessageTooLarge {
+			code = http.StatusRequestEntityTooLarge
+		}
+
+		t.apiResponse(w, req, code, "error decoding request body", resp)
+
+		return false
 	}
 
-	respChan := make(chan Response)
+	t.Metrics.Add(MetricBytesIn, float64(counter.count), msgType)
+
+	return true
+}
+
+// Pass a decoded request to detector and send back its response
+func (t *TransportHttp) injectRequest(
+	ctx context.Context,
+	w http.ResponseWriter,
+	req *http.Request,
+	msgType string,
+	preq Request,
+) {
+	var resp Response
+
+	respChan := make(chan Response, 1)
 
 	inReq := IncomingRequest{
+		Ctx:          ctx,
 		Request:      preq,
 		ResponseChan: respChan,
 	}
@@ -184,11 +502,13 @@ func (t *TransportHttp) pingDirectHandler(
 	select {
 	case t.inChan <- inReq:
 	case <-opTimer.C:
-		NumberOfInjectTimeouts.WithLabelValues("direct_ping").Inc()
+		t.Metrics.Add(MetricInjectTimeouts, 1, msgType)
 
 		// This can happen if detector loop is overloaded
-		t.apiResponse(w, http.StatusServiceUnavailable,
+		t.apiResponse(w, req, http.StatusServiceUnavailable,
 			"timeout injecting a request, detector is likely overloaded", resp)
+
+		return
 	}
 
 	// Now wait for response
@@ -199,16 +519,16 @@ func (t *TransportHttp) pingDirectHandler(
 
 	select {
 	case <-t.Ctx.Done():
-		t.apiResponse(w, http.StatusServiceUnavailable,
+		t.apiResponse(w, req, http.StatusServiceUnavailable,
 			"context was cancelled", resp)
 
 	case resp = <-respChan:
-		t.apiResponse(w, http.StatusOK, "", resp)
+		t.apiResponse(w, req, http.StatusOK, "", resp)
 
 	case <-opTimer.C:
-		NumberOfProcessTimeouts.WithLabelValues("direct_ping").Inc()
+		t.Metrics.Add(MetricProcessTimeouts, 1, msgType)
 
-		t.apiResponse(w, http.StatusServiceUnavailable,
+		t.apiResponse(w, req, http.StatusServiceUnavailable,
 			"timeout waiting for a response, detector is likely overloaded",
 			resp)
 	}
@@ -216,6 +536,7 @@ func (t *TransportHttp) pingDirectHandler(
 
 // Send a request to a remote peer
 func (t *TransportHttp) Rpc(
+	ctx context.Context,
 	peer Peer,
 	req Request,
 	timeout time.Duration,
@@ -241,11 +562,21 @@ func (t *TransportHttp) Rpc(
 	rawUrl := fmt.Sprintf("%s://%s:%d",
 		httpPeer.Protocol, httpPeer.Host, httpPeer.Port)
 
+	var msgType string
+
 	switch req.(type) {
 	case RequestDirectPing:
 		rawUrl += "/v1/ping/direct"
+		msgType = "direct_ping"
 	case RequestIndirectPing:
 		rawUrl += "/v1/ping/indirect"
+		msgType = "indirect_ping"
+	case RequestQueryResponse:
+		rawUrl += "/v1/query/response"
+		msgType = "query_response"
+	case RequestPushPull:
+		rawUrl += "/v1/pushpull"
+		msgType = "push_pull"
 	default:
 		return resp, errors.Errorf("unexpected request type: %T", req)
 	}
@@ -258,35 +589,100 @@ func (t *TransportHttp) Rpc(
 
 	httpReq.URL = uri
 
+	ctx, span := t.Tracer.Start(ctx, "tattle.rpc."+msgType)
+	defer span.End()
+
+	span.SetAttribute(LogFieldPeerId, peer.PeerId())
+
+	// Noop tracer without a parent span has nothing to propagate
+	if sc := span.Context(); sc.IsValid() {
+		hdr.Set(TraceParentHeader, sc.TraceParent())
+	}
+
 	t.Logger.Debug("about to make rpc to %s", rawUrl)
 
 	// Now prepare body
 	buf := new(bytes.Buffer)
 
 	if err := t.Codec.EncodeRequest(req, buf); err != nil {
+		t.Metrics.Add(MetricEncodeErrors, 1, msgType)
+
 		return resp, errors.Wrap(err, "error encoding rpc")
 	}
 
+	if t.CompressThreshold > 0 {
+		hdr.Set("Accept-Encoding", "gzip")
+
+		if buf.Len() >= t.CompressThreshold {
+			if buf, err = gzipBytes(buf.Bytes()); err != nil {
+				return resp, errors.Wrap(err, "error compressing rpc")
+			}
+
+			hdr.Set("Content-Encoding", "gzip")
+		}
+	}
+
+	t.Metrics.Add(MetricBytesOut, float64(buf.Len()), msgType)
+
 	httpReq.Body = ioutil.NopCloser(buf)
-	ctx, cancel := context.WithTimeout(t.Ctx, t.RpcTimeout)
+
+	if timeout <= 0 || timeout > t.RpcTimeout {
+		timeout = t.RpcTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	httpResp, err := t.HttpClient.Do(httpReq.WithContext(ctx))
 
 	if err != nil {
+		span.RecordError(err)
+
 		return resp, errors.Wrapf(err, "rpc error to %s", rawUrl)
 	}
 
 	//noinspection GoUnhandledErrorResult
 	defer httpResp.Body.Close()
 
-	if err = t.Codec.DecodeResponse(httpResp.Body, &resp); err != nil {
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		err := errors.Errorf("rpc to %s failed with status %d: %s",
+			rawUrl, httpResp.StatusCode, msg)
+
+		span.RecordError(err)
+
+		return resp, err
+	}
+
+	counter := &countingReader{reader: httpResp.Body}
+	body, err := decodeContent(
+		counter, httpResp.Header.Get("Content-Encoding"))
+
+	if err != nil {
+		return resp, errors.Wrap(err, "error reading response")
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer body.Close()
+
+	if err = t.Codec.DecodeResponse(body, &resp); err != nil {
+		t.Metrics.Add(MetricDecodeErrors, 1,
+			"response", decodeErrorReason(err))
+
 		return resp, errors.Wrap(err, "error decoding response")
 	}
 
+	t.Metrics.Add(MetricBytesIn, float64(counter.count), "response")
+
 	return resp, nil
 }
 
+// Return the router requests are served with, can be used to mount
+// additional endpoints before the detector starts the transport
+func (t *TransportHttp) Router() *mux.Router {
+	return t.router
+}
+
 // Return a channel of incoming requests from other peers
 func (t *TransportHttp) IncomingRequests() <-chan IncomingRequest {
 	return t.inChan
@@ -294,24 +690,130 @@ func (t *TransportHttp) IncomingRequests() <-chan IncomingRequest {
 
 func (t *TransportHttp) apiResponse(
 	w http.ResponseWriter,
+	req *http.Request,
 	code int,
 	errorMsg string,
 	resp Response) {
 
-	w.WriteHeader(code)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	var err error
 
 	if len(errorMsg) > 0 {
+		w.WriteHeader(code)
+
 		_, err = io.WriteString(w, errorMsg)
 	} else {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-
-		err = t.Codec.EncodeResponse(resp, w)
+		err = t.writeResponse(w, req, code, resp)
 	}
 
 	if err != nil {
 		t.Logger.Error("Error sending API response: %s", err)
 	}
 }
+
+// Encode a response, compressing it if client supports that
+func (t *TransportHttp) writeResponse(
+	w http.ResponseWriter,
+	req *http.Request,
+	code int,
+	resp Response) error {
+
+	buf := new(bytes.Buffer)
+
+	if err := t.Codec.EncodeResponse(resp, buf); err != nil {
+		t.Metrics.Add(MetricEncodeErrors, 1, "response")
+
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return errors.Wrap(err, "error encoding response")
+	}
+
+	if t.CompressThreshold > 0 &&
+		buf.Len() >= t.CompressThreshold && acceptsGzip(req) {
+
+		gz, err := gzipBytes(buf.Bytes())
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return errors.Wrap(err, "error compressing response")
+		}
+
+		buf = gz
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+
+	t.Metrics.Add(MetricBytesOut, float64(buf.Len()), "response")
+
+	_, err := w.Write(buf.Bytes())
+
+	return errors.WithStack(err)
+}
+
+// Wrap a reader into a decoder for the given content encoding
+func decodeContent(reader io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return ioutil.NopCloser(reader), nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(reader)
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return gz, nil
+	default:
+		return nil, errors.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// Check if a client is willing to accept gzip-encoded response
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+
+		if idx := strings.Index(enc, ";"); idx >= 0 {
+			enc = strings.TrimSpace(enc[:idx])
+		}
+
+		if enc == "gzip" || enc == "x-gzip" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Gzip a byte slice into a new buffer
+func gzipBytes(payload []byte) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+
+	if _, err := gz.Write(payload); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return buf, nil
+}
+
+// Reader which counts the number of bytes read
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+
+	return n, err
+}
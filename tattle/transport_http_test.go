@@ -0,0 +1,180 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTransportHttpLifecycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string
+		// Index of the step expected to fail, -1 if none
+		fails int
+	}{
+		{name: "start and shutdown",
+			steps: []string{"start", "shutdown"}, fails: -1},
+		{name: "shutdown before start",
+			steps: []string{"shutdown"}, fails: -1},
+		{name: "shutdown twice",
+			steps: []string{"start", "shutdown", "shutdown"}, fails: -1},
+		{name: "start twice",
+			steps: []string{"start", "start"}, fails: 1},
+		{name: "start after shutdown",
+			steps: []string{"start", "shutdown", "start"}, fails: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, _ := newTestTransport(t, nil)
+
+			for i, step := range test.steps {
+				var err error
+
+				switch step {
+				case "start":
+					err = tr.Start(context.Background())
+				case "shutdown":
+					err = tr.Shutdown(context.Background())
+				}
+
+				if failed := err != nil; failed != (i == test.fails) {
+					t.Errorf("step %d %s: %v", i, step, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTransportHttpRpc(t *testing.T) {
+	server, serverPeer := newTestTransport(t, nil)
+	client, _ := newTestTransport(t, nil)
+
+	startTestTransport(t, server)
+	startTestTransport(t, client)
+
+	serveTestRequests(t, server, func(inReq IncomingRequest) Response {
+		return Response{Updates: []UpdateEvent{{
+			Peer:       fakePeer("a"),
+			UpdateType: UpdateTypePeerAlive,
+			SeqNum:     7,
+		}}}
+	})
+
+	resp, err := client.Rpc(context.Background(), serverPeer,
+		RequestDirectPing{}, time.Second)
+
+	if err != nil {
+		t.Fatalf("rpc: %+v", err)
+	}
+
+	if len(resp.Updates) != 1 || resp.Updates[0].SeqNum != 7 ||
+		resp.Updates[0].Peer.PeerId() != "a" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestTransportHttpDrain(t *testing.T) {
+	tests := []struct {
+		name            string
+		shutdownTimeout time.Duration
+		completed       bool
+	}{
+		{name: "request completes", shutdownTimeout: time.Second,
+			completed: true},
+		{name: "drain times out", shutdownTimeout: 50 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, peer := newTestTransport(t, func(params *TransportHttpParams) {
+				params.ShutdownTimeout = test.shutdownTimeout
+			})
+
+			started := make(chan struct{})
+
+			tr.Router().HandleFunc("/slow",
+				func(w http.ResponseWriter, r *http.Request) {
+					close(started)
+					time.Sleep(200 * time.Millisecond)
+					w.WriteHeader(http.StatusOK)
+				})
+
+			startTestTransport(t, tr)
+
+			status := make(chan int, 1)
+
+			go func() {
+				resp, err := http.Get(peer.String() + "/slow")
+
+				if err != nil {
+					status <- 0
+
+					return
+				}
+
+				_ = resp.Body.Close()
+				status <- resp.StatusCode
+			}()
+
+			<-started
+
+			err := tr.Shutdown(context.Background())
+
+			if (err == nil) != test.completed {
+				t.Errorf("shutdown returned %v", err)
+			}
+
+			if completed := <-status == http.StatusOK; completed != test.completed {
+				t.Errorf("request completed %v, want %v",
+					completed, test.completed)
+			}
+		})
+	}
+}
+
+func TestDetectorManagesTransport(t *testing.T) {
+	nodes := newTestCluster(t, 2, nil)
+
+	waitState(t, nodes, "node-1", MemberStateAlive, 5*time.Second)
+
+	if err := nodes[1].Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %+v", err)
+	}
+
+	if _, err := http.Get(nodes[1].peer.String()); err == nil {
+		t.Error("transport still serves after the detector stopped")
+	}
+
+	waitFor(t, 5*time.Second, "node-1 to be gone", func() bool {
+		state := nodes[0].stateOf("node-1")
+
+		return state == MemberStateDead || state == MemberStateLeft
+	})
+}
@@ -0,0 +1,246 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// Returned when user event name and payload exceed the size limit
+	ErrUserEventTooLarge = errors.New("user event is too large")
+)
+
+// Lamport logical clock
+type LamportClock struct {
+	counter uint64
+}
+
+// Return current time
+func (c *LamportClock) Time() uint64 {
+	return atomic.LoadUint64(&c.counter)
+}
+
+// Advance the clock returning the new time
+func (c *LamportClock) Increment() uint64 {
+	return atomic.AddUint64(&c.counter, 1)
+}
+
+// Move the clock past a time observed in a received message
+func (c *LamportClock) Witness(t uint64) {
+	for {
+		cur := atomic.LoadUint64(&c.counter)
+
+		if t < cur || atomic.CompareAndSwapUint64(&c.counter, cur, t+1) {
+			return
+		}
+	}
+}
+
+// Application event disseminated through the cluster
+type UserEvent struct {
+	// Lamport time of the event
+	LTime   uint64
+	Name    string
+	Payload []byte `json:",omitempty"`
+	// Coalescing events with the same name replace older ones,
+	// so that only the latest of them is delivered
+	Coalesce bool `json:",omitempty"`
+}
+
+// Key identifying the event in the broadcast queue
+func (e UserEvent) key() string {
+	if e.Coalesce {
+		return e.Name
+	}
+
+	return strconv.FormatUint(e.LTime, 10) + "/" + e.Name + "/" +
+		string(e.Payload)
+}
+
+// Recently seen user events used to deliver every event once.
+// Events are grouped by Lamport time, events older than the buffer
+// size relative to the clock are considered stale.
+type userEventBuffer struct {
+	mu    sync.Mutex
+	slots []userEventSlot
+	// Lamport time of the latest coalescing event by name
+	coalesced map[string]uint64
+}
+
+type userEventSlot struct {
+	ltime  uint64
+	events []UserEvent
+}
+
+func newUserEventBuffer(size int) *userEventBuffer {
+	if size < 1 {
+		size = 1
+	}
+
+	return &userEventBuffer{
+		slots:     make([]userEventSlot, size),
+		coalesced: map[string]uint64{},
+	}
+}
+
+// Remember the event, return false if it was already seen,
+// is too old or was superseded by a newer coalescing event
+func (b *userEventBuffer) add(ev UserEvent, now uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := uint64(len(b.slots))
+
+	if now > size && ev.LTime < now-size {
+		return false
+	}
+
+	if ev.Coalesce && ev.LTime < b.coalesced[ev.Name] {
+		return false
+	}
+
+	slot := &b.slots[ev.LTime%size]
+
+	if slot.ltime != ev.LTime {
+		slot.ltime = ev.LTime
+		slot.events = nil
+	}
+
+	for _, seen := range slot.events {
+		if seen.Name == ev.Name && bytes.Equal(seen.Payload, ev.Payload) {
+			return false
+		}
+	}
+
+	slot.events = append(slot.events, ev)
+
+	if ev.Coalesce {
+		b.coalesced[ev.Name] = ev.LTime
+	}
+
+	return true
+}
+
+// Fire a user event disseminating it through the cluster.
+// Name and payload together must fit into UserEventSizeLimit.
+// The event is delivered to the local handler as well.
+func (d *Detector) UserEvent(name string, payload []byte, coalesce bool) error {
+	if name == "" {
+		return errors.New("user event name is empty")
+	}
+
+	if size := len(name) + len(payload); size > d.UserEventSizeLimit {
+		return errors.Wrapf(ErrUserEventTooLarge,
+			"%d bytes, limit is %d", size, d.UserEventSizeLimit)
+	}
+
+	if d.isLeaving() {
+		return errors.WithStack(ErrLeft)
+	}
+
+	d.receiveUserEvent(UserEvent{
+		LTime:    d.userClock.Increment(),
+		Name:     name,
+		Payload:  payload,
+		Coalesce: coalesce,
+	})
+
+	return nil
+}
+
+// Return current Lamport time of user events
+func (d *Detector) UserEventTime() uint64 {
+	return d.userClock.Time()
+}
+
+// Apply user events received from other peers
+func (d *Detector) applyUserEvents(events []UserEvent) {
+	for _, ev := range events {
+		d.userClock.Witness(ev.LTime)
+
+		// Reject whatever doesn't respect the size limit
+		if len(ev.Name)+len(ev.Payload) > d.UserEventSizeLimit {
+			continue
+		}
+
+		d.receiveUserEvent(ev)
+	}
+}
+
+// Deliver and rebroadcast an event unless it was seen before
+func (d *Detector) receiveUserEvent(ev UserEvent) {
+	if !d.userEvents.add(ev, d.userClock.Time()) {
+		return
+	}
+
+	d.userBroadcasts.queue(ev.key(), ev)
+
+	if d.UserEventHandler == nil {
+		return
+	}
+
+	select {
+	case d.userDelivery <- ev:
+	default:
+		d.Logger.Warning("user event handler is too slow, dropping %s event",
+			ev.Name)
+	}
+}
+
+// Pass user events to the handler one by one until detector stops
+func (d *Detector) deliverUserEvents() {
+	for {
+		select {
+		case <-d.Ctx.Done():
+			return
+		case ev := <-d.userDelivery:
+			d.UserEventHandler(ev)
+		}
+	}
+}
+
+// Return user events to piggyback onto an outgoing message
+func (d *Detector) piggybackUserEvents() []UserEvent {
+	msgs := d.userBroadcasts.get(
+		d.Tuning().MaxPiggybackUpdates, d.retransmitLimit())
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	events := make([]UserEvent, 0, len(msgs))
+
+	for _, msg := range msgs {
+		events = append(events, msg.(UserEvent))
+	}
+
+	return events
+}
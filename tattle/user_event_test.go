@@ -0,0 +1,253 @@
+/*
+ MIT License
+
+ Copyright (c) 2019 Max Kuznetsov <syhpoon@syhpoon.ca>
+
+ Permission is hereby granted, free of charge, to any person obtaining a copy
+ of this software and associated documentation files (the "Software"), to deal
+ in the Software without restriction, including without limitation the rights
+ to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ copies of the Software, and to permit persons to whom the Software is
+ furnished to do so, subject to the following conditions:
+
+ The above copyright notice and this permission notice shall be included in all
+ copies or substantial portions of the Software.
+
+ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ SOFTWARE.
+*/
+
+package tattle
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLamportClockWitness(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   uint64
+		witness uint64
+		want    uint64
+	}{
+		{"fresh clock", 0, 0, 1},
+		{"behind", 5, 3, 5},
+		{"equal", 5, 5, 6},
+		{"ahead", 5, 9, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &LamportClock{counter: test.start}
+			c.Witness(test.witness)
+
+			if got := c.Time(); got != test.want {
+				t.Errorf("time = %d, want %d", got, test.want)
+			}
+
+			if got := c.Increment(); got != test.want+1 {
+				t.Errorf("increment = %d, want %d", got, test.want+1)
+			}
+		})
+	}
+}
+
+func TestLamportClockConcurrent(t *testing.T) {
+	c := &LamportClock{}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				c.Witness(uint64(i * j))
+				c.Increment()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Witnessed times only move the clock forward,
+	// so at least every increment is counted
+	if c.Time() < 800 {
+		t.Errorf("time = %d, want at least 800", c.Time())
+	}
+}
+
+func TestUserEventBufferAdd(t *testing.T) {
+	type add struct {
+		ev   UserEvent
+		now  uint64
+		want bool
+	}
+
+	tests := []struct {
+		name string
+		adds []add
+	}{
+		{"duplicate", []add{
+			{UserEvent{LTime: 1, Name: "a"}, 1, true},
+			{UserEvent{LTime: 1, Name: "a"}, 1, false},
+		}},
+		{"same time different payload", []add{
+			{UserEvent{LTime: 1, Name: "a", Payload: []byte("x")}, 1, true},
+			{UserEvent{LTime: 1, Name: "a", Payload: []byte("y")}, 1, true},
+			{UserEvent{LTime: 1, Name: "b", Payload: []byte("x")}, 1, true},
+		}},
+		{"stale", []add{
+			{UserEvent{LTime: 2, Name: "a"}, 10, false},
+			{UserEvent{LTime: 6, Name: "a"}, 10, true},
+		}},
+		{"slot reused", []add{
+			{UserEvent{LTime: 1, Name: "a"}, 1, true},
+			{UserEvent{LTime: 5, Name: "a"}, 5, true},
+			{UserEvent{LTime: 9, Name: "a"}, 9, true},
+		}},
+		{"coalesced", []add{
+			{UserEvent{LTime: 3, Name: "a", Coalesce: true}, 3, true},
+			{UserEvent{LTime: 2, Name: "a", Coalesce: true}, 3, false},
+			{UserEvent{LTime: 2, Name: "a"}, 3, true},
+			{UserEvent{LTime: 4, Name: "a", Coalesce: true}, 4, true},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newUserEventBuffer(4)
+
+			for i, a := range test.adds {
+				if got := b.add(a.ev, a.now); got != a.want {
+					t.Errorf("add #%d of %+v = %v, want %v", i+1, a.ev, got, a.want)
+				}
+			}
+		})
+	}
+}
+
+func TestUserEventValidation(t *testing.T) {
+	d := newTestDetector(t, testDetectorParams(newFakeTransport(nil),
+		fakePeer("local"), fakePeer("seed")))
+
+	tests := []struct {
+		name      string
+		event     string
+		payload   []byte
+		wantErr   bool
+		wantCause error
+	}{
+		{"valid", "deploy", []byte("v1"), false, nil},
+		{"empty name", "", nil, true, nil},
+		{"too large", "deploy", make([]byte, d.UserEventSizeLimit),
+			true, ErrUserEventTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := d.UserEvent(test.event, test.payload, false)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+
+			if test.wantCause != nil && errors.Cause(err) != test.wantCause {
+				t.Errorf("err = %v, want %v", err, test.wantCause)
+			}
+		})
+	}
+}
+
+func TestUserEventDelivery(t *testing.T) {
+	params := testDetectorParams(newFakeTransport(nil),
+		fakePeer("local"), fakePeer("seed"))
+	params.UserEventHandler = func(UserEvent) {}
+
+	// Detector is not started, so delivered events stay queued
+	d := newTestDetector(t, params)
+
+	if err := d.UserEvent("local", nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	d.applyUserEvents([]UserEvent{
+		{LTime: 10, Name: "remote"},
+		{LTime: 10, Name: "remote"},
+		{LTime: 11, Name: "huge", Payload: make([]byte, d.UserEventSizeLimit)},
+	})
+
+	// Remote events move the clock forward even when rejected
+	if got := d.UserEventTime(); got != 12 {
+		t.Errorf("time = %d, want 12", got)
+	}
+
+	var delivered []UserEvent
+
+	for len(d.userDelivery) > 0 {
+		delivered = append(delivered, <-d.userDelivery)
+	}
+
+	if len(delivered) != 2 ||
+		delivered[0].Name != "local" || delivered[0].LTime != 1 ||
+		delivered[1].Name != "remote" || delivered[1].LTime != 10 {
+
+		t.Errorf("delivered %+v", delivered)
+	}
+
+	if events := d.piggybackUserEvents(); len(events) != 2 {
+		t.Errorf("piggybacked %+v, want both events", events)
+	}
+}
+
+func TestUserEventPropagation(t *testing.T) {
+	var mu sync.Mutex
+
+	received := map[int][]string{}
+
+	nodes := newTestCluster(t, 3, func(i int, params *DetectorParams) {
+		params.UserEventHandler = func(ev UserEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			received[i] = append(received[i], ev.Name)
+		}
+	})
+
+	waitState(t, nodes, "node-2", MemberStateAlive, 5*time.Second)
+
+	if err := nodes[2].UserEvent("deploy", []byte("v2"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 5*time.Second, "event delivery", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(received[0]) > 0 && len(received[1]) > 0 &&
+			len(received[2]) > 0
+	})
+
+	// Rebroadcasts don't deliver the event twice
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for i, names := range received {
+		if len(names) != 1 || names[0] != "deploy" {
+			t.Errorf("node-%d received %v", i, names)
+		}
+	}
+}